@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// DefaultAntiEntropyInterval is how often replicas are compared with every
+// peer when FileServerOpts.AntiEntropyInterval is not set.
+const DefaultAntiEntropyInterval = time.Minute
+
+// TombstoneGracePeriod is how long a deleted replica is remembered. A node
+// that stays offline for longer may bring the object back.
+const TombstoneGracePeriod = 7 * 24 * time.Hour
+
+// MessageSyncTree asks for the hashes of some nodes of the sender's Merkle
+// tree of the replicas both ends hold. All requests of one sync carry the
+// same Session, so the tree is only built once.
+type MessageSyncTree struct {
+	Session uint64
+	Level   int
+	Nodes   []int
+}
+
+type MessageSyncTreeReply struct {
+	Hashes [][]byte
+}
+
+// MessageSyncBucket asks for the replicas in the given leaves of the tree.
+type MessageSyncBucket struct {
+	Session uint64
+	Buckets []int
+}
+
+type MessageSyncBucketReply struct {
+	Metas []Meta
+}
+
+// syncSession is the tree a peer is walking while it syncs with us.
+type syncSession struct {
+	id   uint64
+	tree *MerkleTree
+}
+
+func (s *FileServer) antiEntropyLoop() {
+	if s.AntiEntropyInterval < 0 {
+		return
+	}
+
+	for {
+		// Jitter keeps nodes from syncing with each other in lockstep.
+		wait := s.AntiEntropyInterval/2 + time.Duration(rand.Int63n(int64(s.AntiEntropyInterval)))
+		select {
+		case <-time.After(wait):
+		case <-s.QuitCh:
+			return
+		}
+
+		s.purgeTombstones()
+		s.hints.expire()
+		for _, peer := range s.peerList() {
+			if err := s.syncWith(peer); err != nil {
+				log.Printf("[%s] anti-entropy with %s: %v\n", s.Transport.Addr(), peer.ID(), err)
+			}
+		}
+	}
+}
+
+func (s *FileServer) purgeTombstones() {
+	metas, err := replicaMetas(s.Store)
+	if err != nil {
+		log.Printf("[%s] purge tombstones: %v\n", s.Transport.Addr(), err)
+		return
+	}
+
+	for _, meta := range metas {
+		if meta.Deleted && time.Since(time.Unix(0, meta.Version)) > TombstoneGracePeriod {
+			if err := s.Store.Delete(meta.Key); err != nil {
+				log.Printf("[%s] purge tombstone (%s): %v\n", s.Transport.Addr(), meta.Key, err)
+			}
+		}
+	}
+}
+
+// merkleTreeFor builds the tree over the replicas this node and peer are
+// both owners of.
+func (s *FileServer) merkleTreeFor(peer string) (*MerkleTree, error) {
+	metas, err := replicaMetas(s.Store)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := metas[:0]
+	for _, meta := range metas {
+		self, other := false, false
+		for _, id := range s.ring.Owners(meta.Key, s.ReplicationFactor) {
+			self = self || id == s.NodeID
+			other = other || id == peer
+		}
+		if self && other {
+			shared = append(shared, meta)
+		}
+	}
+
+	return NewMerkleTree(shared), nil
+}
+
+// syncWith compares the replicas shared with peer, descending the Merkle
+// tree only where the hashes differ, and then exchanges the objects of the
+// buckets that disagree.
+func (s *FileServer) syncWith(peer p2p.Peer) error {
+	tree, err := s.merkleTreeFor(peer.ID())
+	if err != nil {
+		return err
+	}
+
+	session := rand.Uint64()
+	nodes := []int{0}
+
+	for level := 0; ; level++ {
+		res, err := s.requestOne(peer, MessageSyncTree{Session: session, Level: level, Nodes: nodes})
+		if err != nil {
+			return err
+		}
+
+		remote := res.(MessageSyncTreeReply).Hashes
+		local := tree.Hashes(level, nodes)
+		if len(remote) != len(nodes) {
+			return fmt.Errorf("got %d tree hashes, want %d", len(remote), len(nodes))
+		}
+
+		var diff []int
+		for i, n := range nodes {
+			if !bytes.Equal(local[i], remote[i]) {
+				diff = append(diff, n)
+			}
+		}
+		if len(diff) == 0 {
+			return nil
+		}
+		if level == merkleDepth {
+			nodes = diff
+			break
+		}
+		nodes = merkleChildren(diff)
+	}
+
+	res, err := s.requestOne(peer, MessageSyncBucket{Session: session, Buckets: nodes})
+	if err != nil {
+		return err
+	}
+
+	var mine []Meta
+	for _, b := range nodes {
+		mine = append(mine, tree.Bucket(b)...)
+	}
+
+	return s.reconcile(peer, mine, res.(MessageSyncBucketReply).Metas)
+}
+
+// reconcile pushes the replicas this node has newer versions of to peer and
+// pulls the ones peer has newer versions of. Tombstones travel the same way.
+func (s *FileServer) reconcile(peer p2p.Peer, mine, theirs []Meta) error {
+	remote := make(map[string]Meta, len(theirs))
+	for _, meta := range theirs {
+		remote[meta.Key] = meta
+	}
+
+	pushed, pulled := 0, 0
+
+	for _, local := range mine {
+		other, ok := remote[local.Key]
+		delete(remote, local.Key)
+
+		switch {
+		case !ok || local.Version > other.Version:
+			if err := s.pushReplica(peer, s.Store, local); err != nil {
+				log.Printf("[%s] push (%s) to %s: %v\n", s.Transport.Addr(), local.Key, peer.ID(), err)
+				continue
+			}
+			pushed++
+
+		case other.Version > local.Version:
+			if err := s.pullReplica(peer, other); err != nil {
+				log.Printf("[%s] pull (%s) from %s: %v\n", s.Transport.Addr(), other.Key, peer.ID(), err)
+				continue
+			}
+			pulled++
+
+		case local.Checksum != other.Checksum || local.Deleted != other.Deleted:
+			log.Printf("[%s] replica (%s) version %d differs from %s, leaving it alone\n", s.Transport.Addr(), local.Key, local.Version, peer.ID())
+		}
+	}
+
+	// Whatever is left is missing here entirely. The peer's view of the
+	// ring may differ from ours, so only take what we own.
+	for key, other := range remote {
+		if !s.ownsReplica(key) {
+			continue
+		}
+		if err := s.pullReplica(peer, other); err != nil {
+			log.Printf("[%s] pull (%s) from %s: %v\n", s.Transport.Addr(), key, peer.ID(), err)
+			continue
+		}
+		pulled++
+	}
+
+	fmt.Printf("[%s] anti-entropy with %s: pushed %d, pulled %d replicas\n", s.Transport.Addr(), peer.ID(), pushed, pulled)
+	return nil
+}
+
+func (s *FileServer) ownsReplica(key string) bool {
+	for _, id := range s.ring.Owners(key, s.ReplicationFactor) {
+		if id == s.NodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// pushReplica sends the replica or tombstone described by meta from store to
+// peer.
+func (s *FileServer) pushReplica(peer p2p.Peer, store Backend, meta Meta) error {
+	if meta.Deleted {
+		_, err := s.requestOne(peer, MessageRemoveFile{Key: meta.Key, Version: meta.Version})
+		return err
+	}
+
+	size, r, err := store.Read(meta.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.sendReplica(peer, meta, size, r)
+}
+
+// sendReplica streams size bytes of replica read from r to peer and waits
+// until peer stored them.
+func (s *FileServer) sendReplica(peer p2p.Peer, meta Meta, size int64, r io.Reader) error {
+	msg := MessageStoreFile{Key: meta.Key, Size: int(size), Meta: meta}
+	if meta.Checksum != "" {
+		msg.Session = transferSession(meta.Key, meta.Version, meta.Checksum)
+	}
+
+	res, err := s.requestOne(peer, msg)
+	if err != nil {
+		return err
+	}
+	ready := res.(MessageStoreFileReply)
+	if ready.Have {
+		return nil
+	}
+	if !ready.Ready {
+		return fmt.Errorf("peer is not ready to receive")
+	}
+
+	st, err := peer.AcceptStream(ready.StreamID)
+	if err != nil {
+		return err
+	}
+	if err := skip(r, ready.Offset); err != nil {
+		st.Reset()
+		return err
+	}
+	if _, err := io.Copy(timedWriter{st: st, timeout: s.RequestTimeout}, r); err != nil {
+		st.Reset()
+		return err
+	}
+	st.Close()
+
+	return s.awaitStoreAck(st, meta.Checksum)
+}
+
+// pullReplica fetches the replica or tombstone described by meta from peer.
+func (s *FileServer) pullReplica(peer p2p.Peer, meta Meta) error {
+	if meta.Deleted {
+		return deleteReplica(s.Store, meta.Key, meta.Version)
+	}
+
+	p, err := s.fetchResumable(peer, meta.Key, meta)
+	if err != nil {
+		return err
+	}
+	defer p.done()
+
+	_, err = writeReplica(s.Store, meta.Key, p.reader(), p.Size(), meta)
+	return err
+}
+
+// openReplica asks peer for its replica of key and returns the stream it is
+// sent on. The caller must Close or Reset the stream.
+func (s *FileServer) openReplica(peer p2p.Peer, key string) (MessageGetFileReply, *p2p.Stream, error) {
+	return s.openFile(peer, MessageGetFile{Key: key})
+}
+
+// openReplicaRange is openReplica for length bytes of the file from offset,
+// see MessageGetFile. A length of 0 asks for the whole replica.
+func (s *FileServer) openReplicaRange(peer p2p.Peer, key string, offset, length int64) (MessageGetFileReply, *p2p.Stream, error) {
+	return s.openFile(peer, MessageGetFile{Key: key, Offset: offset, Length: length})
+}
+
+// openReplicaFrom is openReplica for the bytes of the replica from from on.
+func (s *FileServer) openReplicaFrom(peer p2p.Peer, key string, from int64) (MessageGetFileReply, *p2p.Stream, error) {
+	return s.openFile(peer, MessageGetFile{Key: key, From: from})
+}
+
+func (s *FileServer) openFile(peer p2p.Peer, msg MessageGetFile) (MessageGetFileReply, *p2p.Stream, error) {
+	res, err := s.requestOne(peer, msg)
+	if err != nil {
+		return MessageGetFileReply{}, nil, err
+	}
+	file := res.(MessageGetFileReply)
+	if !file.Has {
+		return file, nil, fmt.Errorf("replica (%s) is not on %s", msg.Key, peer.ID())
+	}
+
+	st, err := peer.AcceptStream(file.StreamID)
+	if err != nil {
+		return file, nil, err
+	}
+	return file, st, nil
+}
+
+// requestOne sends payload to peer and returns the payload of its reply.
+func (s *FileServer) requestOne(peer p2p.Peer, payload any) (any, error) {
+	replies, err := s.request([]p2p.Peer{peer}, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) == 0 {
+		return nil, ErrRequestTimeout
+	}
+	return replies[0].msg.Payload, nil
+}
+
+// sessionTree returns the tree peer from is walking in session id, building
+// it when a new session starts.
+func (f *FileServer) sessionTree(from string, id uint64) (*MerkleTree, error) {
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+
+	if sess, ok := f.syncTrees[from]; ok && sess.id == id {
+		return sess.tree, nil
+	}
+
+	tree, err := f.merkleTreeFor(from)
+	if err != nil {
+		return nil, err
+	}
+	f.syncTrees[from] = &syncSession{id: id, tree: tree}
+	return tree, nil
+}
+
+func (f *FileServer) handleMessageSyncTree(from string, id uint64, msg MessageSyncTree) error {
+	peer, ok := f.peer(from)
+	if !ok {
+		return fmt.Errorf("Peer (%s) could not be found in the peer map", from)
+	}
+
+	tree, err := f.sessionTree(from, msg.Session)
+	if err != nil {
+		return err
+	}
+
+	return f.reply(peer, id, MessageSyncTreeReply{Hashes: tree.Hashes(msg.Level, msg.Nodes)})
+}
+
+func (f *FileServer) handleMessageSyncBucket(from string, id uint64, msg MessageSyncBucket) error {
+	peer, ok := f.peer(from)
+	if !ok {
+		return fmt.Errorf("Peer (%s) could not be found in the peer map", from)
+	}
+
+	tree, err := f.sessionTree(from, msg.Session)
+	if err != nil {
+		return err
+	}
+
+	var metas []Meta
+	for _, b := range msg.Buckets {
+		metas = append(metas, tree.Bucket(b)...)
+	}
+
+	return f.reply(peer, id, MessageSyncBucketReply{Metas: metas})
+}
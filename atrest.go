@@ -0,0 +1,662 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// SealedBackend encrypts the plaintext copies a node keeps of the files
+// written or read through it before they reach the Backend underneath, and
+// decrypts them again on Read, so that the disk reveals nothing without the
+// key store. Each copy is sealed with a data key of its own, wrapped with the
+// current key-encryption key like the data key of a replica. Replicas are
+// sealed already and are passed through, as are tombstones.
+//
+// A copy is stored under copyKey of its key, with the key sealed in its Name,
+// so neither the index of the Backend nor the metadata on disk holds the
+// names of the files.
+//
+// The PlainSize and ContentHash of copies and replicas are sealed into
+// Meta.Plain with their data key, see sealPlain, so the hashes on disk do not
+// tell which files a node holds.
+//
+// Callers see the metadata of the plaintext: the Key of a sealed copy is the
+// key of the file, its Size and Checksum are its PlainSize and ContentHash,
+// and the PlainSize and ContentHash of copies and replicas are opened again.
+type SealedBackend struct {
+	Backend
+	keys *KeyStore
+
+	// names holds the keys callers see in order, for List, and files the
+	// keys of the files b holds a copy or a replica of, for Files, with
+	// fileOf mapping the key of a replica to the file's. They are built from
+	// the Backend on first use, which opens the name of every copy and
+	// replica, and kept up to date by the writes and deletes through b.
+	mu     sync.Mutex
+	listed bool
+	names  sortedKeys
+	files  sortedKeys
+	fileOf map[string]string
+}
+
+func NewSealedBackend(b Backend, keys *KeyStore) *SealedBackend {
+	return &SealedBackend{Backend: b, keys: keys}
+}
+
+// copyKey returns the key the sealed copy of key is stored under.
+func copyKey(key string) string {
+	hash := sha256.Sum256([]byte("copy " + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// wrappedFor returns what the data key in meta, the metadata of a replica or
+// of a copy as SealedBackend reports it, is wrapped for: the key it is
+// stored under. Copies sealed before their names were hidden are stored
+// under the key of the file.
+func wrappedFor(meta Meta) string {
+	if meta.Sealed && meta.Name != nil {
+		return copyKey(meta.Key)
+	}
+	return meta.Key
+}
+
+// stat returns the metadata of key as stored and the key it is stored under.
+// Replicas, and copies stored before they were sealed, are stored under key.
+func (b *SealedBackend) stat(key string) (Meta, string, error) {
+	meta, err := b.Backend.Stat(copyKey(key))
+	if err == nil {
+		return meta, copyKey(key), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return Meta{}, "", err
+	}
+	meta, err = b.Backend.Stat(key)
+	return meta, key, err
+}
+
+func (b *SealedBackend) Has(key string) bool {
+	return b.Backend.Has(copyKey(key)) || b.Backend.Has(key)
+}
+
+func (b *SealedBackend) Read(key string) (int64, io.ReadCloser, error) {
+	meta, stored, err := b.stat(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	size, rc, err := b.Backend.Read(stored)
+	if err != nil || !meta.Sealed {
+		return size, rc, err
+	}
+
+	dek, err := b.dataKey(meta, stored)
+	if err != nil {
+		rc.Close()
+		return 0, nil, err
+	}
+	r, err := decryptReader(dek, 0, false, false, rc)
+	if err != nil {
+		rc.Close()
+		return 0, nil, err
+	}
+	return openedSize(size), readCloser{Reader: r, Closer: rc}, nil
+}
+
+// Close closes the Backend underneath, if it needs closing.
+func (b *SealedBackend) Close() error {
+	if c, ok := b.Backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (b *SealedBackend) Write(key string, r io.Reader) (int64, error) {
+	meta, err := b.WriteWithMeta(key, r, Meta{})
+	return meta.Size, err
+}
+
+// WriteWithMeta seals the object read from r, unless it is a replica, and
+// stores it together with meta. A checksum in meta is the one of the
+// plaintext. A copy of key stored before it was sealed is removed once the
+// sealed one is written.
+//
+// The ContentHash of a copy written without a checksum is only known once it
+// is stored, and sealed into its metadata afterwards.
+func (b *SealedBackend) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	if meta.Replica {
+		sealed, err := b.sealPlain(meta, key, nil)
+		if err != nil {
+			return Meta{}, err
+		}
+		written, err := b.Backend.WriteWithMeta(key, r, sealed)
+		if err != nil {
+			return Meta{}, err
+		}
+		b.named(key, meta)
+		written.PlainSize, written.ContentHash, written.Plain = meta.PlainSize, meta.ContentHash, nil
+		return written, nil
+	}
+
+	stored := copyKey(key)
+	id, kek := b.keys.Current()
+	dek := NewEncryptionKey()
+	wrapped, err := wrapKey(kek, dek, stored)
+	if err != nil {
+		return Meta{}, err
+	}
+	if meta.Name, err = sealName(dek, key, stored); err != nil {
+		return Meta{}, err
+	}
+	checksum := meta.Checksum
+	meta.Checksum = ""
+	meta.KeyID, meta.WrappedKey = id, wrapped
+	meta.Sealed, meta.ContentHash = true, checksum
+	if meta, err = b.sealPlain(meta, stored, dek); err != nil {
+		return Meta{}, err
+	}
+
+	sr := newSealReader(dek, r, checksum)
+	written, err := b.Backend.WriteWithMeta(stored, sr, meta)
+	sr.CloseWithError(err)
+	<-sr.done
+	if err != nil {
+		return Meta{}, err
+	}
+	b.named(key, meta)
+	written.ContentHash = sr.plain.Sum()
+	if checksum == "" {
+		sealed, err := b.sealPlain(written, stored, dek)
+		if err == nil {
+			err = b.Backend.WriteMeta(stored, sealed)
+		}
+		if err != nil {
+			return Meta{}, fmt.Errorf("metadata of (%s): %w", key, err)
+		}
+	}
+
+	if old, err := b.Backend.Stat(key); err == nil && !old.Replica {
+		if err := b.Backend.Delete(key); err != nil {
+			log.Printf("removing the copy of (%s) stored under its key: %v\n", key, err)
+		}
+	}
+	written.Plain = nil
+	return plainMeta(written, key), nil
+}
+
+// WriteMeta replaces the metadata of key. The metadata of a sealed copy, as
+// Stat returns it, gets the size and checksum of the sealed bytes back, and
+// the PlainSize and ContentHash of copies and replicas are sealed again.
+func (b *SealedBackend) WriteMeta(key string, meta Meta) error {
+	err := b.writeMeta(key, meta)
+	if err == nil {
+		b.named(key, meta)
+	}
+	return err
+}
+
+func (b *SealedBackend) writeMeta(key string, meta Meta) error {
+	if meta.Replica {
+		sealed, err := b.sealPlain(meta, key, nil)
+		if err != nil {
+			return err
+		}
+		return b.Backend.WriteMeta(key, sealed)
+	}
+
+	stored, at, err := b.stat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return b.Backend.WriteMeta(key, meta)
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Sealed && !meta.Deleted {
+		if stored.Version != meta.Version {
+			return fmt.Errorf("metadata of (%s) version %d: replaced by version %d", key, meta.Version, stored.Version)
+		}
+		meta.Size, meta.Checksum = stored.Size, stored.Checksum
+	}
+	meta.Key, meta.Name = at, stored.Name
+	if meta.Sealed {
+		if meta, err = b.sealPlain(meta, at, nil); err != nil {
+			return err
+		}
+	}
+	return b.Backend.WriteMeta(at, meta)
+}
+
+func (b *SealedBackend) Delete(key string) error {
+	defer b.unnamed(key)
+
+	_, stored, err := b.stat(key)
+	if err != nil {
+		return b.Backend.Delete(key)
+	}
+	return b.Backend.Delete(stored)
+}
+
+func (b *SealedBackend) Stat(key string) (Meta, error) {
+	meta, stored, err := b.stat(key)
+	if err != nil {
+		return Meta{}, err
+	}
+	if meta, err = b.openPlain(meta, stored); err != nil {
+		return Meta{}, err
+	}
+	return plainMeta(meta, key), nil
+}
+
+// List lists the copies and replicas of the Backend by the keys callers see,
+// from the names b keeps. A copy whose name does not open is left out.
+func (b *SealedBackend) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	if err := b.loadNames(); err != nil {
+		return nil, "", err
+	}
+
+	page := func(cursor string, n int) []string {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.names.page(prefix, cursor, n)
+	}
+	metas, next := listSorted(page, cursor, limit, func(key string) (Meta, bool) {
+		meta, err := b.Stat(key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("listing (%s): %v\n", key, err)
+		}
+		return meta, err == nil
+	})
+	return metas, next, nil
+}
+
+// Files returns up to n of the keys of the files b holds a copy or a replica
+// of that start with prefix and come after cursor, see sortedKeys.page.
+// Chunks and replicas from before their names were sealed are left out, and
+// so are tombstones.
+func (b *SealedBackend) Files(prefix, cursor string, n int) ([]string, error) {
+	if err := b.loadNames(); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.files.page(prefix, cursor, n), nil
+}
+
+// loadNames lists every object of the Backend into names and files on first
+// use, opening the names of the copies and replicas.
+func (b *SealedBackend) loadNames() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.listed {
+		return nil
+	}
+
+	all, _, err := b.Backend.List("", "", 0)
+	if err != nil {
+		return err
+	}
+
+	names := make(sortedKeys, 0, len(all))
+	files := make(sortedKeys, 0, len(all))
+	b.fileOf = make(map[string]string)
+	for _, meta := range all {
+		key := meta.Key
+		if meta.Sealed && meta.Name != nil {
+			if key, err = b.copyName(meta); err != nil {
+				log.Printf("listing copy (%s): %v\n", meta.Key, err)
+				continue
+			}
+		}
+		names = append(names, key)
+
+		file := b.fileName(key, meta)
+		if file == "" {
+			continue
+		}
+		if meta.Replica {
+			b.fileOf[key] = file
+		}
+		files = append(files, file)
+	}
+	sort.Strings(names)
+	sort.Strings(files)
+	b.names, b.files = slices.Compact(names), slices.Compact(files)
+	b.listed = true
+	return nil
+}
+
+// fileName returns the key of the file the object key with the metadata
+// meta is a copy or a replica of, or "" if it is not to be listed as one.
+func (b *SealedBackend) fileName(key string, meta Meta) string {
+	file := key
+	if meta.Replica && !meta.Deleted && meta.Name != nil {
+		dek, err := b.dataKey(meta, key)
+		if err == nil {
+			file, err = openName(dek, meta.Name, key)
+		}
+		if err != nil {
+			log.Printf("listing replica (%s): %v\n", key, err)
+			return ""
+		}
+	} else if meta.Replica || meta.Deleted {
+		return ""
+	}
+	if isChunkKey(file) {
+		return ""
+	}
+	return file
+}
+
+// named records that the object key was written with meta, once names are
+// loaded.
+func (b *SealedBackend) named(key string, meta Meta) {
+	b.mu.Lock()
+	listed := b.listed
+	b.mu.Unlock()
+	if !listed {
+		return
+	}
+	file := b.fileName(key, meta)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.names.add(key)
+	if old, ok := b.fileOf[key]; ok && old != file {
+		delete(b.fileOf, key)
+		b.unfile(old)
+	}
+	if file == "" {
+		if !meta.Replica {
+			b.unfile(key)
+		}
+		return
+	}
+	if meta.Replica {
+		b.fileOf[key] = file
+	}
+	b.files.add(file)
+}
+
+// unnamed records that key was deleted, unless an object is still stored
+// for it.
+func (b *SealedBackend) unnamed(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.listed {
+		return
+	}
+	if _, _, err := b.stat(key); errors.Is(err, fs.ErrNotExist) {
+		b.names.remove(key)
+	}
+	if file, ok := b.fileOf[key]; ok {
+		delete(b.fileOf, key)
+		b.unfile(file)
+		return
+	}
+	b.unfile(key)
+}
+
+// unfile removes file from files unless b still holds a copy or a replica
+// of it. The caller holds mu.
+func (b *SealedBackend) unfile(file string) {
+	if _, ok := b.fileOf[hashKey(file)]; ok {
+		return
+	}
+	if meta, _, err := b.stat(file); err == nil && !meta.Replica && !meta.Deleted {
+		return
+	}
+	b.files.remove(file)
+}
+
+// copyName opens the name of the copy meta, as stored, describes.
+func (b *SealedBackend) copyName(meta Meta) (string, error) {
+	dek, err := b.dataKey(meta, meta.Key)
+	if err != nil {
+		return "", err
+	}
+	name, err := unwrapKey(nameKey(dek), meta.Name, meta.Key)
+	if err != nil || copyKey(string(name)) != meta.Key {
+		return "", fmt.Errorf("%w: name of (%s)", ErrTampered, meta.Key)
+	}
+	return string(name), nil
+}
+
+// SealPlaintext seals the copies stored before they were sealed at rest,
+// moves the copies sealed before their names were hidden under copyKey, and
+// seals the PlainSize and ContentHash of copies and replicas stored before
+// those were. It returns how many objects it sealed or moved.
+func (b *SealedBackend) SealPlaintext() (int, error) {
+	metas, _, err := b.Backend.List("", "", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n    int
+		errs []error
+	)
+	for _, meta := range metas {
+		if meta.Deleted {
+			continue
+		}
+		if meta.Replica || (meta.Sealed && meta.Name != nil) {
+			if meta.PlainSize == 0 && meta.ContentHash == "" {
+				continue
+			}
+			if err := b.sealStoredPlain(meta); err != nil {
+				errs = append(errs, fmt.Errorf("seal metadata of (%s): %w", meta.Key, err))
+				continue
+			}
+			n++
+			continue
+		}
+		if err := b.sealCopy(meta); err != nil {
+			errs = append(errs, fmt.Errorf("seal (%s): %w", meta.Key, err))
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// sealStoredPlain seals the PlainSize and ContentHash left in the metadata
+// meta, as stored.
+func (b *SealedBackend) sealStoredPlain(meta Meta) error {
+	local, err := b.Backend.Stat(meta.Key)
+	if errors.Is(err, fs.ErrNotExist) || local.Version != meta.Version {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if local, err = b.sealPlain(local, meta.Key, nil); err != nil {
+		return err
+	}
+	return b.Backend.WriteMeta(meta.Key, local)
+}
+
+func (b *SealedBackend) sealCopy(meta Meta) error {
+	// The copy may have been replaced or removed since it was listed, or
+	// sealed under copyKey while its old one was left behind.
+	local, err := b.Backend.Stat(meta.Key)
+	if errors.Is(err, fs.ErrNotExist) || local.Version != meta.Version {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if b.Backend.Has(copyKey(meta.Key)) {
+		return b.Backend.Delete(meta.Key)
+	}
+
+	// Read goes by the key the copy is stored under, which is meta.Key
+	// until it was sealed.
+	_, r, err := b.Read(meta.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	local = plainMeta(local, meta.Key)
+	_, err = b.WriteWithMeta(meta.Key, r, Meta{
+		// Copies from before metadata have no version; 1 keeps them
+		// older than any write.
+		Version:    max(local.Version, 1),
+		Chunked:    local.Chunked,
+		Recipients: local.Recipients,
+		Checksum:   local.Checksum,
+		Created:    local.Created,
+		Modified:   local.Modified,
+	})
+	return err
+}
+
+// plainMeta returns the metadata of the object stored for key, with its
+// Plain opened, as callers of SealedBackend see it. The PlainSize of a
+// sealed copy follows from the size of the sealed bytes.
+func plainMeta(meta Meta, key string) Meta {
+	meta.Key = key
+	if meta.Sealed {
+		meta.PlainSize = openedSize(meta.Size)
+		meta.Size, meta.Checksum = meta.PlainSize, meta.ContentHash
+	}
+	return meta
+}
+
+// plainFields is what Meta.Plain seals.
+type plainFields struct {
+	Size int64  `json:"size,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// dataKey returns the data key of the copy or replica described by meta,
+// as stored under stored. Replicas without a key ID are sealed with the
+// legacy key.
+func (b *SealedBackend) dataKey(meta Meta, stored string) ([]byte, error) {
+	if meta.KeyID == "" {
+		if _, key := b.keys.Legacy(); key != nil {
+			return key, nil
+		}
+	}
+	kek, ok := b.keys.Key(meta.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("data key of (%s): %w: %s", stored, ErrUnknownKey, meta.KeyID)
+	}
+	return unwrapKey(kek, meta.WrappedKey, stored)
+}
+
+// sealPlain moves the PlainSize and ContentHash of the copy or replica
+// stored under stored into meta.Plain, sealed with a key derived from its
+// data key, dek or else the one in meta. The PlainSize of a sealed copy is
+// left out, see plainMeta.
+func (b *SealedBackend) sealPlain(meta Meta, stored string, dek []byte) (Meta, error) {
+	fields := plainFields{Size: meta.PlainSize, Hash: meta.ContentHash}
+	if meta.Sealed {
+		fields.Size = 0
+	}
+	meta.PlainSize, meta.ContentHash, meta.Plain = 0, "", nil
+	if fields == (plainFields{}) || meta.Deleted {
+		return meta, nil
+	}
+
+	if dek == nil {
+		var err error
+		if dek, err = b.dataKey(meta, stored); err != nil {
+			return Meta{}, err
+		}
+	}
+	plain, err := json.Marshal(fields)
+	if err != nil {
+		return Meta{}, err
+	}
+	if meta.Plain, err = wrapKey(plainKey(dek), plain, stored); err != nil {
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+// openPlain restores the PlainSize and ContentHash that sealPlain moved into
+// meta.Plain. Without the data key they are left empty, as the object can
+// not be read anyway. Metadata stored before they were sealed keeps them as
+// they are.
+func (b *SealedBackend) openPlain(meta Meta, stored string) (Meta, error) {
+	if meta.Plain == nil {
+		return meta, nil
+	}
+
+	dek, err := b.dataKey(meta, stored)
+	if errors.Is(err, ErrUnknownKey) {
+		meta.Plain = nil
+		return meta, nil
+	}
+	if err != nil {
+		return Meta{}, err
+	}
+	plain, err := unwrapKey(plainKey(dek), meta.Plain, stored)
+	if err != nil {
+		return Meta{}, fmt.Errorf("%w: metadata of (%s)", ErrTampered, stored)
+	}
+	var fields plainFields
+	if err := json.Unmarshal(plain, &fields); err != nil {
+		return Meta{}, fmt.Errorf("%w: metadata of (%s)", ErrTampered, stored)
+	}
+	meta.PlainSize, meta.ContentHash, meta.Plain = fields.Size, fields.Hash, nil
+	return meta, nil
+}
+
+// sealReader seals the plaintext read from r for SealedBackend, and hashes
+// it into plain. If the plaintext does not match checksum, the Backend gets
+// ErrChecksumMismatch instead of EOF.
+type sealReader struct {
+	*io.PipeReader
+	plain *hashWriter
+	done  chan struct{}
+}
+
+func newSealReader(dek []byte, r io.Reader, checksum string) *sealReader {
+	pr, pw := io.Pipe()
+	sr := &sealReader{
+		PipeReader: pr,
+		plain:      newHashWriter(io.Discard),
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sr.done)
+
+		_, err := copyEncrypt(dek, io.TeeReader(r, sr.plain), pw)
+		if err == nil && checksum != "" && sr.plain.Sum() != checksum {
+			err = ErrChecksumMismatch
+		}
+		pw.CloseWithError(err)
+	}()
+	return sr
+}
+
+// sealPlaintext seals the plaintext copies left from before copies were
+// sealed at rest.
+func (s *FileServer) sealPlaintext() {
+	b, ok := s.Store.(*SealedBackend)
+	if !ok {
+		return
+	}
+
+	n, err := b.SealPlaintext()
+	if err != nil {
+		log.Printf("[%s] sealing plaintext copies: %v\n", s.Transport.Addr(), err)
+	}
+	if n > 0 {
+		fmt.Printf("[%s] Sealed %d plaintext copies at rest\n", s.Transport.Addr(), n)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSealedBackend(t *testing.T) {
+	s := newTestServer(t, 4)
+	data := []byte("abcdabcdabcdef")
+	if err := s.store("a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing the node stored holds the plaintext, copies included.
+	raw := s.Store.(*SealedBackend).Backend
+	metas, _, err := raw.List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range metas {
+		if !meta.Replica && !meta.Sealed {
+			t.Errorf("(%s) is not sealed", meta.Key)
+		}
+		if meta.PlainSize != 0 || meta.ContentHash != "" {
+			t.Errorf("(%s) keeps the size or hash of its plaintext in the clear", meta.Key)
+		}
+		_, r, err := raw.Read(meta.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if bytes.Contains(b, data[:4]) {
+			t.Errorf("(%s) holds the plaintext", meta.Key)
+		}
+	}
+
+	size, r, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || size != int64(len(data)) || !bytes.Equal(b, data) {
+		t.Errorf("got %d bytes %q, %v", size, b, err)
+	}
+}
+
+func TestSealedBackendMeta(t *testing.T) {
+	keys := newKeyStore(NewEncryptionKey())
+	raw := NewMemoryBackend()
+	b := NewSealedBackend(raw, keys)
+	data := []byte("hello world")
+	sum := newHashWriter(io.Discard)
+	sum.Write(data)
+
+	meta, err := b.WriteWithMeta("a", bytes.NewReader(data), Meta{Checksum: sum.Sum()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Size != int64(len(data)) || meta.Checksum != sum.Sum() || meta.ContentHash != sum.Sum() {
+		t.Errorf("wrote %+v", meta)
+	}
+	if stat, err := b.Stat("a"); err != nil || stat.Size != meta.Size || stat.Checksum != meta.Checksum {
+		t.Errorf("stat %+v, %v", stat, err)
+	}
+	if stored, _ := raw.Stat(copyKey("a")); stored.Size != sealedSize(int64(len(data))) {
+		t.Errorf("stored %d bytes, want %d", stored.Size, sealedSize(int64(len(data))))
+	}
+	if !holdsCopy(b, "a", meta.Version, sum.Sum()) {
+		t.Error("holdsCopy of a sealed copy is false")
+	}
+
+	// A copy that does not match its checksum does not replace the last one.
+	if _, err := b.WriteWithMeta("a", bytes.NewReader([]byte("tampered")), Meta{Checksum: sum.Sum()}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("write with a wrong checksum: got %v, want ErrChecksumMismatch", err)
+	}
+	_, r, err := b.Read("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q, %v", got, err)
+	}
+
+	// Copies stored before they were sealed are sealed in place, and so is
+	// the plaintext hash of replicas stored before it was sealed.
+	if _, err := raw.Write("old", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := raw.Stat("old")
+	id, kek := keys.Current()
+	wrapped, err := wrapKey(kek, NewEncryptionKey(), "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := Meta{Replica: true, KeyID: id, WrappedKey: wrapped, PlainSize: 11, ContentHash: sum.Sum()}
+	if _, err := raw.WriteWithMeta("r", bytes.NewReader([]byte("sealed")), replica); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := b.SealPlaintext(); n != 2 || err != nil {
+		t.Fatalf("sealed %d objects, %v", n, err)
+	}
+	if stored, _ := raw.Stat("r"); stored.Plain == nil || stored.ContentHash != "" {
+		t.Errorf("stored replica %+v, want its plaintext hash sealed", stored)
+	}
+	if stat, err := b.Stat("r"); err != nil || stat.PlainSize != 11 || stat.ContentHash != sum.Sum() {
+		t.Errorf("stat of the replica %+v, %v", stat, err)
+	}
+	if stored, _ := raw.Stat(copyKey("old")); !stored.Sealed || stored.Version != old.Version {
+		t.Errorf("stored %+v, want version %d sealed", stored, old.Version)
+	}
+	if raw.Has("old") {
+		t.Error("the plaintext copy is still there")
+	}
+	_, r, err = b.Read("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+// countingBackend wraps the readers it stores from, as a Backend with quotas
+// or metrics would.
+type countingBackend struct {
+	Backend
+}
+
+func (b countingBackend) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	return b.Backend.WriteWithMeta(key, io.MultiReader(r), meta)
+}
+
+func TestSealedBackendTampered(t *testing.T) {
+	raw := NewMemoryBackend()
+	b := NewSealedBackend(countingBackend{raw}, newKeyStore(NewEncryptionKey()))
+	data := []byte("hello world")
+
+	// A Backend that wraps the reader still records the copy as sealed.
+	meta, err := b.WriteWithMeta("a", bytes.NewReader(data), Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := raw.Stat(copyKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Sealed || stored.Plain == nil || stored.PlainSize != 0 || stored.ContentHash != "" {
+		t.Fatalf("stored %+v, want a sealed copy with its plaintext hash sealed", stored)
+	}
+	if stat, err := b.Stat("a"); err != nil || stat.PlainSize != int64(len(data)) || stat.ContentHash != meta.ContentHash {
+		t.Fatalf("stat %+v, %v, want a copy of %d bytes", stat, err, len(data))
+	}
+
+	_, r, err := raw.Read(copyKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := io.ReadAll(r)
+	r.Close()
+
+	// A sealed copy is only read if it authenticates, whatever byte of it
+	// was changed.
+	stored.Checksum = ""
+	for _, i := range []int{0, len(sealMagic), len(sealed) - 1} {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 1
+		if _, err := raw.WriteWithMeta(copyKey("a"), bytes.NewReader(tampered), stored); err != nil {
+			t.Fatal(err)
+		}
+		_, r, err := b.Read("a")
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if !errors.Is(err, ErrTampered) {
+			t.Errorf("byte %d changed: got %v, want ErrTampered", i, err)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestSealedBackendNames(t *testing.T) {
+	root := t.TempDir()
+	keys := newKeyStore(NewEncryptionKey())
+	b := NewSealedBackend(NewStore(&StoreOpts{Root: root, PathTransformFunc: CASPathTransform}), keys)
+	names := []string{"secret/plans.txt", "secret/salaries.csv", "zzz.txt"}
+	for _, name := range names {
+		if _, err := b.Write(name, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither the key index nor the metadata on disk names the files.
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if bytes.Contains(b, []byte(name)) {
+				t.Errorf("%s holds the name of %s", path, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Callers still see the names, in order and by prefix.
+	metas, next, err := b.List("secret/", "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].Key != names[0] || next != names[0] {
+		t.Fatalf("listed %v, next %q", metas, next)
+	}
+	if metas, _, err = b.List("secret/", next, 0); err != nil || len(metas) != 1 || metas[0].Key != names[1] {
+		t.Errorf("listed %v after %s, %v", metas, next, err)
+	}
+	if meta, err := b.Stat("zzz.txt"); err != nil || meta.Key != "zzz.txt" || meta.Size != 4 {
+		t.Errorf("stat %+v, %v", meta, err)
+	}
+
+	// Re-wrapping the data key keeps the name readable.
+	meta, _ := b.Stat("zzz.txt")
+	kek := NewEncryptionKey()
+	id, err := keys.Add(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek, err := unwrapDataKey(keys, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.WrappedKey, err = wrapKey(kek, dek, wrappedFor(meta)); err != nil {
+		t.Fatal(err)
+	}
+	meta.KeyID = id
+	if err := b.WriteMeta("zzz.txt", meta); err != nil {
+		t.Fatal(err)
+	}
+	if metas, _, err = b.List("z", "", 0); err != nil || len(metas) != 1 || metas[0].KeyID != id {
+		t.Errorf("listed %v after re-wrapping, %v", metas, err)
+	}
+
+	if err := b.Delete("zzz.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if b.Has("zzz.txt") {
+		t.Error("deleted copy is still there")
+	}
+}
+
+// listingBackend counts how often it is listed.
+type listingBackend struct {
+	Backend
+	lists *int
+}
+
+func (b listingBackend) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	*b.lists++
+	return b.Backend.List(prefix, cursor, limit)
+}
+
+func TestSealedBackendListNames(t *testing.T) {
+	var lists int
+	b := NewSealedBackend(listingBackend{NewMemoryBackend(), &lists}, newKeyStore(NewEncryptionKey()))
+	for _, name := range []string{"b", "d"} {
+		if _, err := b.Write(name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := b.List("", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later writes and deletes are listed without listing the Backend again.
+	for _, name := range []string{"a", "c", "e"} {
+		if _, err := b.Write(name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteMeta("r", Meta{Version: 1, Replica: true, Deleted: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for cursor := ""; ; {
+		metas, next, err := b.List("", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, meta := range metas {
+			got = append(got, meta.Key)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if want := []string{"a", "b", "c", "e", "r"}; !slices.Equal(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	if lists != 1 {
+		t.Errorf("listed the Backend %d times, want once", lists)
+	}
+}
+
+func TestSealedBackendFiles(t *testing.T) {
+	var lists int
+	keys := newKeyStore(NewEncryptionKey())
+	b := NewSealedBackend(listingBackend{NewMemoryBackend(), &lists}, keys)
+	if _, err := b.Files("", "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// f has a replica only, g a copy only, h both; chunks are left out.
+	replica := func(name string) {
+		t.Helper()
+		id, kek := keys.Current()
+		dek := NewEncryptionKey()
+		wrapped, err := wrapKey(kek, dek, hashKey(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := sealName(dek, name, hashKey(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := Meta{Version: 1, KeyID: id, WrappedKey: wrapped, Name: sealed}
+		if _, err := writeReplica(b, hashKey(name), bytes.NewReader([]byte("sealed")), -1, meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replica("f")
+	replica("h")
+	for _, name := range []string{"g", "h", chunkKey("x")} {
+		if _, err := b.Write(name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := func(want ...string) {
+		t.Helper()
+		got, err := b.Files("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("files %v, want %v", got, want)
+		}
+	}
+	files("f", "g", "h")
+
+	// A file goes once neither its copy nor its replica is left.
+	if err := deleteReplica(b, hashKey("h"), 2); err != nil {
+		t.Fatal(err)
+	}
+	files("f", "g", "h")
+	if err := b.Delete("h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteReplica(b, hashKey("f"), 2); err != nil {
+		t.Fatal(err)
+	}
+	files("g")
+
+	if lists != 1 {
+		t.Errorf("listed the Backend %d times, want once", lists)
+	}
+}
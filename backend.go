@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend is a storage engine for objects and the metadata kept with them.
+// Store, the content-addressable layout on the file system, is the default
+// one. MemoryBackend keeps everything in memory.
+type Backend interface {
+	Has(key string) bool
+	// Read returns the size of the object key and a reader for it.
+	Read(key string) (int64, io.ReadCloser, error)
+	// Write stores the object read from r as a new version of key.
+	Write(key string, r io.Reader) (int64, error)
+	// WriteWithMeta stores the object read from r together with meta,
+	// completed as described by completeMeta, and returns the metadata
+	// written. The previous version of key is only replaced if r is read to
+	// EOF without error and, when meta has a checksum, the object matches
+	// it.
+	WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error)
+	// WriteMeta replaces the metadata of key, for example with a tombstone.
+	WriteMeta(key string, meta Meta) error
+	// Delete removes the object key and its metadata.
+	Delete(key string) error
+	// Stat returns the metadata of key. The error wraps fs.ErrNotExist if
+	// there is neither an object nor metadata.
+	Stat(key string) (Meta, error)
+	// List returns the metadata of up to limit objects and tombstones whose
+	// key starts with prefix and comes after cursor, sorted by key, and the
+	// cursor of the next page, which is empty after the last one. A limit
+	// of 0 or less means no limit.
+	List(prefix, cursor string, limit int) ([]Meta, string, error)
+}
+
+// Storage engines a node can be configured with.
+const (
+	EngineCAS    = "cas"
+	EnginePack   = "pack"
+	EngineMemory = "memory"
+)
+
+// OpenBackend opens the storage engine named engine under root: a Store
+// using CASPathTransform for EngineCAS, a PackStore in root/pack for
+// EnginePack, or a MemoryBackend.
+func OpenBackend(engine, root string) (Backend, error) {
+	switch engine {
+	case EngineCAS:
+		store := NewStore(&StoreOpts{Root: root, PathTransformFunc: CASPathTransform})
+		if err := store.CleanTemp(); err != nil {
+			log.Println("cleaning unfinished writes:", err)
+		}
+		return store, nil
+	case EnginePack:
+		return OpenPackStore(&PackStoreOpts{Root: filepath.Join(root, "pack")})
+	case EngineMemory:
+		return NewMemoryBackend(), nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q, want %s, %s or %s", engine, EngineCAS, EnginePack, EngineMemory)
+}
+
+// readMeta returns the metadata of key. Keys without any report version 0.
+func readMeta(b Backend, key string) (Meta, error) {
+	meta, err := b.Stat(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Meta{Key: key}, nil
+	}
+	return meta, err
+}
+
+// completeMeta fills in the metadata of an object just written: size and
+// checksum of what was stored, the version and modification time with the
+// current time unless set, and the creation time from prev, the version
+// being replaced. The plaintext of a sealed copy or a replica is described
+// by whoever encrypted it.
+func completeMeta(key string, meta, prev Meta, size int64, sum string) Meta {
+	meta.Key = key
+	meta.Deleted = false
+	meta.Size, meta.Checksum = size, sum
+	if !meta.Sealed && !meta.Replica {
+		meta.PlainSize, meta.ContentHash = meta.Size, meta.Checksum
+	}
+	if meta.Version == 0 {
+		meta.Version = time.Now().UnixNano()
+	}
+	if meta.Modified.IsZero() {
+		meta.Modified = time.Unix(0, meta.Version)
+	}
+	if meta.Created.IsZero() {
+		meta.Created = meta.Modified
+		if !prev.Deleted && !prev.Created.IsZero() {
+			meta.Created = prev.Created
+		}
+	}
+	return meta
+}
+
+// writeReplica stores the replica bytes read from r and its metadata. If
+// size is not negative, r must yield exactly size bytes, and if meta has a
+// checksum the bytes must match. Otherwise the previous replica is left in
+// place.
+func writeReplica(b Backend, key string, r io.Reader, size int64, meta Meta) (int64, error) {
+	meta.Replica = true
+
+	if size >= 0 {
+		r = &sizedReader{r: r, key: key, want: size}
+	}
+
+	written, err := b.WriteWithMeta(key, r, meta)
+	return written.Size, err
+}
+
+// deleteReplica removes a replica and leaves a tombstone at version behind,
+// so that anti-entropy does not bring it back from a node that missed the
+// delete.
+func deleteReplica(b Backend, key string, version int64) error {
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	return b.WriteMeta(key, Meta{Key: key, Version: version, Replica: true, Deleted: true})
+}
+
+// replicaMetas returns the metadata of every replica and tombstone in b.
+func replicaMetas(b Backend) ([]Meta, error) {
+	metas, _, err := b.List("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	replicas := metas[:0]
+	for _, meta := range metas {
+		if meta.Replica {
+			replicas = append(replicas, meta)
+		}
+	}
+	return replicas, nil
+}
+
+// keysAfter returns the part of the sorted keys that begins with the first
+// key after cursor that starts with prefix. Callers stop at the first key
+// without the prefix.
+func keysAfter(sorted []string, prefix, cursor string) []string {
+	i := sort.SearchStrings(sorted, max(prefix, cursor))
+	if i < len(sorted) && sorted[i] == cursor {
+		i++
+	}
+	return sorted[i:]
+}
+
+// sortedKeys is a set of keys kept in order as keys are added and removed,
+// so that a page of them is found without sorting all of them.
+type sortedKeys []string
+
+// add adds key and reports whether it was new.
+func (s *sortedKeys) add(key string) bool {
+	i := sort.SearchStrings(*s, key)
+	if i < len(*s) && (*s)[i] == key {
+		return false
+	}
+	*s = slices.Insert(*s, i, key)
+	return true
+}
+
+// remove removes key and reports whether it was there.
+func (s *sortedKeys) remove(key string) bool {
+	i := sort.SearchStrings(*s, key)
+	if i == len(*s) || (*s)[i] != key {
+		return false
+	}
+	*s = slices.Delete(*s, i, i+1)
+	return true
+}
+
+// page returns a copy of up to n keys that start with prefix and come after
+// cursor, or all of them if n is 0 or less.
+func (s sortedKeys) page(prefix, cursor string, n int) []string {
+	var page []string
+	for _, key := range keysAfter(s, prefix, cursor) {
+		if !strings.HasPrefix(key, prefix) || (n > 0 && len(page) == n) {
+			break
+		}
+		page = append(page, key)
+	}
+	return page
+}
+
+// listSorted is listPage for keys that change while they are listed: it
+// asks page for the keys after a cursor a few at a time, as described by
+// sortedKeys.page, and stats them without holding on to the set.
+func listSorted(page func(cursor string, n int) []string, cursor string, limit int, stat func(key string) (Meta, bool)) ([]Meta, string) {
+	var metas []Meta
+	for {
+		n := 0
+		if limit > 0 {
+			n = limit - len(metas) + 1
+		}
+		keys := page(cursor, n)
+		for _, key := range keys {
+			if limit > 0 && len(metas) == limit {
+				return metas, metas[len(metas)-1].Key
+			}
+			if meta, ok := stat(key); ok {
+				metas = append(metas, meta)
+			}
+			cursor = key
+		}
+		if n <= 0 || len(keys) < n {
+			return metas, ""
+		}
+	}
+}
+
+// listPage returns the metadata of up to limit of keys, the result of
+// keysAfter, and the cursor of the next page. stat reports false for keys
+// that are gone.
+func listPage(keys []string, prefix string, limit int, stat func(key string) (Meta, bool)) ([]Meta, string) {
+	var metas []Meta
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if limit > 0 && len(metas) == limit {
+			return metas, metas[len(metas)-1].Key
+		}
+		if meta, ok := stat(key); ok {
+			metas = append(metas, meta)
+		}
+	}
+	return metas, ""
+}
+
+// sizedReader fails at EOF unless exactly want bytes were read.
+type sizedReader struct {
+	r    io.Reader
+	key  string
+	want int64
+	got  int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.got += int64(n)
+	if err == io.EOF && r.got != r.want {
+		return n, fmt.Errorf("short stream for (%s): got %d of %d bytes", r.key, r.got, r.want)
+	}
+	return n, err
+}
+
+// holdsCopy reports whether b has an intact copy of key at version with the
+// plaintext contentHash, in which case there is no need to write it again.
+func holdsCopy(b Backend, key string, version int64, contentHash string) bool {
+	local, err := b.Stat(key)
+	if err != nil || local.Deleted || contentHash == "" || local.Version != version || local.ContentHash != contentHash {
+		return false
+	}
+
+	_, r, err := b.Read(key)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+
+	h := newHashWriter(io.Discard)
+	if _, err := io.Copy(h, r); err != nil {
+		return false
+	}
+	return h.n == local.Size && h.Sum() == local.Checksum
+}
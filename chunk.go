@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// DefaultChunkSize is the size files are split into when
+// FileServerOpts.ChunkSize is not set.
+const DefaultChunkSize = 4 << 20
+
+// chunkPrefix starts the key of every chunk, which is followed by the hex
+// encoded SHA-256 of its contents. Files cannot be stored under it.
+const chunkPrefix = "chunks/"
+
+// chunkVersion is the version of every chunk. A chunk never changes, so
+// all its copies are the same version whenever they were written.
+const chunkVersion = 1
+
+var ErrReservedKey = errors.New("key is reserved for chunks")
+
+// Manifest is stored under the key of a file in place of its contents and
+// lists the chunks that make it up, in order.
+type Manifest struct {
+	Size      int64
+	ChunkSize int64
+	Chunks    []ChunkRef
+}
+
+// ChunkRef identifies a chunk by the hex encoded SHA-256 of its contents.
+type ChunkRef struct {
+	Hash string
+	Size int64
+}
+
+func chunkKey(hash string) string {
+	return chunkPrefix + hash
+}
+
+// storeChunks splits r into chunks of ChunkSize and stores each one before
+// the next is read, so no more than a chunk of the file is held in memory.
+// Chunks already stored, by this file or any other, are not sent again.
+// The chunks are pinned until the caller stores the manifest and unpins
+// them, see pinChunk; on an error they are unpinned already.
+func (s *FileServer) storeChunks(r io.Reader, cl Consistency) (Manifest, error) {
+	m := Manifest{ChunkSize: s.ChunkSize}
+	buf := make([]byte, s.ChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			ref, err := s.storeChunk(buf[:n], cl)
+			if err != nil {
+				s.unpinChunks(m)
+				return Manifest{}, err
+			}
+			m.Chunks = append(m.Chunks, ref)
+			m.Size += ref.Size
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return m, nil
+		}
+		if err != nil {
+			s.unpinChunks(m)
+			return Manifest{}, err
+		}
+	}
+}
+
+func (s *FileServer) storeChunk(data []byte, cl Consistency) (ChunkRef, error) {
+	sum := sha256.Sum256(data)
+	ref := ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+
+	s.pinChunk(ref.Hash)
+	origin := Meta{Version: chunkVersion, Checksum: ref.Hash}
+	if err := s.storeObject(chunkKey(ref.Hash), bytes.NewReader(data), cl, origin, true); err != nil {
+		s.unpinChunks(Manifest{Chunks: []ChunkRef{ref}})
+		return ChunkRef{}, err
+	}
+	return ref, nil
+}
+
+// readManifest decodes the manifest of a chunked file from r.
+func readManifest(key string, r io.Reader) (Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Manifest{}, fmt.Errorf("manifest of (%s): %w", key, err)
+	}
+
+	var size int64
+	for _, ref := range m.Chunks {
+		size += ref.Size
+	}
+	if size != m.Size {
+		return Manifest{}, fmt.Errorf("manifest of (%s): chunks add up to %d of %d bytes", key, size, m.Size)
+	}
+	return m, nil
+}
+
+// chunkReader reads parts of the chunks of a file in turn. Whole chunks are
+// read from the local store as its swarm brings them in, and checked against
+// their hash; other parts are read from wherever the chunk is found.
+type chunkReader struct {
+	s     *FileServer
+	key   string
+	parts []chunkPart
+	swarm *swarm
+
+	cur  io.Reader
+	part chunkPart
+	hash hash.Hash
+	n    int64
+}
+
+func (s *FileServer) newChunkReader(key string, parts []chunkPart) *chunkReader {
+	var whole []ChunkRef
+	for _, part := range parts {
+		if part.whole() {
+			whole = append(whole, part.ref)
+		}
+	}
+	return &chunkReader{s: s, key: key, parts: parts, swarm: s.newSwarm(key, whole)}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.parts) == 0 {
+				c.swarm.report()
+				return 0, io.EOF
+			}
+			if err := c.next(); err != nil {
+				c.swarm.close()
+				return 0, err
+			}
+		}
+
+		n, err := c.cur.Read(p)
+		if c.hash != nil {
+			c.hash.Write(p[:n])
+		}
+		c.n += int64(n)
+		if err == io.EOF {
+			err = c.finish()
+			if err == nil && n == 0 {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) next() error {
+	c.part, c.parts = c.parts[0], c.parts[1:]
+	c.hash, c.n = nil, 0
+
+	if !c.part.whole() {
+		r, err := c.s.readChunkPart(c.key, c.part)
+		if err != nil {
+			return err
+		}
+		c.cur = r
+		return nil
+	}
+
+	if err := c.swarm.wait(c.part.ref); err != nil {
+		return err
+	}
+	_, r, err := c.s.Store.Read(chunkKey(c.part.ref.Hash))
+	if err != nil {
+		return fmt.Errorf("chunk %s of (%s): %w", c.part.ref.Hash, c.key, err)
+	}
+	c.cur, c.hash = r, sha256.New()
+	return nil
+}
+
+// finish closes the current part and checks it was read in full.
+func (c *chunkReader) finish() error {
+	c.closeChunk()
+
+	ref := c.part.ref
+	if c.n != c.part.length {
+		return fmt.Errorf("chunk %s of (%s): read %d of %d bytes", ref.Hash, c.key, c.n, c.part.length)
+	}
+	if c.hash != nil && hex.EncodeToString(c.hash.Sum(nil)) != ref.Hash {
+		return fmt.Errorf("chunk %s of (%s): %w", ref.Hash, c.key, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+func (c *chunkReader) closeChunk() {
+	if rc, ok := c.cur.(io.Closer); ok {
+		rc.Close()
+	}
+	c.cur = nil
+}
+
+// Close releases the chunk being read, if any, and stops the download.
+func (c *chunkReader) Close() error {
+	c.swarm.close()
+	c.closeChunk()
+	return nil
+}
+
+func isChunkKey(key string) bool {
+	return strings.HasPrefix(key, chunkPrefix)
+}
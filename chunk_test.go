@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// newTestServer returns a node without peers that keeps its objects in
+// memory.
+func newTestServer(t *testing.T, chunkSize int64) *FileServer {
+	return NewFileServer(FileServerOpts{
+		ListenAddr:        ":0",
+		StorageRoot:       ":" + t.TempDir(),
+		PathTransformFunc: CASPathTransform,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddress: ":0"}),
+		EncKey:            NewEncryptionKey(),
+		ChunkSize:         chunkSize,
+		Backend:           NewMemoryBackend(),
+	})
+}
+
+func TestChunkedFile(t *testing.T) {
+	s := newTestServer(t, 4)
+	data := []byte("abcdabcdabcdef")
+
+	if err := s.store("a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	size, r, err := s.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(b, data) {
+		t.Errorf("got %d bytes %q, want %q", size, b, data)
+	}
+
+	// abcd is stored once, whichever file it is part of.
+	if err := s.store("b", bytes.NewReader(data[:8])); err != nil {
+		t.Fatal(err)
+	}
+	chunks, _, err := s.Store.List(chunkPrefix, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 {
+		t.Errorf("%d chunks stored, want 2", len(chunks))
+	}
+
+	metas, _, err := s.List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 2 || metas[0].Key != "a" || metas[0].PlainSize != int64(len(data)) {
+		t.Errorf("listed %+v", metas)
+	}
+
+	if err := s.store(chunkPrefix+"x", bytes.NewReader(data)); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("store under %s: got %v, want ErrReservedKey", chunkPrefix, err)
+	}
+
+	// A chunk that does not match its hash fails the read.
+	sum := sha256.Sum256(data[:4])
+	if _, err := s.Store.WriteWithMeta(chunkKey(hex.EncodeToString(sum[:])), bytes.NewReader([]byte("xxxx")), Meta{Version: chunkVersion}); err != nil {
+		t.Fatal(err)
+	}
+	_, r, err = s.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("read with a corrupt chunk: got %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestChunkRange(t *testing.T) {
+	m := Manifest{Size: 10, Chunks: []ChunkRef{{"a", 4}, {"b", 4}, {"c", 2}}}
+
+	tests := []struct {
+		offset, length int64
+		want           []chunkPart
+	}{
+		{0, 10, []chunkPart{{m.Chunks[0], 0, 4}, {m.Chunks[1], 0, 4}, {m.Chunks[2], 0, 2}}},
+		{1, 2, []chunkPart{{m.Chunks[0], 1, 2}}},
+		{3, 6, []chunkPart{{m.Chunks[0], 3, 1}, {m.Chunks[1], 0, 4}, {m.Chunks[2], 0, 1}}},
+		{4, 4, []chunkPart{{m.Chunks[1], 0, 4}}},
+		{10, 0, nil},
+	}
+	for _, tt := range tests {
+		got := chunkRange(m, tt.offset, tt.length)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("chunkRange(%d, %d) = %v, want %v", tt.offset, tt.length, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// newTestCluster starts n nodes that keep their objects in memory and trust
+// each other, connected over loopback TCP, and waits until every node is
+// connected to all others. The nodes share one key store. configure, if not
+// nil, adjusts the options of node i before it starts.
+func newTestCluster(t *testing.T, n int, configure func(i int, opts *FileServerOpts)) []*FileServer {
+	t.Helper()
+
+	var (
+		keys       = newKeyStore(NewEncryptionKey())
+		identities = make([]*p2p.Identity, n)
+		addrs      = make([]string, n)
+		trusted    = p2p.TrustedNodes{}
+	)
+	for i := range identities {
+		id, err := p2p.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities[i], addrs[i] = id, freeAddr(t)
+		trusted[id.NodeID()] = true
+	}
+
+	servers := make([]*FileServer, n)
+	for i := range servers {
+		servers[i] = startTestNode(t, identities[i], trusted, addrs[i], addrs[:i], keys, i, configure)
+	}
+	waitConnected(t, servers, n-1)
+	return servers
+}
+
+// startTestNode starts a node of a test cluster, see newTestCluster.
+func startTestNode(t *testing.T, id *p2p.Identity, trusted p2p.TrustedNodes, addr string, bootstrap []string, keys *KeyStore, i int, configure func(int, *FileServerOpts)) *FileServer {
+	t.Helper()
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddress: addr,
+		ShakeHands:    p2p.TLSHandshakeFunc(id, trusted),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	_, legacy := keys.Legacy()
+	opts := FileServerOpts{
+		NodeID:              id.NodeID(),
+		ListenAddr:          addr,
+		StorageRoot:         ":" + t.TempDir(),
+		PathTransformFunc:   CASPathTransform,
+		Transport:           tr,
+		BootstrapedNodes:    append([]string(nil), bootstrap...),
+		EncKey:              legacy,
+		Keys:                keys,
+		Backend:             NewMemoryBackend(),
+		RequestTimeout:      2 * time.Second,
+		AntiEntropyInterval: -1,
+		GCInterval:          -1,
+	}
+	if configure != nil {
+		configure(i, &opts)
+	}
+
+	s := NewFileServer(opts)
+	tr.TCPTransportOpts.OnPeer = s.OnPeer
+	tr.TCPTransportOpts.OnPeerDisconnect = s.OnPeerDisconnect
+
+	go s.Start()
+	t.Cleanup(func() { stopTestNode(s) })
+	return s
+}
+
+// stopTestNode stops s unless it was stopped already.
+func stopTestNode(s *FileServer) {
+	select {
+	case <-s.QuitCh:
+	default:
+		s.Stop()
+	}
+}
+
+// waitConnected waits until every server has peers connected peers.
+func waitConnected(t *testing.T, servers []*FileServer, peers int) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, s := range servers {
+		for len(s.peerList()) != peers {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s has %d peers, want %d", s.ListenAddr, len(s.peerList()), peers)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// freeAddr returns a loopback address with a port that was free a moment
+// ago.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNotEnoughReplicas = errors.New("not enough replicas responded")
+
+// Consistency is the number of replicas an operation must hear from before
+// it is considered successful.
+type Consistency int
+
+const (
+	// ConsistencyOne needs a single replica.
+	ConsistencyOne Consistency = iota + 1
+	// ConsistencyQuorum needs a majority of the ReplicationFactor replicas.
+	ConsistencyQuorum
+	// ConsistencyAll needs every replica.
+	ConsistencyAll
+)
+
+// Required returns how many of replicationFactor replicas must respond.
+func (c Consistency) Required(replicationFactor int) int {
+	switch c {
+	case ConsistencyAll:
+		return replicationFactor
+	case ConsistencyQuorum:
+		return replicationFactor/2 + 1
+	default:
+		return 1
+	}
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "one":
+		return ConsistencyOne, nil
+	case "quorum":
+		return ConsistencyQuorum, nil
+	case "all":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("unknown consistency level %q (want one, quorum or all)", s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWaitAcks(t *testing.T) {
+	failed := errors.New("replica failed")
+
+	tests := []struct {
+		name     string
+		acks     []error
+		required int
+		ok       bool
+	}{
+		{"all succeed", []error{nil, nil, nil}, 3, true},
+		{"quorum despite a failure", []error{failed, nil, nil}, 2, true},
+		{"all with a failure", []error{nil, failed, nil}, 3, false},
+		{"quorum with two failures", []error{failed, nil, failed}, 2, false},
+	}
+	for _, tt := range tests {
+		acks := make(chan error, len(tt.acks))
+		for _, err := range tt.acks {
+			acks <- err
+		}
+		err := waitAcks(acks, len(tt.acks), tt.required, "a", ConsistencyQuorum)
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrNotEnoughReplicas) {
+			t.Errorf("%s: got %v, want ErrNotEnoughReplicas", tt.name, err)
+		}
+	}
+
+	// It returns once enough succeeded, without waiting for the rest.
+	acks := make(chan error, 3)
+	acks <- nil
+	acks <- nil
+	if err := waitAcks(acks, 3, 2, "a", ConsistencyQuorum); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewestReplica(t *testing.T) {
+	states := []replicaState{
+		{node: "a", has: true, meta: Meta{Version: 2}},
+		{node: "b", has: false, meta: Meta{Version: 5}},
+		{node: "c", has: true, meta: Meta{Version: 3}},
+	}
+	if newest, ok := newestReplica(states); !ok || newest.node != "c" {
+		t.Errorf("newest is %q, want c: a replica that is missing does not count", newest.node)
+	}
+
+	// A newer tombstone wins over the replicas it removed.
+	states = append(states, replicaState{node: "d", meta: Meta{Version: 4, Deleted: true}})
+	if newest, ok := newestReplica(states); !ok || newest.node != "d" {
+		t.Errorf("newest is %q, want the tombstone on d", newest.node)
+	}
+
+	if _, ok := newestReplica([]replicaState{{node: "a"}}); ok {
+		t.Error("found a replica where there is none")
+	}
+}
+
+// failingBackend refuses to store replicas.
+type failingBackend struct {
+	Backend
+}
+
+var errDiskFull = errors.New("disk full")
+
+func (b failingBackend) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	if meta.Replica {
+		return Meta{}, errDiskFull
+	}
+	return b.Backend.WriteWithMeta(key, r, meta)
+}
+
+func TestQuorumWriteWithFailedReplica(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		// Replicas larger than the stream window, so that the failing
+		// replica is reset while the others are still being written.
+		opts.ChunkSize = 1 << 20
+		if i == 2 {
+			opts.Backend = failingBackend{NewMemoryBackend()}
+		}
+	})
+	data := bytes.Repeat([]byte("quorum "), 1<<18)
+
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader(data), ConsistencyQuorum); err != nil {
+		t.Fatalf("store at quorum with one failing replica: %v", err)
+	}
+	if err := servers[0].StoreWithConsistency("b", bytes.NewReader(data), ConsistencyAll); !errors.Is(err, ErrNotEnoughReplicas) {
+		t.Errorf("store at all with one failing replica: got %v, want ErrNotEnoughReplicas", err)
+	}
+
+	_, r, err := servers[1].GetWithConsistency("a", ConsistencyQuorum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("read %d bytes, %v", len(b), err)
+	}
+}
+
+func TestGetServesNewestVersion(t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("v1")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[1].StoreWithConsistency("a", bytes.NewReader([]byte("v2")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// servers[0] still holds a copy of v1, which is not served even at ONE.
+	for _, cl := range []Consistency{ConsistencyOne, ConsistencyQuorum, ConsistencyAll} {
+		_, r, err := servers[0].GetWithConsistency("a", cl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(r); string(b) != "v2" {
+			t.Errorf("read %q at %s, want v2", b, cl)
+		}
+	}
+
+	if err := servers[2].Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := servers[0].GetWithConsistency("a", ConsistencyOne); err == nil {
+		t.Error("a removed file is still served at one")
+	}
+}
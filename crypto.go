@@ -1,14 +1,54 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// Replicas are sealed: a header, followed by the file in segments of up to
+// sealSegment bytes, each encrypted and authenticated with AES-256-GCM. The
+// header is
+//
+//	magic (8) | version (1) | algorithm (1) | segment size (4) | salt (32)
+//
+// Every replica is sealed with a key of its own, derived from the node's key
+// and the random salt, so the nonce of a segment is just its index and
+// whether it is the last one. The header is authenticated along with every
+// segment, and a stream that does not end with the last segment fails, so a
+// replica cannot be altered, reordered or cut short without being noticed.
+//
+// Replicas written before sealing are a random IV followed by the AES-CTR
+// ciphertext of the file. Which of the two a replica is comes from its
+// metadata, never from the bytes: only a replica its metadata marks as
+// legacy (see legacyReplica) may be read as CTR, without authentication,
+// until it is written again. Any other replica must be sealed.
+const (
+	sealMagic     = "GDSSEAL\x00"
+	sealVersion   = 1
+	sealAESGCM    = 1
+	sealSegment   = 64 << 10
+	sealSaltSize  = 32
+	sealHeaderLen = len(sealMagic) + 2 + 4 + sealSaltSize
+	sealTagSize   = 16
+
+	// sealMaxSegment bounds the segment size a header may ask a reader
+	// to buffer.
+	sealMaxSegment = 16 << 20
+)
+
+var ErrTampered = errors.New("replica failed authentication")
+
 func hashKey(key string) string {
 	hash := md5.Sum([]byte(key))
 	return hex.EncodeToString(hash[:])
@@ -20,70 +60,325 @@ func NewEncryptionKey() []byte {
 	return keyBuf
 }
 
+// copyEncrypt seals src with a random salt into dst and returns the size of
+// the sealed replica.
 func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	salt := make([]byte, sealSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return 0, err
 	}
 
-	iv := make([]byte, block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	return copySeal(key, salt, src, dst)
+}
+
+// convergentSalt derives the salt of a chunk from its content hash, so every
+// encryption of the chunk yields the same ciphertext and its replicas are
+// identical wherever they were written. A salt, and so the key it derives,
+// is only ever used for the one plaintext it was derived from; what leaks is
+// which chunks are equal.
+func convergentSalt(key []byte, contentHash string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chunk salt "))
+	mac.Write([]byte(contentHash))
+	return mac.Sum(nil)
+}
+
+// sealedSize returns the size of the sealed replica of a size byte file.
+// There is always a last segment, which is empty for an empty file.
+func sealedSize(size int64) int64 {
+	segments := max((size+sealSegment-1)/sealSegment, 1)
+	return int64(sealHeaderLen) + size + segments*sealTagSize
+}
+
+// openedSize is the inverse of sealedSize: the size of what size sealed
+// bytes hold.
+func openedSize(size int64) int64 {
+	n := size - int64(sealHeaderLen)
+	segments := max((n+sealSegment+sealTagSize-1)/(sealSegment+sealTagSize), 1)
+	return max(n-segments*sealTagSize, 0)
+}
+
+// copySeal seals src with salt into dst and returns the size of the sealed
+// replica.
+func copySeal(key, salt []byte, src io.Reader, dst io.Writer) (int, error) {
+	header := make([]byte, 0, sealHeaderLen)
+	header = append(header, sealMagic...)
+	header = append(header, sealVersion, sealAESGCM)
+	header = binary.BigEndian.AppendUint32(header, sealSegment)
+	header = append(header, salt...)
+
+	aead, err := sealAEAD(key, salt)
+	if err != nil {
 		return 0, err
 	}
 
-	if _, err := dst.Write(iv); err != nil {
+	if _, err := dst.Write(header); err != nil {
 		return 0, err
 	}
+	nw := len(header)
+
+	var (
+		br  = bufio.NewReader(src)
+		buf = make([]byte, sealSegment, sealSegment+sealTagSize)
+	)
+	for i := uint64(0); ; i++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// A full segment is the last one if nothing follows it.
+		last := err != nil
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
 
-	stream := cipher.NewCTR(block, iv)
+		sealed := aead.Seal(buf[:0], segmentNonce(i, last), buf[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return 0, err
+		}
+		nw += len(sealed)
 
-	return copyStream(stream, block.BlockSize(), src, dst)
+		if last {
+			return nw, nil
+		}
+		buf = buf[:sealSegment]
+	}
 }
 
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// copyDecrypt decrypts the replica read from src into dst and returns the
+// size of the replica. A replica that is not legacy and fails authentication,
+// or is not sealed at all, returns ErrTampered.
+func copyDecrypt(key []byte, legacy bool, src io.Reader, dst io.Writer) (int, error) {
+	cr := &countReader{r: src}
+	r, err := decryptReader(key, 0, false, legacy, cr)
 	if err != nil {
 		return 0, err
 	}
+	if _, err := io.Copy(dst, r); err != nil {
+		return 0, err
+	}
+	return int(cr.n), nil
+}
 
-	iv := make([]byte, block.BlockSize())
+// decryptReaderAt returns the plaintext from offset of a replica, given src
+// yields the part of it replicaRange sends for a range from offset. The
+// plaintext goes on past the range up to the end of the segment it ends in.
+func decryptReaderAt(key []byte, offset int64, legacy bool, src io.Reader) (io.Reader, error) {
+	return decryptReader(key, offset, true, legacy, src)
+}
 
-	if _, err := src.Read(iv); err != nil {
-		return 0, err
+// decryptReader returns the plaintext of a replica from offset. src yields
+// the header, or the IV of a CTR replica, followed by the ciphertext from
+// the segment or block offset is in. If partial is set src may end before
+// the last segment. Only a legacy replica may be read as CTR; one that is
+// not and lacks the magic fails with ErrTampered.
+func decryptReader(key []byte, offset int64, partial, legacy bool, src io.Reader) (io.Reader, error) {
+	prefix := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(prefix, []byte(sealMagic)) {
+		if !legacy {
+			return nil, fmt.Errorf("%w: the replica is not sealed", ErrTampered)
+		}
+		return decryptCTR(key, prefix, offset, src)
 	}
 
-	stream := cipher.NewCTR(block, iv)
+	header := make([]byte, sealHeaderLen)
+	copy(header, prefix)
+	if _, err := io.ReadFull(src, header[len(prefix):]); err != nil {
+		return nil, err
+	}
+	segment, salt, err := parseSealHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
 
-	return copyStream(stream, block.BlockSize(), src, dst)
+	r := &openReader{
+		aead:    aead,
+		header:  header,
+		src:     bufio.NewReader(src),
+		buf:     make([]byte, segment+sealTagSize),
+		next:    uint64(offset / int64(segment)),
+		partial: partial,
+	}
+	// Drop the plaintext of the first segment before offset.
+	if _, err := io.CopyN(io.Discard, r, offset%int64(segment)); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
-	var (
-		buf = make([]byte, 32*1024)
-		nw  = blockSize
-	)
-	for {
-		n, err := src.Read(buf)
-		if err != nil && err != io.EOF {
+// parseSealHeader returns the segment size and salt of a sealed replica.
+func parseSealHeader(header []byte) (int, []byte, error) {
+	i := len(sealMagic)
+	if header[i] != sealVersion {
+		return 0, nil, fmt.Errorf("%w: sealed replica version %d is not supported", ErrTampered, header[i])
+	}
+	if header[i+1] != sealAESGCM {
+		return 0, nil, fmt.Errorf("%w: sealed replica algorithm %d is not supported", ErrTampered, header[i+1])
+	}
+	segment := binary.BigEndian.Uint32(header[i+2:])
+	if segment == 0 || segment > sealMaxSegment {
+		return 0, nil, fmt.Errorf("%w: sealed replica segment size %d is out of bounds", ErrTampered, segment)
+	}
+	return int(segment), header[i+6:], nil
+}
+
+// sealAEAD returns the AEAD a replica with salt is sealed with.
+func sealAEAD(key, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("seal key "))
+	mac.Write(salt)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of segment i, which tells the last segment
+// from the others.
+func segmentNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// openReader authenticates and decrypts the segments of a sealed replica.
+type openReader struct {
+	aead   cipher.AEAD
+	header []byte
+	src    *bufio.Reader
+	buf    []byte
+	// next is the index of the next segment to be read.
+	next uint64
+	// partial is set when the segments read may stop before the last one.
+	partial bool
+
+	out  []byte
+	done bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.open(); err != nil {
 			return 0, err
 		}
+	}
 
-		if n > 0 {
-			stream.XORKeyStream(buf, buf[:n])
-			nn, err := dst.Write(buf[:n])
-			if err != nil {
-				return 0, err
-			}
-			nw += nn
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+// open reads the next segment into out.
+func (o *openReader) open() error {
+	n, err := io.ReadFull(o.src, o.buf)
+	if err == io.EOF {
+		if o.partial {
+			o.done = true
+			return nil
 		}
-		if n == 0 {
-			if err == io.EOF {
-				break
-			}
-			continue
+		return fmt.Errorf("%w: the last segment is missing", ErrTampered)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	end := err != nil
+	if !end {
+		if _, err := o.src.Peek(1); err == io.EOF {
+			end = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	i := o.next
+	o.next++
+
+	if !end {
+		out, err := o.aead.Open(o.buf[:0], segmentNonce(i, false), o.buf[:n], o.header)
+		if err != nil {
+			return fmt.Errorf("%w: segment %d", ErrTampered, i)
 		}
+		o.out = out
+		return nil
+	}
+
+	// The stream ends here, which is only allowed at the last segment or,
+	// for a range, at any segment. A failed Open clears its output, so it
+	// does not decrypt in place to leave the ciphertext for the retry.
+	o.done = true
+	out, err := o.aead.Open(nil, segmentNonce(i, true), o.buf[:n], o.header)
+	if err != nil && o.partial {
+		out, err = o.aead.Open(nil, segmentNonce(i, false), o.buf[:n], o.header)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: segment %d is damaged or not the last one", ErrTampered, i)
 	}
-	return nw, nil
+	o.out = out
+	return nil
 }
 
-//NOTE: issue : getting one extra byte while reading for the second time over the peer
+// decryptCTR returns the plaintext from offset of a replica written before
+// sealing, given src yields its ciphertext from offset. CTR mode encrypts
+// every block with its own counter, so decryption can start at any block.
+func decryptCTR(key, iv []byte, offset int64, src io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := int64(block.BlockSize())
+	stream := cipher.NewCTR(block, ctrAdd(iv, uint64(offset/bs)))
+
+	// Skip the keystream of the bytes of the first block before offset.
+	skip := make([]byte, offset%bs)
+	stream.XORKeyStream(skip, skip)
+
+	return cipher.StreamReader{S: stream, R: src}, nil
+}
+
+// ctrAdd returns the counter block n blocks after iv. The counter is the
+// whole block as a big-endian number, as cipher.NewCTR increments it.
+func ctrAdd(iv []byte, n uint64) []byte {
+	ctr := make([]byte, len(iv))
+	copy(ctr, iv)
+	for i := len(ctr) - 1; i >= 0 && n > 0; i-- {
+		n += uint64(ctr[i])
+		ctr[i] = byte(n)
+		n >>= 8
+	}
+	return ctr
+}
+
+// countReader counts the bytes read through it.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -22,7 +26,7 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	fmt.Println(len(dst.String()))
 
 	out := new(bytes.Buffer)
-	nw, err := copyDecrypt(key, dst, out)
+	nw, err := copyDecrypt(key, false, dst, out)
 	if err != nil {
 		t.Error(err)
 	}
@@ -30,7 +34,7 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	fmt.Println(nw)
 	fmt.Println(out.String())
 
-	if nw != 16+len(payload) {
+	if int64(nw) != sealedSize(int64(len(payload))) {
 		t.Fail()
 	}
 
@@ -38,3 +42,154 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Error("decryption failed")
 	}
 }
+
+func TestDecryptReaderAt(t *testing.T) {
+	payload := make([]byte, 3*sealSegment+1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	key := NewEncryptionKey()
+
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), enc); err != nil {
+		t.Fatal(err)
+	}
+	replica := enc.Bytes()
+
+	ranges := [][2]int64{
+		{0, 1}, {0, sealSegment}, {1, sealSegment}, {sealSegment - 1, 2},
+		{sealSegment, 10}, {2*sealSegment + 5, sealSegment + 995}, {0, int64(len(payload))},
+	}
+	for _, rg := range ranges {
+		offset, length := rg[0], rg[1]
+		rc, _, err := replicaRange(io.NopCloser(bytes.NewReader(replica)), int64(len(replica)), offset, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decryptReaderAt(key, offset, false, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(io.LimitReader(r, length))
+		if err != nil {
+			t.Fatalf("range %d+%d: %v", offset, length, err)
+		}
+		if !bytes.Equal(out, payload[offset:offset+length]) {
+			t.Errorf("range %d+%d: decrypted the wrong plaintext", offset, length)
+		}
+	}
+}
+
+func TestSealedSize(t *testing.T) {
+	key := NewEncryptionKey()
+	for _, size := range []int{0, 1, sealSegment - 1, sealSegment, sealSegment + 1, 2 * sealSegment} {
+		n, err := copyEncrypt(key, bytes.NewReader(make([]byte, size)), io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(n) != sealedSize(int64(size)) {
+			t.Errorf("sealed %d bytes into %d, sealedSize says %d", size, n, sealedSize(int64(size)))
+		}
+		if got := openedSize(int64(n)); got != int64(size) {
+			t.Errorf("sealed %d bytes into %d, openedSize says %d", size, n, got)
+		}
+	}
+}
+
+func TestSealTampering(t *testing.T) {
+	key := NewEncryptionKey()
+	enc := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(make([]byte, 2*sealSegment+10)), enc); err != nil {
+		t.Fatal(err)
+	}
+	replica := enc.Bytes()
+	seg := sealSegment + sealTagSize
+
+	flip := func(i int) []byte {
+		b := bytes.Clone(replica)
+		b[i] ^= 1
+		return b
+	}
+	swapped := bytes.Clone(replica)
+	copy(swapped[sealHeaderLen:], replica[sealHeaderLen+seg:sealHeaderLen+2*seg])
+	copy(swapped[sealHeaderLen+seg:], replica[sealHeaderLen:sealHeaderLen+seg])
+
+	tests := map[string][]byte{
+		"magic":            flip(0),
+		"version":          flip(len(sealMagic)),
+		"algorithm":        flip(len(sealMagic) + 1),
+		"salt":             flip(sealHeaderLen - 1),
+		"ciphertext":       flip(sealHeaderLen + seg + 7),
+		"tag":              flip(len(replica) - 1),
+		"last segment cut": replica[:sealHeaderLen+2*seg],
+		"truncated":        replica[:len(replica)-5],
+		"appended":         append(bytes.Clone(replica), 0),
+		"reordered":        swapped,
+	}
+	for name, b := range tests {
+		_, err := copyDecrypt(key, false, bytes.NewReader(b), io.Discard)
+		if !errors.Is(err, ErrTampered) {
+			t.Errorf("%s: got %v, want ErrTampered", name, err)
+		}
+	}
+
+	if _, err := copyDecrypt(NewEncryptionKey(), false, bytes.NewReader(replica), io.Discard); !errors.Is(err, ErrTampered) {
+		t.Errorf("wrong key: got %v, want ErrTampered", err)
+	}
+}
+
+// Replicas written before sealing are the IV followed by the AES-CTR
+// ciphertext, and are still read when their metadata marks them legacy.
+func TestDecryptCTR(t *testing.T) {
+	payload := make([]byte, 1000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	key := NewEncryptionKey()
+
+	// The counter wraps in its lower bytes within the payload.
+	iv := bytes.Repeat([]byte{0xff}, 16)
+	iv[0] = 0x01
+	iv[15] = 0xf0
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := bytes.Clone(iv)
+	ciphertext := make([]byte, len(payload))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, payload)
+	replica = append(replica, ciphertext...)
+
+	out := new(bytes.Buffer)
+	n, err := copyDecrypt(key, true, bytes.NewReader(replica), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(replica) || !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("decrypted %d bytes of the replica to the wrong plaintext", n)
+	}
+
+	// Without the legacy mark it is not read as CTR.
+	if _, err := copyDecrypt(key, false, bytes.NewReader(replica), io.Discard); !errors.Is(err, ErrTampered) {
+		t.Errorf("read a CTR replica not marked legacy: %v", err)
+	}
+
+	for _, offset := range []int64{0, 1, 15, 16, 17, 255, 256, 999} {
+		rc, _, err := replicaRange(io.NopCloser(bytes.NewReader(replica)), int64(len(replica)), offset, int64(len(payload)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := decryptReaderAt(key, offset, true, rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, payload[offset:]) {
+			t.Errorf("offset %d: decrypted the wrong plaintext", offset)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files can be encrypted end to end: the client seals a file before it is
+// stored, with a file key that only the recipients it is wrapped to can
+// unwrap. The nodes store and replicate the sealed file like any other and
+// never see the plaintext or the file key.
+
+// ClientPassphraseEnv names the environment variable the passphrase of the
+// client key is read from when no -client-passphrase flag is given.
+const ClientPassphraseEnv = "STORAGE_CLIENT_PASSPHRASE"
+
+var (
+	ErrNotRecipient = errors.New("client key is not a recipient of the file")
+	ErrNotEncrypted = errors.New("file is not end-to-end encrypted")
+)
+
+// Recipient grants the holder of an X25519 key access to an end-to-end
+// encrypted file. The file key is wrapped with a key agreed between an
+// ephemeral key and the recipient's key.
+type Recipient struct {
+	// PublicKey is the hex encoded X25519 public key of the recipient.
+	PublicKey  string
+	Ephemeral  []byte
+	WrappedKey []byte
+}
+
+// ClientKey is the X25519 key pair of a client of end-to-end encrypted
+// files. The public key is what other clients share files with.
+type ClientKey struct {
+	priv *ecdh.PrivateKey
+}
+
+func NewClientKey() (*ClientKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientKey{priv: priv}, nil
+}
+
+// LoadOrCreateClientKey opens the client key kept in the key store file at
+// path, which is unlocked with passphrase, creating the store with a new key
+// if the file does not exist yet. The private key is never written down in
+// plaintext.
+func LoadOrCreateClientKey(path string, passphrase []byte) (*ClientKey, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	ks, err := LoadOrCreateKeyStore(path, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("client key %s: %w", path, err)
+	}
+
+	// Any 32 bytes are an X25519 private key.
+	_, key := ks.Current()
+	priv, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientKey{priv: priv}, nil
+}
+
+// PublicKey returns the hex encoded public key of ck.
+func (ck *ClientKey) PublicKey() string {
+	return hex.EncodeToString(ck.priv.PublicKey().Bytes())
+}
+
+// ParsePublicKey parses a hex encoded X25519 public key.
+func ParsePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("public key %q: %w", s, err)
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+// SealFor returns r sealed with a new file key, and the file key wrapped to
+// each of the recipients. The recipients are stored along with the file,
+// see StoreEncrypted.
+func SealFor(r io.Reader, recipients ...*ecdh.PublicKey) (io.Reader, []Recipient, error) {
+	if len(recipients) == 0 {
+		return nil, nil, fmt.Errorf("seal: no recipients")
+	}
+
+	fileKey := NewEncryptionKey()
+	var stanzas []Recipient
+	for _, pub := range recipients {
+		stanza, err := wrapTo(pub, fileKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyEncrypt(fileKey, r, pw)
+		pw.CloseWithError(err)
+	}()
+	return pr, stanzas, nil
+}
+
+// Open returns the plaintext of the file sealed for recipients read from r.
+// A file that is not sealed fails with ErrTampered, as does reading one that
+// was altered.
+func (ck *ClientKey) Open(r io.Reader, recipients []Recipient) (io.Reader, error) {
+	fileKey, err := ck.fileKey(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return decryptReader(fileKey, 0, false, false, r)
+}
+
+// Share returns recipients with to added, which ck must be one of.
+func (ck *ClientKey) Share(recipients []Recipient, to *ecdh.PublicKey) ([]Recipient, error) {
+	fileKey, err := ck.fileKey(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString(to.Bytes())
+	shared := make([]Recipient, 0, len(recipients)+1)
+	for _, stanza := range recipients {
+		if stanza.PublicKey != id {
+			shared = append(shared, stanza)
+		}
+	}
+	stanza, err := wrapTo(to, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(shared, stanza), nil
+}
+
+func (ck *ClientKey) fileKey(recipients []Recipient) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNotEncrypted
+	}
+
+	id := ck.PublicKey()
+	for _, stanza := range recipients {
+		if stanza.PublicKey != id {
+			continue
+		}
+		eph, err := ecdh.X25519().NewPublicKey(stanza.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := ck.priv.ECDH(eph)
+		if err != nil {
+			return nil, err
+		}
+		return unwrapKey(recipientKey(secret, stanza.Ephemeral, ck.priv.PublicKey().Bytes()), stanza.WrappedKey, id)
+	}
+	return nil, ErrNotRecipient
+}
+
+// wrapTo wraps fileKey to pub with a key agreed with a new ephemeral key.
+func wrapTo(pub *ecdh.PublicKey, fileKey []byte) (Recipient, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return Recipient{}, err
+	}
+	secret, err := eph.ECDH(pub)
+	if err != nil {
+		return Recipient{}, err
+	}
+
+	stanza := Recipient{
+		PublicKey: hex.EncodeToString(pub.Bytes()),
+		Ephemeral: eph.PublicKey().Bytes(),
+	}
+	kek := recipientKey(secret, stanza.Ephemeral, pub.Bytes())
+	if stanza.WrappedKey, err = wrapKey(kek, fileKey, stanza.PublicKey); err != nil {
+		return Recipient{}, err
+	}
+	return stanza, nil
+}
+
+// recipientKey derives the key a file key is wrapped with from the shared
+// secret of the ephemeral and the recipient's key, and both public keys.
+func recipientKey(secret, ephemeral, recipient []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("e2e file key "))
+	mac.Write(ephemeral)
+	mac.Write(recipient)
+	return mac.Sum(nil)
+}
+
+// StoreEncrypted stores r, a file sealed by SealFor, for recipients with the
+// server's WriteConsistency. The nodes treat it as any other file.
+func (s *FileServer) StoreEncrypted(key string, r io.Reader, recipients []Recipient) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("store (%s): %w", key, ErrNotEncrypted)
+	}
+	return s.storeFile(key, r, s.WriteConsistency, recipients)
+}
+
+// GetEncrypted reads the end-to-end encrypted file key like Get, and returns
+// its recipients, for the client to open it with.
+func (s *FileServer) GetEncrypted(key string) (int64, io.Reader, []Recipient, error) {
+	size, r, err := s.Get(key)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	recipients, err := s.localRecipients(key)
+	if err != nil {
+		if rc, ok := r.(io.Closer); ok {
+			rc.Close()
+		}
+		return 0, nil, nil, err
+	}
+	return size, r, recipients, nil
+}
+
+// SetRecipients replaces the recipients of the end-to-end encrypted file
+// key, for example with the ones ClientKey.Share returns. Only the manifest
+// of the file is written again; its chunks stay as they are.
+func (s *FileServer) SetRecipients(key string, recipients []Recipient) error {
+	if len(recipients) == 0 {
+		return fmt.Errorf("share (%s): %w", key, ErrNotEncrypted)
+	}
+
+	_, r, err := s.getObject(key, s.ReadConsistency)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := s.localRecipients(key); err != nil {
+		return err
+	}
+	if _, err := readManifest(key, bytes.NewReader(b)); err != nil {
+		return err
+	}
+
+	return s.storeObject(key, bytes.NewReader(b), s.WriteConsistency, Meta{Chunked: true, Recipients: recipients}, false)
+}
+
+func (s *FileServer) localRecipients(key string) ([]Recipient, error) {
+	meta, err := s.Store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Recipients) == 0 {
+		return nil, fmt.Errorf("(%s): %w", key, ErrNotEncrypted)
+	}
+	return meta.Recipients, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealFor(t *testing.T) {
+	alice, _ := NewClientKey()
+	bob, _ := NewClientKey()
+	eve, _ := NewClientKey()
+	data := bytes.Repeat([]byte("end to end "), 100)
+
+	r, recipients, err := SealFor(bytes.NewReader(data), publicKey(t, alice), publicKey(t, bob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, data[:32]) {
+		t.Fatal("sealed file holds the plaintext")
+	}
+
+	for _, ck := range []*ClientKey{alice, bob} {
+		plain, err := ck.Open(bytes.NewReader(sealed), recipients)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(plain); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("opened %d bytes, %v", len(b), err)
+		}
+	}
+	if _, err := eve.Open(bytes.NewReader(sealed), recipients); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("open by a non-recipient: got %v, want ErrNotRecipient", err)
+	}
+
+	// A stanza only unwraps for the key it names.
+	stolen := []Recipient{recipients[0]}
+	stolen[0].PublicKey = eve.PublicKey()
+	if _, err := eve.Open(bytes.NewReader(sealed), stolen); !errors.Is(err, ErrTampered) {
+		t.Errorf("open with a renamed stanza: got %v, want ErrTampered", err)
+	}
+
+	// A file without the seal header is not read, as it is not
+	// authenticated.
+	forged := bytes.Repeat([]byte{'x'}, 32)
+	if _, err := alice.Open(bytes.NewReader(forged), recipients); !errors.Is(err, ErrTampered) {
+		t.Errorf("open an unsealed file: got %v, want ErrTampered", err)
+	}
+
+	sealed[len(sealed)/2] ^= 1
+	plain, err := alice.Open(bytes.NewReader(sealed), recipients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(plain); !errors.Is(err, ErrTampered) {
+		t.Errorf("open a tampered file: got %v, want ErrTampered", err)
+	}
+}
+
+func TestLoadOrCreateClientKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.key")
+	ck, err := LoadOrCreateClientKey(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, ck.priv.Bytes()) {
+		t.Error("client key file holds the key in plaintext")
+	}
+
+	again, err := LoadOrCreateClientKey(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.PublicKey() != ck.PublicKey() {
+		t.Errorf("reopened key %s, want %s", again.PublicKey(), ck.PublicKey())
+	}
+	if _, err := LoadOrCreateClientKey(path, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	s := newTestServer(t, 64)
+	alice, _ := NewClientKey()
+	bob, _ := NewClientKey()
+	data := bytes.Repeat([]byte("end to end "), 100)
+
+	r, recipients, err := SealFor(bytes.NewReader(data), publicKey(t, alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StoreEncrypted("a", r, recipients); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.store("b", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := s.GetEncrypted("b"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("GetEncrypted of a plain file: got %v, want ErrNotEncrypted", err)
+	}
+
+	open := func(ck *ClientKey) ([]byte, error) {
+		_, r, recipients, err := s.GetEncrypted("a")
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(sealed, data[:32]) {
+			t.Fatal("node returned the plaintext")
+		}
+		plain, err := ck.Open(bytes.NewReader(sealed), recipients)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(plain)
+	}
+
+	if b, err := open(alice); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("alice opened %d bytes, %v", len(b), err)
+	}
+	if _, err := open(bob); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("bob opened the file before it was shared: %v", err)
+	}
+
+	_, _, recipients, err = s.GetEncrypted("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipients, err = alice.Share(recipients, publicKey(t, bob)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRecipients("a", recipients); err != nil {
+		t.Fatal(err)
+	}
+	for _, ck := range []*ClientKey{alice, bob} {
+		if b, err := open(ck); err != nil || !bytes.Equal(b, data) {
+			t.Errorf("opened %d bytes after sharing, %v", len(b), err)
+		}
+	}
+
+	if err := s.SetRecipients("b", recipients); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("SetRecipients of a plain file: got %v, want ErrNotEncrypted", err)
+	}
+}
+
+func publicKey(t *testing.T, ck *ClientKey) *ecdh.PublicKey {
+	t.Helper()
+	pub, err := ParsePublicKey(ck.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// Every replica is sealed with a data key of its own. The data key is
+// wrapped with the current key-encryption key of the key store and kept in
+// the replica's metadata, along with the ID of that key. Rotating the
+// key-encryption key only rewrites the metadata, never the replicas.
+//
+// Replicas written before data keys carry no key ID. Their data key is the
+// node's EncKey, so wrapping it moves them to the key store as well. The
+// plaintext copies SealedBackend seals at rest get data keys the same way.
+
+// newDataKey returns the data key and the salt a replica is sealed with. A
+// replica of a chunk gets a key and salt derived from its content hash, see
+// convergentSalt; other replicas get a random key, and a random salt from
+// copyEncrypt.
+func newDataKey(kek []byte, contentHash string, convergent bool) ([]byte, []byte) {
+	if !convergent {
+		return NewEncryptionKey(), nil
+	}
+
+	mac := hmac.New(sha256.New, kek)
+	mac.Write([]byte("chunk key "))
+	mac.Write([]byte(contentHash))
+	dek := mac.Sum(nil)
+	return dek, convergentSalt(dek, contentHash)
+}
+
+// wrapKey seals the data key of the replica key under kek. The replica key
+// is authenticated along with it, so a wrapped key cannot be moved to
+// another replica.
+func wrapKey(kek, dek []byte, key string) ([]byte, error) {
+	aead, err := keyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dek, []byte(key)), nil
+}
+
+func unwrapKey(kek, wrapped []byte, key string) ([]byte, error) {
+	aead, err := keyWrapAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped data key of (%s)", ErrTampered, key)
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dek, err := aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrapped data key of (%s)", ErrTampered, key)
+	}
+	return dek, nil
+}
+
+func keyWrapAEAD(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealName seals name, the key of the file whose replica is stored under
+// hashed, with the replica's data key.
+func sealName(dek []byte, name, hashed string) ([]byte, error) {
+	return wrapKey(nameKey(dek), []byte(name), hashed)
+}
+
+// openName returns the key of the file whose replica is stored under hashed
+// from its sealed name.
+func openName(dek, sealed []byte, hashed string) (string, error) {
+	name, err := unwrapKey(nameKey(dek), sealed, hashed)
+	if err != nil || hashKey(string(name)) != hashed {
+		return "", fmt.Errorf("%w: name of (%s)", ErrTampered, hashed)
+	}
+	return string(name), nil
+}
+
+// nameKey derives the key names are sealed with from a data key.
+func nameKey(dek []byte) []byte {
+	mac := hmac.New(sha256.New, dek)
+	mac.Write([]byte("name key"))
+	return mac.Sum(nil)
+}
+
+// plainKey derives the key the PlainSize and ContentHash of an object are
+// sealed with from its data key, see SealedBackend.sealPlain.
+func plainKey(dek []byte) []byte {
+	mac := hmac.New(sha256.New, dek)
+	mac.Write([]byte("plain key"))
+	return mac.Sum(nil)
+}
+
+// dataKey returns the key the replica described by meta is sealed with.
+func (s *FileServer) dataKey(meta Meta) ([]byte, error) {
+	if meta.KeyID == "" {
+		return s.EncKey, nil
+	}
+	return unwrapDataKey(s.Keys, meta)
+}
+
+// legacyReplica tells whether the replica described by meta may be an
+// AES-CTR one written before sealing: one still sealed with the node's key,
+// or whose data key was re-wrapped from it. Every other replica is sealed.
+func legacyReplica(meta Meta) bool {
+	return meta.Legacy || (meta.Replica && meta.KeyID == "" && !meta.Sealed)
+}
+
+// unwrapDataKey unwraps the data key in meta with the key of keys it was
+// wrapped with.
+func unwrapDataKey(keys *KeyStore, meta Meta) ([]byte, error) {
+	kek, ok := keys.Key(meta.KeyID)
+	if !ok {
+		return nil, fmt.Errorf("data key of (%s): %w: %s", meta.Key, ErrUnknownKey, meta.KeyID)
+	}
+	return unwrapKey(kek, meta.WrappedKey, wrappedFor(meta))
+}
+
+// RotateKey makes kek the current key-encryption key, so data keys are
+// wrapped with it from now on, and returns its ID. The data keys of the
+// local replicas and sealed copies are re-wrapped with it in the background.
+func (s *FileServer) RotateKey(kek []byte) (string, error) {
+	id, err := s.Keys.Add(kek)
+	if err != nil {
+		return "", err
+	}
+
+	go func() {
+		n, err := s.rewrapKeys(func(meta Meta) bool { return meta.KeyID != id })
+		if err != nil {
+			log.Printf("[%s] rotate to key %s: %v\n", s.Transport.Addr(), id, err)
+		}
+		fmt.Printf("[%s] Re-wrapped the data keys of %d objects with key %s\n", s.Transport.Addr(), n, id)
+	}()
+	return id, nil
+}
+
+// RevokeKey re-wraps the data keys wrapped with the key id with the current
+// key, and then removes id from the key store. The key is kept if any data
+// key could not be re-wrapped. The current key cannot be revoked.
+func (s *FileServer) RevokeKey(id string) error {
+	if current, _ := s.Keys.Current(); id == current {
+		return fmt.Errorf("revoke %s: it is the current key, rotate to another one first", id)
+	}
+	if _, ok := s.Keys.Key(id); !ok {
+		return fmt.Errorf("revoke: %w: %s", ErrUnknownKey, id)
+	}
+
+	// The legacy key's ID is kept by the key store, as EncKey may be
+	// another key once the legacy one was rotated away from.
+	legacyID, _ := s.Keys.Legacy()
+	legacy := legacyID == id
+	n, err := s.rewrapKeys(func(meta Meta) bool {
+		return meta.KeyID == id || (legacy && meta.KeyID == "")
+	})
+	if err != nil {
+		return fmt.Errorf("revoke %s: re-wrapped %d data keys: %w", id, n, err)
+	}
+	fmt.Printf("[%s] Re-wrapped the data keys of %d objects, revoking key %s\n", s.Transport.Addr(), n, id)
+	return s.Keys.Remove(id)
+}
+
+// rewrapKeys wraps the data keys of the local replicas and sealed copies
+// that match with the current key, and returns how many it re-wrapped.
+func (s *FileServer) rewrapKeys(match func(Meta) bool) (int, error) {
+	metas, _, err := s.Store.List("", "", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n    int
+		errs []error
+	)
+	for _, meta := range metas {
+		if meta.Deleted || !(meta.Replica || meta.Sealed) || !match(meta) {
+			continue
+		}
+		if err := s.rewrapKey(meta); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+func (s *FileServer) rewrapKey(meta Meta) error {
+	dek, err := s.dataKey(meta)
+	if err != nil {
+		return err
+	}
+	id, kek := s.Keys.Current()
+	wrapped, err := wrapKey(kek, dek, wrappedFor(meta))
+	if err != nil {
+		return err
+	}
+
+	// The replica may have been replaced since it was listed.
+	local, err := s.Store.Stat(meta.Key)
+	if err != nil {
+		return err
+	}
+	if local.Version != meta.Version || local.Checksum != meta.Checksum {
+		return nil
+	}
+	local.Legacy = legacyReplica(local)
+	local.KeyID, local.WrappedKey = id, wrapped
+	return s.Store.WriteMeta(meta.Key, local)
+}
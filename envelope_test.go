@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestKeyRotation(t *testing.T) {
+	s := newTestServer(t, 4)
+	data := []byte("abcdabcdabcdef")
+	if err := s.store("a", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A replica written before data keys is sealed with the node's key.
+	var legacy bytes.Buffer
+	if _, err := copyEncrypt(s.EncKey, bytes.NewReader(data), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeReplica(s.Store, hashKey("legacy"), &legacy, -1, Meta{Key: hashKey("legacy"), Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	old, _ := s.Keys.Current()
+	if _, err := s.Keys.Add(NewEncryptionKey()); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := s.Keys.Current()
+	if err := s.RevokeKey(current); err == nil {
+		t.Error("revoked the current key")
+	}
+	if err := s.RevokeKey(old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Keys.Key(old); ok {
+		t.Error("revoked key is still in the key store")
+	}
+
+	metas, _, err := s.Store.List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range metas {
+		if meta.KeyID != current {
+			t.Errorf("(%s) is wrapped with %q, want %s", meta.Key, meta.KeyID, current)
+		}
+	}
+
+	// Without the plaintext copies every file is read from its replicas,
+	// whose data keys are now only wrapped with the current key.
+	all, _, err := s.Store.List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range all {
+		if !meta.Replica {
+			s.Store.Delete(meta.Key)
+		}
+	}
+	for _, key := range []string{"a", "legacy"} {
+		_, r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("read %q from (%s), want %q", b, key, data)
+		}
+	}
+}
+
+func TestUnwrapKey(t *testing.T) {
+	kek, dek := NewEncryptionKey(), NewEncryptionKey()
+	wrapped, err := wrapKey(kek, dek, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unwrapKey(kek, wrapped, "a"); err != nil || !bytes.Equal(got, dek) {
+		t.Errorf("unwrapped %x, %v", got, err)
+	}
+
+	// A wrapped key only unwraps for the replica it was wrapped for.
+	if _, err := unwrapKey(kek, wrapped, "b"); !errors.Is(err, ErrTampered) {
+		t.Errorf("unwrap for another replica: got %v, want ErrTampered", err)
+	}
+	if _, err := unwrapKey(NewEncryptionKey(), wrapped, "a"); !errors.Is(err, ErrTampered) {
+		t.Errorf("unwrap with another key: got %v, want ErrTampered", err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultChunkGracePeriod is how long a chunk no manifest refers to is kept
+// when FileServerOpts.ChunkGracePeriod is not set. A write stores its chunks
+// before the manifest that refers to them. The writing node keeps them until
+// the manifest is stored, but the other owners of a chunk only for the grace
+// period from when they were asked to store it, so a write must finish
+// within it.
+const DefaultChunkGracePeriod = time.Hour
+
+// DefaultGCInterval is how often unreferenced chunks are collected when
+// FileServerOpts.GCInterval is not set. A collection reads every manifest
+// in the cluster, so it runs far less often than anti-entropy.
+const DefaultGCInterval = 6 * time.Hour
+
+// MessageChunkRefs asks for the chunks in one bucket, see bucketOf, that the
+// manifests a node holds refer to. All requests of one collection carry the
+// same Session, so the manifests are only read once.
+type MessageChunkRefs struct {
+	Session uint64
+	Bucket  int
+}
+
+type MessageChunkRefsReply struct {
+	Hashes []string
+}
+
+// chunkRefSession is the references a peer is collecting from us, by bucket.
+type chunkRefSession struct {
+	id      uint64
+	buckets [][]string
+}
+
+func (s *FileServer) gcLoop() {
+	if s.GCInterval < 0 {
+		return
+	}
+
+	for {
+		wait := s.GCInterval/2 + time.Duration(rand.Int63n(int64(s.GCInterval)))
+		select {
+		case <-time.After(wait):
+		case <-s.QuitCh:
+			return
+		}
+
+		if n, err := s.CollectChunks(); err != nil {
+			log.Printf("[%s] collect chunks: %v\n", s.Transport.Addr(), err)
+		} else if n > 0 {
+			fmt.Printf("[%s] Removed %d unreferenced chunks\n", s.Transport.Addr(), n)
+		}
+	}
+}
+
+// CollectChunks removes the copies and replicas of chunks this node holds
+// that no manifest in the cluster refers to, and returns how many chunks it
+// removed. A chunk goes once two collections at least ChunkGracePeriod
+// apart found it unreferenced, so that the chunks of a write whose manifest
+// is not stored yet are kept. Nothing is removed unless every node the
+// cluster has seen told which chunks its manifests refer to.
+//
+// The references are asked for one bucket of the hash space at a time, so
+// no reply grows with the number of chunks in the cluster. A collection cut
+// short has still collected the buckets before.
+//
+// Replicas of chunks are removed without a tombstone: all chunks are the
+// same version, which a tombstone would shadow for good. Anti-entropy may
+// bring one back from an owner that has not collected it yet, until that
+// owner does.
+func (s *FileServer) CollectChunks() (int, error) {
+	refs, err := s.chunkRefs()
+	if err != nil {
+		return 0, err
+	}
+	chunks, err := s.localChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		session = rand.Uint64()
+		peers   = s.peerList()
+		removed int
+	)
+	for b := 0; b < merkleBuckets; b++ {
+		replies, err := s.request(peers, MessageChunkRefs{Session: session, Bucket: b})
+		if err != nil && err != ErrRequestTimeout {
+			return removed, err
+		}
+		if nodes := s.members.Len(); len(replies)+1 < nodes {
+			return removed, fmt.Errorf("collect chunks: %d of %d nodes told their references", len(replies)+1, nodes)
+		}
+		for _, r := range replies {
+			res, ok := r.msg.Payload.(MessageChunkRefsReply)
+			if !ok {
+				return removed, fmt.Errorf("collect chunks: unexpected reply from %s", r.from)
+			}
+			for _, hash := range res.Hashes {
+				refs[hash] = true
+			}
+		}
+
+		n, err := s.collectBucket(b, refs, chunks)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// collectBucket removes the chunks of bucket b that stayed unreferenced
+// for the grace period, and notes those that are newly unreferenced.
+func (s *FileServer) collectBucket(b int, refs map[string]bool, chunks map[string][]string) (int, error) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+
+	// Chunks no longer held start over if they come back.
+	for hash := range s.unreferenced {
+		if _, ok := chunks[hash]; !ok && bucketOf(hash) == b {
+			delete(s.unreferenced, hash)
+		}
+	}
+
+	var (
+		now     = time.Now()
+		removed int
+		errs    []error
+	)
+	for hash, keys := range chunks {
+		if bucketOf(hash) != b {
+			continue
+		}
+		if refs[hash] || s.pinned[hash] > 0 {
+			delete(s.unreferenced, hash)
+			continue
+		}
+		since, ok := s.unreferenced[hash]
+		if !ok {
+			s.unreferenced[hash] = now
+			continue
+		}
+		if now.Sub(since) < s.ChunkGracePeriod {
+			continue
+		}
+
+		for _, key := range keys {
+			if err := s.Store.Delete(key); err != nil {
+				errs = append(errs, fmt.Errorf("remove chunk %s: %w", hash, err))
+			}
+		}
+		delete(s.unreferenced, hash)
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// pinChunk keeps the chunk hash until unpinChunks, for a write whose
+// manifest will refer to it. The chunk may be one a collection found
+// unreferenced already, which the write reuses: its grace period starts
+// over, as a collection that asked for references before the manifest was
+// stored may still be under way.
+func (s *FileServer) pinChunk(hash string) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	s.pinned[hash]++
+	delete(s.unreferenced, hash)
+}
+
+// unpinChunks releases the chunks of m pinned by pinChunk.
+func (s *FileServer) unpinChunks(m Manifest) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	for _, ref := range m.Chunks {
+		if s.pinned[ref.Hash]--; s.pinned[ref.Hash] <= 0 {
+			delete(s.pinned, ref.Hash)
+		}
+	}
+}
+
+// touchChunk starts the grace period of the chunk hash over, for an owner
+// asked to store it by a write.
+func (s *FileServer) touchChunk(hash string) {
+	s.gcMu.Lock()
+	defer s.gcMu.Unlock()
+	delete(s.unreferenced, hash)
+}
+
+// chunkRefs returns the chunks the manifests this node holds, in plaintext
+// copies or replicas, refer to. A manifest that cannot be read fails it, as
+// its chunks are unknown.
+func (s *FileServer) chunkRefs() (map[string]bool, error) {
+	metas, _, err := s.Store.List("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]bool)
+	for _, meta := range metas {
+		if !meta.Chunked || meta.Deleted {
+			continue
+		}
+
+		var m Manifest
+		if meta.Replica {
+			m, err = s.replicaManifest(meta)
+		} else {
+			m, err = s.localManifest(meta.Key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range m.Chunks {
+			refs[ref.Hash] = true
+		}
+	}
+	return refs, nil
+}
+
+// localChunks returns the keys of the copies and replicas of every chunk
+// this node holds, by chunk hash.
+func (s *FileServer) localChunks() (map[string][]string, error) {
+	metas, _, err := s.Store.List("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := make(map[string][]string)
+	for _, meta := range metas {
+		switch {
+		case meta.Deleted:
+		case !meta.Replica && isChunkKey(meta.Key):
+			hash := strings.TrimPrefix(meta.Key, chunkPrefix)
+			chunks[hash] = append(chunks[hash], meta.Key)
+		case meta.Replica && meta.Key == hashKey(chunkKey(meta.ContentHash)):
+			chunks[meta.ContentHash] = append(chunks[meta.ContentHash], meta.Key)
+		}
+	}
+	return chunks, nil
+}
+
+// sessionChunkRefs returns the references in bucket b of collection
+// session of peer from, reading the manifests when a collection starts. The
+// session is dropped with its last bucket.
+func (f *FileServer) sessionChunkRefs(from string, session uint64, b int) ([]string, error) {
+	f.syncMu.Lock()
+	sess, ok := f.chunkRefSessions[from]
+	f.syncMu.Unlock()
+
+	if !ok || sess.id != session {
+		refs, err := f.chunkRefs()
+		if err != nil {
+			return nil, err
+		}
+		sess = &chunkRefSession{id: session, buckets: make([][]string, merkleBuckets)}
+		for hash := range refs {
+			sess.buckets[bucketOf(hash)] = append(sess.buckets[bucketOf(hash)], hash)
+		}
+		for _, hashes := range sess.buckets {
+			sort.Strings(hashes)
+		}
+	}
+
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	if b == merkleBuckets-1 {
+		delete(f.chunkRefSessions, from)
+	} else {
+		f.chunkRefSessions[from] = sess
+	}
+	return sess.buckets[b], nil
+}
+
+func (f *FileServer) handleMessageChunkRefs(from string, id uint64, msg MessageChunkRefs) error {
+	peer, ok := f.peer(from)
+	if !ok {
+		return fmt.Errorf("Peer (%s) could not be found in the peer map", from)
+	}
+	if msg.Bucket < 0 || msg.Bucket >= merkleBuckets {
+		return fmt.Errorf("chunk references of bucket %d asked for by %s", msg.Bucket, from)
+	}
+
+	hashes, err := f.sessionChunkRefs(from, msg.Session, msg.Bucket)
+	if err != nil {
+		return err
+	}
+	return f.reply(peer, id, MessageChunkRefsReply{Hashes: hashes})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCollectChunks(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		opts.ChunkSize = 4
+		opts.ChunkGracePeriod = time.Nanosecond
+	})
+
+	// b shares its first chunk with a.
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("aaaabbbbcccc")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[0].StoreWithConsistency("b", bytes.NewReader([]byte("ccccdddd")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	used := func(s *FileServer) (n int64) {
+		metas, _, err := s.Store.(*SealedBackend).Backend.List("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, meta := range metas {
+			n += meta.Size
+		}
+		return n
+	}
+	before := make([]int64, len(servers))
+	for i, s := range servers {
+		before[i] = used(s)
+	}
+
+	if err := servers[0].Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first collection only notes the unreferenced chunks.
+	for round := 0; round < 2; round++ {
+		for _, s := range servers {
+			if _, err := s.CollectChunks(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i, s := range servers {
+		chunks, err := s.localChunks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 2 {
+			t.Errorf("%s holds %d chunks, want the 2 of b", s.ListenAddr, len(chunks))
+		}
+		if after := used(s); after >= before[i] {
+			t.Errorf("%s uses %d bytes after collecting, %d before", s.ListenAddr, after, before[i])
+		}
+	}
+
+	_, r, err := servers[1].GetWithConsistency("b", ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "ccccdddd" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
+
+func TestCollectChunksWithNodeDown(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		opts.ChunkSize = 4
+		opts.ChunkGracePeriod = time.Nanosecond
+	})
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("aaaa")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the references of servers[2] nothing is collected.
+	stopTestNode(servers[2])
+	waitConnected(t, servers[:2], 1)
+	for round := 0; round < 2; round++ {
+		if _, err := servers[0].CollectChunks(); err == nil {
+			t.Error("collected chunks while a node was down")
+		}
+	}
+}
+
+func TestCollectChunksDuringRewrite(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		opts.ChunkSize = 4
+		opts.ChunkGracePeriod = time.Hour
+	})
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("aaaabbbb")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[0].Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks of a have been unreferenced for longer than the grace period.
+	collect := func() {
+		t.Helper()
+		for _, s := range servers {
+			if _, err := s.CollectChunks(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	collect()
+	for _, s := range servers {
+		s.gcMu.Lock()
+		if len(s.unreferenced) != 2 {
+			t.Errorf("%s found %d unreferenced chunks, want 2", s.ListenAddr, len(s.unreferenced))
+		}
+		for hash := range s.unreferenced {
+			s.unreferenced[hash] = time.Now().Add(-2 * time.Hour)
+		}
+		s.gcMu.Unlock()
+	}
+
+	// a is written again with the same content, and the chunks are collected
+	// after they were found stored, before the manifest is.
+	m, err := servers[0].storeChunks(bytes.NewReader([]byte("aaaabbbb")), ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[0].storeObject("a", bytes.NewReader(b), ConsistencyAll, Meta{Chunked: true}, false); err != nil {
+		t.Fatal(err)
+	}
+	servers[0].unpinChunks(m)
+	collect()
+
+	for _, s := range servers {
+		chunks, err := s.localChunks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunks) != 2 {
+			t.Errorf("%s holds %d chunks, want the 2 of a", s.ListenAddr, len(chunks))
+		}
+	}
+	_, r, err := servers[1].GetWithConsistency("a", ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(r); err != nil || string(b) != "aaaabbbb" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
+
+func TestChunkRefsByBucket(t *testing.T) {
+	s := newTestServer(t, 4)
+	if err := s.store("a", bytes.NewReader([]byte("aaaabbbbccccddddeeeeffffgggghhhh"))); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := s.chunkRefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := 0
+	for b := 0; b < merkleBuckets; b++ {
+		hashes, err := s.sessionChunkRefs("peer", 1, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hash := range hashes {
+			if !refs[hash] || bucketOf(hash) != b {
+				t.Errorf("bucket %d holds %s", b, hash)
+			}
+		}
+		got += len(hashes)
+	}
+	if got != len(refs) || got != 8 {
+		t.Errorf("got %d references in all buckets, want the %d of a", got, len(refs))
+	}
+	if len(s.chunkRefSessions) != 0 {
+		t.Error("session kept after its last bucket")
+	}
+}
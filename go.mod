@@ -4,7 +4,10 @@ go 1.22.0
 
 toolchain go1.22.4
 
-require github.com/magiconair/properties v1.8.7
+require (
+	github.com/magiconair/properties v1.8.7
+	golang.org/x/crypto v0.31.0
+)
 
 require (
 	golang.org/x/lint v0.0.0-20210508222113-6edffad5e616 // indirect
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+const (
+	// DefaultMaxHintBytes bounds the total size of the hint queue when
+	// FileServerOpts.MaxHintBytes is not set.
+	DefaultMaxHintBytes = 1 << 30
+	// DefaultMaxHintAge is how long writes are hinted for a node that went
+	// down, and how long hints are kept, when FileServerOpts.MaxHintAge is
+	// not set. Anti-entropy has to repair anything older.
+	DefaultMaxHintAge = 3 * time.Hour
+)
+
+// hintsDir holds one Store per unreachable node under the storage root.
+// Hidden directories are skipped by Store.List, so hints are not
+// mistaken for this node's own replicas.
+const hintsDir = ".hints"
+
+// hintQueue keeps the replicas and tombstones that could not be delivered to
+// an owner because it was down, until the owner reconnects.
+type hintQueue struct {
+	root     string
+	pathFunc PathTransformFunc
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu        sync.Mutex
+	size      int64
+	replaying map[string]bool
+}
+
+func newHintQueue(root string, pathFunc PathTransformFunc, maxBytes int64, maxAge time.Duration) *hintQueue {
+	q := &hintQueue{
+		root:      filepath.Join(root, hintsDir),
+		pathFunc:  pathFunc,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		replaying: make(map[string]bool),
+	}
+
+	// Pick up the hints left over from before a restart.
+	filepath.WalkDir(q.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, metaSuffix) || d.Name() == keyIndexFile {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			q.size += info.Size()
+		}
+		return nil
+	})
+
+	return q
+}
+
+// store returns the hints kept for node.
+func (q *hintQueue) store(node string) *Store {
+	return NewStore(&StoreOpts{
+		Root:              filepath.Join(q.root, node),
+		PathTransformFunc: q.pathFunc,
+	})
+}
+
+// nodes lists the nodes there are hints for.
+func (q *hintQueue) nodes() []string {
+	entries, err := os.ReadDir(q.root)
+	if err != nil {
+		return nil
+	}
+
+	nodes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			nodes = append(nodes, e.Name())
+		}
+	}
+	return nodes
+}
+
+// reserve claims n bytes of the queue. It fails once the queue is full.
+func (q *hintQueue) reserve(n int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size+n > q.maxBytes {
+		return false
+	}
+	q.size += n
+	return true
+}
+
+func (q *hintQueue) release(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.size -= n
+	if q.size < 0 {
+		q.size = 0
+	}
+}
+
+// hintSize returns the space the hint for key in store takes up, which is
+// released once a newer write or remove of the key replaced it.
+func hintSize(store *Store, key string) int64 {
+	size, r, err := store.Read(key)
+	if err != nil {
+		return 0
+	}
+	r.Close()
+	return size
+}
+
+// drop removes a hint from the queue of node.
+func (q *hintQueue) drop(node string, meta Meta) {
+	store := q.store(node)
+
+	size := hintSize(store, meta.Key)
+	if err := store.Delete(meta.Key); err != nil {
+		log.Printf("drop hint (%s) for %s: %v\n", meta.Key, node, err)
+		return
+	}
+	q.release(size)
+}
+
+func (q *hintQueue) expired(meta Meta) bool {
+	return time.Since(time.Unix(0, meta.Version)) > q.maxAge
+}
+
+// expire drops the hints that are older than the age limit.
+func (q *hintQueue) expire() {
+	for _, node := range q.nodes() {
+		metas, err := replicaMetas(q.store(node))
+		if err != nil {
+			log.Printf("expire hints for %s: %v\n", node, err)
+			continue
+		}
+		for _, meta := range metas {
+			if q.expired(meta) {
+				q.drop(node, meta)
+			}
+		}
+	}
+}
+
+// begin marks the queue of node as being replayed. It reports false if a
+// replay is already running.
+func (q *hintQueue) begin(node string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.replaying[node] {
+		return false
+	}
+	q.replaying[node] = true
+	return true
+}
+
+func (q *hintQueue) end(node string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.replaying, node)
+}
+
+// hintTargets returns the owners of key that are down but were seen within
+// the hint window. Those are the nodes a write of key must be hinted for.
+func (s *FileServer) hintTargets(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var targets []string
+	for _, id := range s.members.Owners(hashKey(key), s.ReplicationFactor) {
+		since, down := s.downSince[id]
+		if !down {
+			continue
+		}
+		if time.Since(since) > s.MaxHintAge {
+			// Gone for good as far as hints are concerned.
+			s.members.Remove(id)
+			delete(s.downSince, id)
+			continue
+		}
+		targets = append(targets, id)
+	}
+	return targets
+}
+
+// hintWriters returns a writer per target that queues the replica written to
+// it. Queueing is best effort: targets are skipped once the queue is full.
+// A hint the write replaces is kept, and its space reserved, until the new
+// one is stored.
+func (s *FileServer) hintWriters(targets []string, key string, size int64, meta Meta) []*hintWriter {
+	var writers []*hintWriter
+
+	for _, node := range targets {
+		if !s.hints.reserve(size) {
+			log.Printf("[%s] hint queue full, not hinting (%s) for %s\n", s.Transport.Addr(), key, node)
+			continue
+		}
+
+		store := s.hints.store(node)
+		replaced := hintSize(store, key)
+		pw, errc := replicaWriter(store, key, meta)
+		writers = append(writers, &hintWriter{bestEffortWriter{w: pw}, pw})
+
+		go func(node string) {
+			if err := <-errc; err != nil {
+				s.hints.release(size)
+				log.Printf("[%s] hint (%s) for %s: %v\n", s.Transport.Addr(), key, node, err)
+				return
+			}
+			s.hints.release(replaced)
+			fmt.Printf("[%s] Hinted (%s) for %s\n", s.Transport.Addr(), key, node)
+		}(node)
+	}
+
+	return writers
+}
+
+// hintWriter queues a replica for an owner that is down.
+type hintWriter struct {
+	bestEffortWriter
+	pw *io.PipeWriter
+}
+
+// CloseWithError finishes the queued replica; a non-nil err discards it.
+func (h *hintWriter) CloseWithError(err error) error {
+	return h.pw.CloseWithError(err)
+}
+
+// hintRemove queues a tombstone for every target.
+func (s *FileServer) hintRemove(targets []string, key string, version int64) {
+	for _, node := range targets {
+		store := s.hints.store(node)
+		replaced := hintSize(store, key)
+
+		if err := deleteReplica(store, key, version); err != nil {
+			log.Printf("[%s] hint remove (%s) for %s: %v\n", s.Transport.Addr(), key, node, err)
+			continue
+		}
+		s.hints.release(replaced)
+	}
+}
+
+// replayHints hands the hints queued for peer over to it, dropping every
+// hint that was delivered or is too old.
+func (s *FileServer) replayHints(peer p2p.Peer) {
+	node := peer.ID()
+	if !s.hints.begin(node) {
+		return
+	}
+	defer s.hints.end(node)
+
+	store := s.hints.store(node)
+	metas, err := replicaMetas(store)
+	if err != nil {
+		log.Printf("[%s] replay hints for %s: %v\n", s.Transport.Addr(), node, err)
+		return
+	}
+
+	delivered := 0
+	for _, meta := range metas {
+		if s.hints.expired(meta) {
+			s.hints.drop(node, meta)
+			continue
+		}
+
+		if err := s.pushReplica(peer, store, meta); err != nil {
+			// Most likely the peer went away again; keep the rest.
+			log.Printf("[%s] replay hint (%s) to %s: %v\n", s.Transport.Addr(), meta.Key, node, err)
+			return
+		}
+		s.hints.drop(node, meta)
+		delivered++
+	}
+
+	if delivered > 0 {
+		fmt.Printf("[%s] Replayed %d hints to %s\n", s.Transport.Addr(), delivered, node)
+	}
+}
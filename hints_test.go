@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHintQueueLimits(t *testing.T) {
+	root := t.TempDir()
+	q := newHintQueue(root, CASPathTransform, 10, time.Hour)
+
+	if !q.reserve(8) {
+		t.Fatal("reserve within the limit failed")
+	}
+	if q.reserve(8) {
+		t.Fatal("reserve beyond the limit succeeded")
+	}
+	q.release(8)
+
+	store := q.store("node")
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	q.reserve(4)
+	if _, err := writeReplica(store, "old", bytes.NewReader([]byte("data")), 4, Meta{Version: old}); err != nil {
+		t.Fatal(err)
+	}
+	q.reserve(4)
+	if _, err := writeReplica(store, "new", bytes.NewReader([]byte("data")), 4, Meta{Version: time.Now().UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue size survives a restart.
+	q = newHintQueue(root, CASPathTransform, 10, time.Hour)
+	if q.size != 8 {
+		t.Fatalf("got size %d after restart, want 8", q.size)
+	}
+
+	q.expire()
+	if store.Has("old") {
+		t.Error("expired hint was kept")
+	}
+	if !store.Has("new") {
+		t.Error("fresh hint was dropped")
+	}
+	if q.size != 4 {
+		t.Errorf("got size %d after expire, want 4", q.size)
+	}
+}
+
+func TestHintReplace(t *testing.T) {
+	s := newTestServer(t, 64)
+	s.hints = newHintQueue(t.TempDir(), CASPathTransform, 10, time.Hour)
+	store := s.hints.store("node")
+
+	hint := func(data string, fail bool) {
+		t.Helper()
+		writers := s.hintWriters([]string{"node"}, "a", int64(len(data)), Meta{Version: time.Now().UnixNano()})
+		for _, w := range writers {
+			w.Write([]byte(data))
+			var err error
+			if fail {
+				err = errDiskFull
+			}
+			w.CloseWithError(err)
+		}
+	}
+	waitSize := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.hints.mu.Lock()
+			size := s.hints.size
+			s.hints.mu.Unlock()
+			if size == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got size %d, want %d", size, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	hint("1234", false)
+	waitSize(4)
+
+	// A hint that does not fit, or fails, leaves the one before in place.
+	hint("1234567", false)
+	waitSize(4)
+	hint("5678", true)
+	waitSize(4)
+	if got := hintSize(store, "a"); got != 4 {
+		t.Fatalf("got a hint of %d bytes, want the first one", got)
+	}
+
+	// A newer hint replaces it once written.
+	hint("567", false)
+	waitSize(3)
+	if got := hintSize(store, "a"); got != 3 {
+		t.Errorf("got a hint of %d bytes, want 3", got)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// keyIndexFile keeps the keys of a Store, under its root. Paths are hashed,
+// so the keys cannot be recovered from the directory tree.
+//
+// The file is a log of quoted keys, one per line, prefixed with + when the
+// key was added and - when it was removed. Keys are added before their
+// object is written and removed after it was deleted, so after a crash the
+// index may list a key that is gone, but never misses one that exists.
+const keyIndexFile = ".keys"
+
+// keyIndex is the in-memory copy of a key index file. Every Store on the
+// same root shares one, see keyIndexFor.
+type keyIndex struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]struct{}
+	// sorted holds the keys in order, kept so as they are added and removed.
+	sorted sortedKeys
+	log    *os.File
+	// lines counts the lines of the file, to know when to rewrite it.
+	lines    int
+	snapshot bool
+}
+
+var keyIndexes = struct {
+	sync.Mutex
+	m map[string]*keyIndex
+}{m: make(map[string]*keyIndex)}
+
+// keyIndexFor returns the key index of the Store at root, loading it on first
+// use. A Store that predates the index gets one built from its metadata.
+func keyIndexFor(root string) (*keyIndex, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	keyIndexes.Lock()
+	defer keyIndexes.Unlock()
+
+	if idx, ok := keyIndexes.m[root]; ok {
+		return idx, nil
+	}
+
+	idx := &keyIndex{
+		path: filepath.Join(root, keyIndexFile),
+		keys: make(map[string]struct{}),
+	}
+	if err := idx.load(root); err != nil {
+		return nil, err
+	}
+	idx.sorted = make(sortedKeys, 0, len(idx.keys))
+	for key := range idx.keys {
+		idx.sorted = append(idx.sorted, key)
+	}
+	sort.Strings(idx.sorted)
+	keyIndexes.m[root] = idx
+	return idx, nil
+}
+
+// forgetKeyIndex drops the key index of root, whose files were removed.
+func forgetKeyIndex(root string) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return
+	}
+
+	keyIndexes.Lock()
+	defer keyIndexes.Unlock()
+
+	if idx, ok := keyIndexes.m[root]; ok {
+		idx.mu.Lock()
+		if idx.log != nil {
+			idx.log.Close()
+		}
+		idx.mu.Unlock()
+		delete(keyIndexes.m, root)
+	}
+}
+
+func (idx *keyIndex) load(root string) error {
+	f, err := os.Open(idx.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		idx.snapshot = true
+		return idx.rebuild(root)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		idx.lines++
+		if len(line) < 2 {
+			continue
+		}
+		key, err := strconv.Unquote(line[1:])
+		if err != nil {
+			// A line torn by a crash; the keys before it are intact.
+			log.Printf("%s: skipping line %d: %v\n", idx.path, idx.lines, err)
+			continue
+		}
+		switch line[0] {
+		case '+':
+			idx.keys[key] = struct{}{}
+		case '-':
+			delete(idx.keys, key)
+		}
+	}
+	return sc.Err()
+}
+
+// rebuild reads the keys from the metadata files under root.
+func (idx *keyIndex) rebuild(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != root && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) || strings.Contains(d.Name(), tempMarker) {
+			return nil
+		}
+
+		meta, err := readMetaFile(path)
+		if err != nil {
+			log.Println("skipping unreadable metadata:", err)
+			return nil
+		}
+		idx.keys[meta.Key] = struct{}{}
+		return nil
+	})
+}
+
+// add records key before its object is written.
+func (idx *keyIndex) add(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.keys[key]; ok {
+		return nil
+	}
+	if err := idx.append('+', key); err != nil {
+		return err
+	}
+	idx.keys[key] = struct{}{}
+	idx.sorted.add(key)
+	return nil
+}
+
+// remove records that the object key was deleted.
+func (idx *keyIndex) remove(key string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if _, ok := idx.keys[key]; !ok {
+		return nil
+	}
+	delete(idx.keys, key)
+	idx.sorted.remove(key)
+	return idx.append('-', key)
+}
+
+// append writes a line to the file, rewriting the whole file first if most
+// of it is history.
+func (idx *keyIndex) append(op byte, key string) error {
+	if idx.snapshot || idx.lines > 2*len(idx.keys)+1024 {
+		if err := idx.rewrite(); err != nil {
+			return err
+		}
+	}
+
+	if idx.log == nil {
+		if err := os.MkdirAll(filepath.Dir(idx.path), os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(idx.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		idx.log = f
+	}
+
+	if _, err := fmt.Fprintf(idx.log, "%c%s\n", op, strconv.Quote(key)); err != nil {
+		return err
+	}
+	idx.lines++
+	return idx.log.Sync()
+}
+
+// rewrite replaces the file by one that adds every key once.
+func (idx *keyIndex) rewrite() error {
+	if idx.log != nil {
+		idx.log.Close()
+		idx.log = nil
+	}
+
+	_, err := writeFileAtomic(idx.path, func(w io.Writer) (int64, error) {
+		bw := bufio.NewWriter(w)
+		for key := range idx.keys {
+			fmt.Fprintf(bw, "+%s\n", strconv.Quote(key))
+		}
+		return 0, bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.lines = len(idx.keys)
+	idx.snapshot = false
+	return nil
+}
+
+// page returns up to n of the keys after cursor that start with prefix, see
+// sortedKeys.page.
+func (idx *keyIndex) page(prefix, cursor string, n int) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.sorted.page(prefix, cursor, n)
+}
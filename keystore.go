@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyStoreFile is the name of the key store under the storage root.
+const KeyStoreFile = "keystore.json"
+
+// PassphraseEnv names the environment variable the key store passphrase is
+// read from when no -passphrase flag is given.
+const PassphraseEnv = "STORAGE_PASSPHRASE"
+
+// The scrypt cost of new key stores. They are kept in the file, so a store
+// opens with the parameters it was created with.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+const keyStoreVersion = 1
+
+var (
+	ErrWrongPassphrase = errors.New("key store: wrong passphrase")
+	ErrUnknownKey      = errors.New("key store: no such key")
+)
+
+// KeyStore holds the node's key-encryption keys in a file, each wrapped with
+// AES-256-GCM under a key derived from a passphrase with scrypt. One of them
+// is current and wraps the data keys of new replicas; the others are kept to
+// unwrap what they wrapped before.
+//
+// A key's ID is derived from the key, so nodes that were given the same key
+// agree on its ID.
+type KeyStore struct {
+	path string
+	kek  []byte
+
+	mu   sync.RWMutex
+	file keyStoreFile
+	keys map[string][]byte
+}
+
+type keyStoreFile struct {
+	Version int
+	KDF     string
+	Salt    []byte
+	N, R, P int
+	Current string
+	// Legacy is the ID of the store's first key, which sealed replicas
+	// directly before data keys. It is kept after the key is removed.
+	Legacy string
+	Keys   []wrappedKey
+}
+
+// wrappedKey is a key-encryption key sealed under the key store's key,
+// with its ID as additional data.
+type wrappedKey struct {
+	ID      string
+	Created time.Time
+	Nonce   []byte
+	Key     []byte
+}
+
+// LoadOrCreateKeyStore opens the key store at path with passphrase, creating
+// it with a new current key if the file does not exist yet.
+func LoadOrCreateKeyStore(path string, passphrase []byte) (*KeyStore, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("key store: empty passphrase")
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return createKeyStore(path, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeyStore{path: path, keys: make(map[string][]byte)}
+	if err := json.Unmarshal(b, &ks.file); err != nil {
+		return nil, fmt.Errorf("key store %s: %w", path, err)
+	}
+	if ks.file.Version != keyStoreVersion || ks.file.KDF != "scrypt" {
+		return nil, fmt.Errorf("key store %s: version %d with %q is not supported", path, ks.file.Version, ks.file.KDF)
+	}
+
+	if ks.kek, err = scrypt.Key(passphrase, ks.file.Salt, ks.file.N, ks.file.R, ks.file.P, 32); err != nil {
+		return nil, err
+	}
+	aead, err := ks.aead()
+	if err != nil {
+		return nil, err
+	}
+	for _, wk := range ks.file.Keys {
+		key, err := aead.Open(nil, wk.Nonce, wk.Key, []byte(wk.ID))
+		if err != nil {
+			return nil, ErrWrongPassphrase
+		}
+		ks.keys[wk.ID] = key
+	}
+	if _, ok := ks.keys[ks.file.Current]; !ok {
+		return nil, fmt.Errorf("key store %s: current key %q is missing", path, ks.file.Current)
+	}
+	// Stores saved before the legacy key was recorded still start with it.
+	if ks.file.Legacy == "" {
+		ks.file.Legacy = ks.file.Keys[0].ID
+	}
+	return ks, nil
+}
+
+func createKeyStore(path string, passphrase []byte) (*KeyStore, error) {
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	kek, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeyStore{
+		path: path,
+		kek:  kek,
+		file: keyStoreFile{Version: keyStoreVersion, KDF: "scrypt", Salt: salt, N: scryptN, R: scryptR, P: scryptP},
+		keys: make(map[string][]byte),
+	}
+	id, err := ks.add(NewEncryptionKey())
+	if err != nil {
+		return nil, err
+	}
+	ks.file.Legacy = id
+	return ks, ks.save()
+}
+
+// newKeyStore returns a key store that only holds key and is not saved.
+func newKeyStore(key []byte) *KeyStore {
+	ks := &KeyStore{keys: make(map[string][]byte)}
+	id := keyID(key)
+	ks.file.Current = id
+	ks.file.Legacy = id
+	ks.file.Keys = []wrappedKey{{ID: id, Created: time.Now().UTC()}}
+	ks.keys[id] = key
+	return ks
+}
+
+func keyID(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("key id "))
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// Current returns the ID of the key new data keys are wrapped with, and the
+// key.
+func (ks *KeyStore) Current() (string, []byte) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.file.Current, ks.keys[ks.file.Current]
+}
+
+// Key returns the key with the given ID.
+func (ks *KeyStore) Key(id string) ([]byte, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[id]
+	return key, ok
+}
+
+// Legacy returns the ID of the key replicas were encrypted with directly
+// before data keys, which is the store's first key, and the key. The key is
+// nil once it was removed.
+func (ks *KeyStore) Legacy() (string, []byte) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.file.Legacy, ks.keys[ks.file.Legacy]
+}
+
+// ReadCurrent returns the current key of the key store file at path. The
+// file must be a copy of the same key store, as the stores of a cluster are,
+// so that its keys are wrapped under the same passphrase and salt. This is
+// how a key rotated to on one node reaches the others without being written
+// down in plaintext.
+func (ks *KeyStore) ReadCurrent(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keyStoreFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, fmt.Errorf("key store %s: %w", path, err)
+	}
+
+	ks.mu.RLock()
+	same := bytes.Equal(file.Salt, ks.file.Salt) && file.KDF == ks.file.KDF &&
+		file.N == ks.file.N && file.R == ks.file.R && file.P == ks.file.P
+	ks.mu.RUnlock()
+	if ks.path == "" || !same {
+		return nil, fmt.Errorf("key store %s: not a copy of this node's key store", path)
+	}
+
+	aead, err := ks.aead()
+	if err != nil {
+		return nil, err
+	}
+	for _, wk := range file.Keys {
+		if wk.ID != file.Current {
+			continue
+		}
+		key, err := aead.Open(nil, wk.Nonce, wk.Key, []byte(wk.ID))
+		if err != nil || keyID(key) != wk.ID {
+			return nil, ErrWrongPassphrase
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("key store %s: current key %q is missing", path, file.Current)
+}
+
+// Add makes key the current key, adding it if the store does not hold it
+// yet, and saves the store. It returns the ID of key.
+func (ks *KeyStore) Add(key []byte) (string, error) {
+	if len(key) != 32 {
+		return "", fmt.Errorf("key store: key is %d bytes, want 32", len(key))
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	prev := ks.file
+	_, had := ks.keys[keyID(key)]
+	id, err := ks.add(key)
+	if err != nil {
+		return "", err
+	}
+	if err := ks.save(); err != nil {
+		ks.file = prev
+		if !had {
+			delete(ks.keys, id)
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+// Remove drops the key id from the store and saves it. The current key
+// cannot be removed.
+func (ks *KeyStore) Remove(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if _, ok := ks.keys[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if id == ks.file.Current {
+		return fmt.Errorf("key store: %s is the current key", id)
+	}
+
+	prev := ks.file
+	keys := make([]wrappedKey, 0, len(ks.file.Keys))
+	for _, wk := range ks.file.Keys {
+		if wk.ID != id {
+			keys = append(keys, wk)
+		}
+	}
+	ks.file.Keys = keys
+	if err := ks.save(); err != nil {
+		ks.file = prev
+		return err
+	}
+	delete(ks.keys, id)
+	return nil
+}
+
+// add wraps key and makes it current. The store is not saved.
+func (ks *KeyStore) add(key []byte) (string, error) {
+	id := keyID(key)
+	if _, ok := ks.keys[id]; ok {
+		ks.file.Current = id
+		return id, nil
+	}
+
+	// A store that is not saved holds its keys in memory only.
+	wk := wrappedKey{ID: id, Created: time.Now().UTC()}
+	if ks.path != "" {
+		wk.Nonce = make([]byte, 12)
+		if _, err := io.ReadFull(rand.Reader, wk.Nonce); err != nil {
+			return "", err
+		}
+		aead, err := ks.aead()
+		if err != nil {
+			return "", err
+		}
+		wk.Key = aead.Seal(nil, wk.Nonce, key, []byte(wk.ID))
+	}
+
+	ks.file.Keys = append(ks.file.Keys[:len(ks.file.Keys):len(ks.file.Keys)], wk)
+	ks.file.Current = wk.ID
+	ks.keys[wk.ID] = key
+	return wk.ID, nil
+}
+
+func (ks *KeyStore) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(ks.kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// save replaces the key store file. Temp files are created readable by the
+// owner only. A store that is not kept in a file is not saved.
+func (ks *KeyStore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(ks.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(ks.path, func(w io.Writer) (int64, error) {
+		n, err := w.Write(b)
+		return int64(n), err
+	})
+	return err
+}
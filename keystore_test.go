@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), KeyStoreFile)
+
+	ks, err := LoadOrCreateKeyStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key := ks.Current()
+	if len(key) != 32 {
+		t.Fatalf("current key is %d bytes", len(key))
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, key) {
+		t.Error("key store holds the key in plaintext")
+	}
+
+	// The key survives a restart.
+	ks, err = LoadOrCreateKeyStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID, got := ks.Current(); gotID != id || !bytes.Equal(got, key) {
+		t.Errorf("reopened with key %s, want %s", gotID, id)
+	}
+	if got, ok := ks.Key(id); !ok || !bytes.Equal(got, key) {
+		t.Errorf("Key(%s) = %x, %v", id, got, ok)
+	}
+
+	if _, err := LoadOrCreateKeyStore(path, []byte("wrong")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := LoadOrCreateKeyStore(path, nil); err == nil {
+		t.Error("opened with an empty passphrase")
+	}
+
+	// Rotating and removing keys is saved.
+	next, err := ks.Add(NewEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Remove(next); err == nil {
+		t.Error("removed the current key")
+	}
+	if err := ks.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	ks, err = LoadOrCreateKeyStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID, _ := ks.Current(); gotID != next {
+		t.Errorf("reopened with key %s, want %s", gotID, next)
+	}
+	if _, ok := ks.Key(id); ok {
+		t.Errorf("removed key %s is still there", id)
+	}
+
+	// The first key stays the legacy one after it was rotated away from.
+	if legacy, key := ks.Legacy(); legacy != id || key != nil {
+		t.Errorf("legacy key is %s, %x; want the removed %s", legacy, key, id)
+	}
+}
+
+func TestKeyStoreReadCurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, KeyStoreFile)
+	ks, err := LoadOrCreateKeyStore(path, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another node starts with a copy and rotates first.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath := filepath.Join(dir, "copy.json")
+	if err := os.WriteFile(copyPath, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := LoadOrCreateKeyStore(copyPath, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kek := NewEncryptionKey()
+	if _, err := other.Add(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ks.ReadCurrent(copyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, kek) {
+		t.Errorf("read key %x, want %x", got, kek)
+	}
+
+	// A store of its own is not read, whatever its passphrase.
+	stranger := filepath.Join(dir, "stranger.json")
+	if _, err := LoadOrCreateKeyStore(stranger, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.ReadCurrent(stranger); err == nil {
+		t.Error("read the current key of another key store")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+)
+
+// DefaultListLimit is the page size of List when no limit is given.
+const DefaultListLimit = 100
+
+// MessageListKeys asks for up to Limit of the files a node holds a plaintext
+// copy or a replica of whose key starts with Prefix and comes after Cursor.
+type MessageListKeys struct {
+	Prefix string
+	Cursor string
+	Limit  int
+}
+
+// MessageListKeysReply holds the files in key order. More is set if the node
+// has further files after the last one.
+type MessageListKeysReply struct {
+	Metas []Meta
+	More  bool
+}
+
+// List returns up to limit of the files stored in the cluster whose key
+// starts with prefix and comes after cursor, in key order, and the cursor of
+// the next page, which is empty after the last one. Files are listed by the
+// nodes that hold a plaintext copy or a replica of them. Peers that do not
+// reply in time are left out of the page.
+func (s *FileServer) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	own, more, err := s.listOwn(prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	peers := s.peerList()
+	replies, err := s.request(peers, MessageListKeys{Prefix: prefix, Cursor: cursor, Limit: limit})
+	if err != nil && err != ErrRequestTimeout {
+		return nil, "", err
+	}
+	if len(replies) < len(peers) {
+		log.Printf("[%s] listing without %d of %d peers that did not reply\n", s.Transport.Addr(), len(peers)-len(replies), len(peers))
+	}
+
+	newest := make(map[string]Meta, len(own))
+	mergeNewest(newest, own)
+	for _, r := range replies {
+		res, ok := r.msg.Payload.(MessageListKeysReply)
+		if !ok {
+			continue
+		}
+		mergeNewest(newest, res.Metas)
+		more = more || res.More
+	}
+
+	// Every node sent its first limit files, so the first limit of the
+	// merged ones are the page. Any node may hold files after them.
+	metas, cut := firstKeys(newest, limit)
+	more = more || cut
+	if !more || len(metas) == 0 {
+		return metas, "", nil
+	}
+	return metas, metas[len(metas)-1].Key, nil
+}
+
+// mergeNewest adds metas to newest, keeping the newest version of each key.
+func mergeNewest(newest map[string]Meta, metas []Meta) {
+	for _, meta := range metas {
+		if cur, ok := newest[meta.Key]; !ok || meta.Version > cur.Version {
+			newest[meta.Key] = meta
+		}
+	}
+}
+
+// firstKeys returns up to limit of metas in key order, and whether any were
+// left out.
+func firstKeys(metas map[string]Meta, limit int) ([]Meta, bool) {
+	sorted := make([]Meta, 0, len(metas))
+	for _, meta := range metas {
+		sorted = append(sorted, meta)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	if len(sorted) > limit {
+		return sorted[:limit], true
+	}
+	return sorted, false
+}
+
+// listOwn returns up to limit of the files this node holds a plaintext copy
+// or a replica of, and whether there are more. They are paged from the files
+// the SealedBackend keeps, which leaves out tombstones and chunks.
+func (s *FileServer) listOwn(prefix, cursor string, limit int) ([]Meta, bool, error) {
+	b, ok := s.Store.(*SealedBackend)
+	if !ok {
+		return nil, false, fmt.Errorf("list: the store does not keep its files")
+	}
+
+	var err error
+	page := func(cursor string, n int) []string {
+		var files []string
+		if err == nil {
+			files, err = b.Files(prefix, cursor, n)
+		}
+		return files
+	}
+	own, next := listSorted(page, cursor, limit, s.fileMeta)
+	if err != nil {
+		return nil, false, err
+	}
+	return own, next != "", nil
+}
+
+// fileMeta returns the metadata of the file key from the newer of the
+// plaintext copy and the replica this node holds of it.
+func (s *FileServer) fileMeta(key string) (Meta, bool) {
+	var (
+		file  Meta
+		found bool
+	)
+	if meta, err := s.Store.Stat(key); err == nil && !meta.Replica && !meta.Deleted {
+		if meta.Chunked {
+			meta, err = s.chunkedMeta(meta)
+		}
+		if err == nil {
+			file, found = meta, true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("[%s] listing (%s): %v\n", s.Transport.Addr(), key, err)
+		}
+	}
+
+	meta, err := s.Store.Stat(hashKey(key))
+	if err != nil || !meta.Replica || meta.Deleted || meta.Name == nil || (found && meta.Version <= file.Version) {
+		return file, found
+	}
+	replica, err := s.replicaFileMeta(meta)
+	if err == nil && replica.Key != key {
+		err = fmt.Errorf("%w: name of (%s)", ErrTampered, meta.Key)
+	}
+	if err == nil && replica.Chunked {
+		replica, err = s.replicaChunkedMeta(replica, meta)
+	}
+	if err != nil {
+		log.Printf("[%s] listing replica (%s): %v\n", s.Transport.Addr(), meta.Key, err)
+		return file, found
+	}
+	return replica, true
+}
+
+// replicaFileMeta returns the metadata of the file the replica meta belongs
+// to, as a plaintext copy of it would have.
+func (s *FileServer) replicaFileMeta(meta Meta) (Meta, error) {
+	dek, err := s.dataKey(meta)
+	if err != nil {
+		return Meta{}, err
+	}
+	name, err := openName(dek, meta.Name, meta.Key)
+	if err != nil {
+		return Meta{}, err
+	}
+
+	return Meta{
+		Key:         name,
+		Version:     meta.Version,
+		Chunked:     meta.Chunked,
+		Recipients:  meta.Recipients,
+		Size:        meta.PlainSize,
+		Checksum:    meta.ContentHash,
+		PlainSize:   meta.PlainSize,
+		ContentHash: meta.ContentHash,
+		Created:     meta.Created,
+		Modified:    meta.Modified,
+	}, nil
+}
+
+// replicaChunkedMeta is chunkedMeta for the manifest in the replica meta.
+func (s *FileServer) replicaChunkedMeta(file, meta Meta) (Meta, error) {
+	m, err := s.replicaManifest(meta)
+	if err != nil {
+		return Meta{}, err
+	}
+	file.PlainSize = m.Size
+	return file, nil
+}
+
+// chunkedMeta returns the metadata of the manifest meta with the size of the
+// file it lists instead of its own.
+func (s *FileServer) chunkedMeta(meta Meta) (Meta, error) {
+	m, err := s.localManifest(meta.Key)
+	if err != nil {
+		return Meta{}, err
+	}
+	meta.PlainSize = m.Size
+	return meta, nil
+}
+
+// localManifest reads the manifest of the plaintext copy of key.
+func (s *FileServer) localManifest(key string) (Manifest, error) {
+	_, r, err := s.Store.Read(key)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer r.Close()
+
+	return readManifest(key, r)
+}
+
+// replicaManifest decrypts the manifest in the replica meta.
+func (s *FileServer) replicaManifest(meta Meta) (Manifest, error) {
+	dek, err := s.dataKey(meta)
+	if err != nil {
+		return Manifest{}, err
+	}
+	_, r, err := s.Store.Read(meta.Key)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer r.Close()
+
+	var manifest bytes.Buffer
+	if _, err := copyDecrypt(dek, legacyReplica(meta), r, &manifest); err != nil {
+		return Manifest{}, err
+	}
+	return readManifest(meta.Key, &manifest)
+}
+
+func (f *FileServer) handleMessageListKeys(from string, id uint64, msg MessageListKeys) error {
+	peer, ok := f.peer(from)
+	if !ok {
+		return fmt.Errorf("Peer (%s) could not be found in the peer map", from)
+	}
+
+	limit := msg.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+
+	metas, more, err := f.listOwn(msg.Prefix, msg.Cursor, limit)
+	if err != nil {
+		return err
+	}
+	return f.reply(peer, id, MessageListKeysReply{Metas: metas, More: more})
+}
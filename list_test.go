@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// slowBackend takes its time to list.
+type slowBackend struct {
+	Backend
+	delay time.Duration
+}
+
+func (b slowBackend) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	time.Sleep(b.delay)
+	return b.Backend.List(prefix, cursor, limit)
+}
+
+func TestListReplicas(t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	files := map[string]string{"a/1": "one", "a/2": "two", "b": "three"}
+	for key, data := range files {
+		if err := servers[0].StoreWithConsistency(key, bytes.NewReader([]byte(data)), ConsistencyAll); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only servers[0] holds the plaintext copies.
+	stopTestNode(servers[0])
+	waitConnected(t, servers[1:], 1)
+
+	metas, next, err := servers[1].List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != len(files) || next != "" {
+		t.Fatalf("listed %d files, next %q; want %d", len(metas), next, len(files))
+	}
+	for _, meta := range metas {
+		if data, ok := files[meta.Key]; !ok || meta.PlainSize != int64(len(data)) {
+			t.Errorf("listed %s of %d bytes", meta.Key, meta.PlainSize)
+		}
+	}
+
+	metas, _, err = servers[1].List("a/", "a/1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].Key != "a/2" {
+		t.Errorf("listed %v after a/1, want a/2", metas)
+	}
+}
+
+func TestListPartial(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		opts.RequestTimeout = 500 * time.Millisecond
+		if i == 2 {
+			opts.Backend = slowBackend{NewMemoryBackend(), 2 * time.Second}
+		}
+	})
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("a")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// servers[2] does not reply in time; the others do.
+	metas, _, err := servers[1].List("", "", 0)
+	if err != nil {
+		t.Fatalf("list without a slow peer: %v", err)
+	}
+	if len(metas) != 1 || metas[0].Key != "a" {
+		t.Errorf("listed %v, want a", metas)
+	}
+}
@@ -8,19 +8,45 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
 )
 
 // makeServer initializes and returns a new FileServer instance.
-// It sets up the TCP transport options, encryption key, storage root, and bootstrap nodes.
-func makeServer(listenAddr string, nodes ...string) *FileServer {
+// It sets up the TCP transport options, node identity, encryption key, storage root, and bootstrap nodes.
+// Peers are only accepted if their node ID is in trusted, or if it holds p2p.AnyNode.
+// Objects are kept by the storage engine named engine.
+// The encryption key is loaded from the key store, which is unlocked with passphrase.
+func makeServer(listenAddr, engine string, passphrase []byte, trusted p2p.TrustedNodes, nodes ...string) *FileServer {
+	storageRoot := listenAddr + "_network"
+
+	// Open the storage engine the node was configured with
+	backend, err := OpenBackend(engine, storageRoot[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the long-term node identity, creating it on first start
+	identity, err := p2p.LoadOrCreateIdentity(storageRoot[1:] + "/node.key")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Unlock the node's data encryption keys, creating them on first start
+	keys, err := LoadOrCreateKeyStore(storageRoot[1:]+"/"+KeyStoreFile, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, legacyKey := keys.Legacy()
 
 	tcpTransportOpts := p2p.TCPTransportOpts{
-		ListenAddress: listenAddr,           // Address to listen on
-		ShakeHands:    p2p.NOPHandshakeFunc, // No-operation handshake function
-		Decoder:       p2p.DefaultDecoder{}, // Default decoder for incoming messages
+		ListenAddress: listenAddr,                              // Address to listen on
+		ShakeHands:    p2p.TLSHandshakeFunc(identity, trusted), // Mutually authenticated TLS 1.3
+		Decoder:       p2p.DefaultDecoder{},                    // Default decoder for incoming messages
 	}
 
 	// Initialize a new TCP transport with the specified options
@@ -28,12 +54,15 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 
 	// Configure FileServer options
 	fileServerOpts := FileServerOpts{
-		ListenAddr:        listenAddr,              // Address to listen on
-		StorageRoot:       listenAddr + "_network", // Directory for storing files
-		PathTransformFunc: CASPathTransform,        // Function to transform file paths
-		Transport:         tcpTransport,            // Transport layer for communication
-		BootstrapedNodes:  nodes,                   // Initial peers to connect to
-		EncKey:            NewEncryptionKey(),      // Encryption key for securing data
+		NodeID:            identity.NodeID(), // Verified identity presented to peers
+		ListenAddr:        listenAddr,        // Address to listen on
+		StorageRoot:       storageRoot,       // Directory for storing files
+		PathTransformFunc: CASPathTransform,  // Function to transform file paths
+		Transport:         tcpTransport,      // Transport layer for communication
+		BootstrapedNodes:  nodes,             // Initial peers to connect to
+		EncKey:            legacyKey,         // Key of replicas encrypted before data keys
+		Keys:              keys,              // Key-encryption keys wrapping the data keys of replicas
+		Backend:           backend,           // Storage engine for local objects
 	}
 
 	// Create a new FileServer with the specified options
@@ -42,6 +71,9 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	// Assign the OnPeer callback to handle new peer connections
 	tcpTransport.TCPTransportOpts.OnPeer = f.OnPeer
 
+	// Forget peers whose connection dropped
+	tcpTransport.TCPTransportOpts.OnPeerDisconnect = f.OnPeerDisconnect
+
 	return f
 }
 
@@ -55,23 +87,100 @@ func main() {
 
 	port := flag.String("port", "", "Server port address")
 	nodes := flag.String("nodes", "", "Remote nodes to connect the current node")
+	trustedFile := flag.String("trusted", "", "File listing the node IDs allowed to connect, one per line")
+	trustAny := flag.Bool("trust-any", false, "Accept any node with a valid identity instead of a -trusted list")
+	readCL := flag.String("read-consistency", "one", "Replicas a read must consult: one, quorum or all")
+	writeCL := flag.String("write-consistency", "one", "Replicas a write must reach: one, quorum or all")
+	engine := flag.String("engine", EngineCAS, "Storage engine: cas (a file per object) or pack (segment files for many small objects)")
+	antiEntropy := flag.Duration("anti-entropy", DefaultAntiEntropyInterval, "Average interval between replica comparisons with peers, negative to disable")
+	gcInterval := flag.Duration("gc", DefaultGCInterval, "Average interval between collections of unreferenced chunks, negative to disable")
+	fillCache := flag.Bool("fill-cache", false, "Keep a local copy of every chunk of a file read, not only those near the reader")
+	passphrase := flag.String("passphrase", "", "Passphrase of the key store, read from $"+PassphraseEnv+" if not given")
+	clientKeyFile := flag.String("client-key", "", "Key store holding the X25519 key of the client for end-to-end encrypted files, created if missing; outside the node's storage root. Without it end-to-end encryption is off")
+	clientPassphrase := flag.String("client-passphrase", "", "Passphrase of the client key, which must not be the node's, read from $"+ClientPassphraseEnv+" if not given")
 
 	flag.Parse()
 
 	validatePortAddr(*port)
 	nodeList := extractAndValidateNodes(*nodes)
 
+	var (
+		trusted p2p.TrustedNodes
+		err     error
+	)
+	switch {
+	case *trustedFile != "" && *trustAny:
+		log.Fatal("-trusted and -trust-any exclude each other")
+	case *trustedFile != "":
+		if trusted, err = p2p.LoadTrustedNodes(*trustedFile); err != nil {
+			log.Fatal(err)
+		}
+	case *trustAny:
+		trusted = p2p.TrustedNodes{p2p.AnyNode: true}
+		fmt.Println("\033[33mWARNING: -trust-any given, any node with a valid identity can connect\033[0m")
+	default:
+		// The node's ID goes into the lists of the other nodes.
+		identity, err := p2p.LoadOrCreateIdentity((*port)[1:] + "_network/node.key")
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Fatalf("no -trusted list of node IDs given, pass -trust-any to accept any node. Node ID: %s", identity.NodeID())
+	}
+
+	if *passphrase == "" {
+		*passphrase = os.Getenv(PassphraseEnv)
+	}
+	if *passphrase == "" {
+		log.Fatalf("a key store passphrase is required: set $%s or pass -passphrase", PassphraseEnv)
+	}
+
+	// The client key belongs to the user of the node, not to the node: it
+	// is kept apart from the node's files and keys, and only the CLI uses it.
+	var clientKey *ClientKey
+	if *clientKeyFile != "" {
+		if *clientPassphrase == "" {
+			*clientPassphrase = os.Getenv(ClientPassphraseEnv)
+		}
+		switch {
+		case *clientPassphrase == "":
+			log.Fatalf("a client key passphrase is required: set $%s or pass -client-passphrase", ClientPassphraseEnv)
+		case *clientPassphrase == *passphrase:
+			log.Fatal("the client key needs a passphrase of its own, not the key store's")
+		}
+		if err := checkOutsideRoot(*clientKeyFile, (*port)[1:]+"_network"); err != nil {
+			log.Fatal(err)
+		}
+		if clientKey, err = LoadOrCreateClientKey(*clientKeyFile, []byte(*clientPassphrase)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	commandChan := make(chan Command)
 	doneProcess := make(chan bool)
 
 	fmt.Printf("\n\033[34mNode Initialization and Bootstrap Process =======>\033[0m\n")
-	s := makeServer(*port, nodeList...)
+	s := makeServer(*port, *engine, []byte(*passphrase), trusted, nodeList...)
+	if s.ReadConsistency, err = ParseConsistency(*readCL); err != nil {
+		log.Fatal(err)
+	}
+	if s.WriteConsistency, err = ParseConsistency(*writeCL); err != nil {
+		log.Fatal(err)
+	}
+	s.AntiEntropyInterval = *antiEntropy
+	s.GCInterval = *gcInterval
+	s.FillCache = *fillCache
+	fmt.Printf("Node ID: %s\n", s.NodeID)
+	currentKey, _ := s.Keys.Current()
+	fmt.Printf("Current key: %s\n", currentKey)
+	if clientKey != nil {
+		fmt.Printf("Client public key: %s\n", clientKey.PublicKey())
+	}
 
 	go func() {
 		log.Fatal(s.Start())
 	}()
 
-	go processCommands(s, commandChan, doneProcess)
+	go processCommands(s, clientKey, commandChan, doneProcess)
 
 	reader := bufio.NewReader(os.Stdin)
 	for {
@@ -92,7 +201,7 @@ func main() {
 		action := strings.TrimSpace(parts[0])
 		key := strings.TrimSpace(parts[1])
 		content := ""
-		if action == "write" && len(parts) == 3 {
+		if (action == "write" || action == "list" || action == "range" || action == "seal" || action == "share") && len(parts) == 3 {
 			content = strings.TrimSpace(parts[2])
 		}
 		commandChan <- Command{Action: action, Key: key, Content: content}
@@ -100,9 +209,16 @@ func main() {
 	}
 }
 
-func processCommands(s *FileServer, commandChan chan Command, done chan bool) {
+func processCommands(s *FileServer, clientKey *ClientKey, commandChan chan Command, done chan bool) {
 	for command := range commandChan {
 		switch command.Action {
+		case "seal", "open", "share":
+			if clientKey == nil {
+				fmt.Println("error : end-to-end encryption needs a client key, pass -client-key")
+				break
+			}
+			processE2ECommand(s, clientKey, command)
+
 		case "write":
 			fmt.Printf("\n\033[34mWriting File =======>\033[0m\n")
 			data := bytes.NewReader([]byte(command.Content))
@@ -125,11 +241,80 @@ func processCommands(s *FileServer, commandChan chan Command, done chan bool) {
 			}
 			fmt.Printf("\nContent of file %s: %s\n", command.Key, string(b))
 
+		case "range":
+			// The content is the offset and, optionally, the length.
+			fmt.Printf("\n\033[34mReading File Range =======>\033[0m\n")
+			offset, length, err := parseRange(command.Content)
+			if err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			n, r, err := s.GetRange(command.Key, offset, length)
+			if err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			b, err := io.ReadAll(r)
+			if rc, ok := r.(io.ReadCloser); ok {
+				rc.Close()
+			}
+			if err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			fmt.Printf("\n%d bytes of file %s from %d: %s\n", n, command.Key, offset, string(b))
+
 		case "remove":
 			fmt.Printf("\n\033[34mRemoving File =======>\033[0m\n")
 			if err := s.Remove(command.Key); err != nil {
 				log.Fatal(err)
 			}
+
+		case "list":
+			// The key is the prefix to list and the content the cursor
+			// printed with the previous page.
+			fmt.Printf("\n\033[34mListing Files =======>\033[0m\n")
+			metas, next, err := s.List(command.Key, command.Content, DefaultListLimit)
+			if err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			for _, meta := range metas {
+				fmt.Printf("%-40s %10d bytes  %s\n", meta.Key, meta.PlainSize, meta.Modified.Format(time.RFC3339))
+			}
+			fmt.Printf("%d files\n", len(metas))
+			if next != "" {
+				fmt.Printf("More files: list,%s,%s\n", command.Key, next)
+			}
+		case "rotate":
+			// The key is a copy of the key store of the node that
+			// rotated first, whose current key becomes current here.
+			// Without one a new key is made in the key store.
+			fmt.Printf("\n\033[34mRotating Key =======>\033[0m\n")
+			kek := NewEncryptionKey()
+			if command.Key != "" {
+				var err error
+				if kek, err = s.Keys.ReadCurrent(command.Key); err != nil {
+					fmt.Println("error : ", err)
+					break
+				}
+			}
+			id, err := s.RotateKey(kek)
+			if err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			fmt.Printf("Current key: %s\n", id)
+
+		case "revoke":
+			// The key is the ID of the key-encryption key to revoke.
+			fmt.Printf("\n\033[34mRevoking Key =======>\033[0m\n")
+			if err := s.RevokeKey(command.Key); err != nil {
+				fmt.Println("error : ", err)
+				break
+			}
+			fmt.Printf("Revoked key: %s\n", command.Key)
+
 		default:
 			fmt.Println("Invalid command")
 		}
@@ -137,6 +322,111 @@ func processCommands(s *FileServer, commandChan chan Command, done chan bool) {
 	}
 }
 
+// processE2ECommand runs an end-to-end encrypted command. The file is
+// sealed and opened here, with the client key; the server only ever gets
+// the sealed file and its recipients.
+func processE2ECommand(s *FileServer, clientKey *ClientKey, command Command) {
+	switch command.Action {
+	case "seal":
+		// The file is encrypted before it is stored, so only the client
+		// key can read it.
+		fmt.Printf("\n\033[34mWriting End-to-End Encrypted File =======>\033[0m\n")
+		pub, err := ParsePublicKey(clientKey.PublicKey())
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		r, recipients, err := SealFor(bytes.NewReader([]byte(command.Content)), pub)
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		if err := s.StoreEncrypted(command.Key, r, recipients); err != nil {
+			fmt.Println("error : ", err)
+		}
+
+	case "open":
+		fmt.Printf("\n\033[34mReading End-to-End Encrypted File =======>\033[0m\n")
+		_, r, recipients, err := s.GetEncrypted(command.Key)
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		plain, err := clientKey.Open(r, recipients)
+		var b []byte
+		if err == nil {
+			b, err = io.ReadAll(plain)
+		}
+		if rc, ok := r.(io.ReadCloser); ok {
+			rc.Close()
+		}
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		fmt.Printf("\nContent of file %s: %s\n", command.Key, string(b))
+
+	case "share":
+		// The content is the public key of the client to share with.
+		fmt.Printf("\n\033[34mSharing End-to-End Encrypted File =======>\033[0m\n")
+		to, err := ParsePublicKey(command.Content)
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		_, r, recipients, err := s.GetEncrypted(command.Key)
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		if rc, ok := r.(io.ReadCloser); ok {
+			rc.Close()
+		}
+		if recipients, err = clientKey.Share(recipients, to); err == nil {
+			err = s.SetRecipients(command.Key, recipients)
+		}
+		if err != nil {
+			fmt.Println("error : ", err)
+			break
+		}
+		fmt.Printf("File %s is shared with %d clients\n", command.Key, len(recipients))
+	}
+}
+
+// checkOutsideRoot fails if path is inside the storage root of a node.
+func checkOutsideRoot(path, root string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absRoot, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("client key %s is inside the node's storage root %s; keep it apart from the node", path, root)
+	}
+	return nil
+}
+
+// parseRange parses "offset[,length]"; without a length the range extends to
+// the end of the file.
+func parseRange(s string) (int64, int64, error) {
+	offset, length, ok := strings.Cut(s, ",")
+	off, err := strconv.ParseInt(strings.TrimSpace(offset), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid offset %q", offset)
+	}
+	if !ok {
+		return off, -1, nil
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(length), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid length %q", length)
+	}
+	return off, n, nil
+}
+
 func validatePortAddr(port string) {
 	if len(port) == 0 && !strings.HasPrefix(port, ":") {
 		log.Fatal("Invalid port argument.", port)
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+)
+
+// MemoryBackend keeps objects and their metadata in memory. Nothing survives
+// a restart, which makes it suited for tests and for nodes that only cache.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+	metas   map[string]Meta
+	// sorted holds the keys of metas in order from the first List on, kept
+	// so as they change.
+	sorted sortedKeys
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string][]byte),
+		metas:   make(map[string]Meta),
+	}
+}
+
+func (m *MemoryBackend) Has(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.objects[key]
+	return ok
+}
+
+func (m *MemoryBackend) Read(key string) (int64, io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.objects[key]
+	if !ok {
+		return 0, nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+	// Objects are replaced, never modified, so b can be shared.
+	return int64(len(b)), io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *MemoryBackend) Write(key string, r io.Reader) (int64, error) {
+	meta, err := m.WriteWithMeta(key, r, Meta{})
+	return meta.Size, err
+}
+
+func (m *MemoryBackend) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	var buf bytes.Buffer
+
+	stored := newHashWriter(&buf)
+	if _, err := io.Copy(stored, r); err != nil {
+		return Meta{}, err
+	}
+	if meta.Checksum != "" && stored.Sum() != meta.Checksum {
+		return Meta{}, ErrChecksumMismatch
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, ok := m.metas[key]
+	if !ok && m.sorted != nil {
+		m.sorted.add(key)
+	}
+	meta = completeMeta(key, meta, prev, stored.n, stored.Sum())
+	m.objects[key] = buf.Bytes()
+	m.metas[key] = meta
+	return meta, nil
+}
+
+func (m *MemoryBackend) WriteMeta(key string, meta Meta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.metas[key]; !ok && m.sorted != nil {
+		m.sorted.add(key)
+	}
+	m.metas[key] = meta
+	return nil
+}
+
+func (m *MemoryBackend) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	delete(m.metas, key)
+	if m.sorted != nil {
+		m.sorted.remove(key)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Stat(key string) (Meta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.metas[key]
+	if !ok {
+		return Meta{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	return meta, nil
+}
+
+func (m *MemoryBackend) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sorted == nil {
+		m.sorted = make(sortedKeys, 0, len(m.metas))
+		for key := range m.metas {
+			m.sorted = append(m.sorted, key)
+		}
+		sort.Strings(m.sorted)
+	}
+
+	metas, next := listPage(keysAfter(m.sorted, prefix, cursor), prefix, limit, func(key string) (Meta, bool) {
+		return m.metas[key], true
+	})
+	return metas, next, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// merkleFanout is the number of children of every inner node.
+	merkleFanout = 16
+	// merkleDepth is the number of levels below the root. The leaves are
+	// merkleFanout^merkleDepth buckets of the ring's hash space.
+	merkleDepth   = 2
+	merkleBuckets = 256
+)
+
+// MerkleTree summarises a set of replicas. Each leaf hashes the keys,
+// versions and checksums that fall into one hash-range bucket, and each inner
+// node hashes its children, so two nodes can find the buckets they disagree
+// on by comparing a few hashes from the root down.
+type MerkleTree struct {
+	// levels[0] holds the root and levels[merkleDepth] the buckets.
+	levels  [][][]byte
+	buckets [][]Meta
+}
+
+// bucketOf maps a replica key to its range of the ring's hash space.
+func bucketOf(key string) int {
+	return int(ringHash(key) >> 56)
+}
+
+func NewMerkleTree(metas []Meta) *MerkleTree {
+	t := &MerkleTree{
+		levels:  make([][][]byte, merkleDepth+1),
+		buckets: make([][]Meta, merkleBuckets),
+	}
+
+	for _, meta := range metas {
+		b := bucketOf(meta.Key)
+		t.buckets[b] = append(t.buckets[b], meta)
+	}
+
+	leaves := make([][]byte, merkleBuckets)
+	for i, bucket := range t.buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].Key < bucket[j].Key })
+		leaves[i] = hashBucket(bucket)
+	}
+	t.levels[merkleDepth] = leaves
+
+	for level := merkleDepth - 1; level >= 0; level-- {
+		below := t.levels[level+1]
+		nodes := make([][]byte, len(below)/merkleFanout)
+		for i := range nodes {
+			h := sha256.New()
+			for _, child := range below[i*merkleFanout : (i+1)*merkleFanout] {
+				h.Write(child)
+			}
+			nodes[i] = h.Sum(nil)
+		}
+		t.levels[level] = nodes
+	}
+
+	return t
+}
+
+func hashBucket(bucket []Meta) []byte {
+	h := sha256.New()
+	buf := make([]byte, 8)
+	for _, meta := range bucket {
+		h.Write([]byte(meta.Key))
+		binary.BigEndian.PutUint64(buf, uint64(meta.Version))
+		h.Write(buf)
+		if meta.Deleted {
+			h.Write([]byte{1})
+		} else {
+			h.Write([]byte{0})
+		}
+		h.Write([]byte(meta.Checksum))
+	}
+	return h.Sum(nil)
+}
+
+func (t *MerkleTree) Root() []byte {
+	return t.levels[0][0]
+}
+
+// Hashes returns the hashes of the given nodes of level. Nodes outside the
+// level are reported as nil.
+func (t *MerkleTree) Hashes(level int, nodes []int) [][]byte {
+	hashes := make([][]byte, len(nodes))
+	if level < 0 || level > merkleDepth {
+		return hashes
+	}
+	for i, n := range nodes {
+		if n >= 0 && n < len(t.levels[level]) {
+			hashes[i] = t.levels[level][n]
+		}
+	}
+	return hashes
+}
+
+// Bucket returns the replicas in bucket i, sorted by key.
+func (t *MerkleTree) Bucket(i int) []Meta {
+	if i < 0 || i >= len(t.buckets) {
+		return nil
+	}
+	return t.buckets[i]
+}
+
+// merkleChildren returns the indexes of the children of nodes on the next
+// level down.
+func merkleChildren(nodes []int) []int {
+	children := make([]int, 0, len(nodes)*merkleFanout)
+	for _, n := range nodes {
+		for i := 0; i < merkleFanout; i++ {
+			children = append(children, n*merkleFanout+i)
+		}
+	}
+	return children
+}
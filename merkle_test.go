@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestMerkleTreeLocatesDifference(t *testing.T) {
+	var a, b []Meta
+	for i := 0; i < 500; i++ {
+		meta := Meta{Key: hashKey(fmt.Sprintf("key_%d", i)), Version: int64(i), Replica: true}
+		a = append(a, meta)
+		b = append(b, meta)
+	}
+
+	if !bytes.Equal(NewMerkleTree(a).Root(), NewMerkleTree(b).Root()) {
+		t.Fatal("equal sets must have equal roots")
+	}
+
+	b[42].Version++
+	ta, tb := NewMerkleTree(a), NewMerkleTree(b)
+	if bytes.Equal(ta.Root(), tb.Root()) {
+		t.Fatal("changed version must change the root")
+	}
+
+	// Walk down from the root the way syncWith does.
+	nodes := []int{0}
+	for level := 0; level <= merkleDepth; level++ {
+		ha, hb := ta.Hashes(level, nodes), tb.Hashes(level, nodes)
+
+		var diff []int
+		for i, n := range nodes {
+			if !bytes.Equal(ha[i], hb[i]) {
+				diff = append(diff, n)
+			}
+		}
+		if len(diff) != 1 {
+			t.Fatalf("level %d: want 1 differing node, got %v", level, diff)
+		}
+		nodes = diff
+		if level < merkleDepth {
+			nodes = merkleChildren(diff)
+		}
+	}
+
+	if want := bucketOf(b[42].Key); nodes[0] != want {
+		t.Errorf("got bucket %d want %d", nodes[0], want)
+	}
+}
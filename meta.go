@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const metaSuffix = ".meta"
+
+var ErrChecksumMismatch = errors.New("replica does not match its checksum")
+
+// Meta is the metadata the Store keeps in a sidecar file next to every
+// object. Replicas of a file carry the metadata of the write that created
+// them, so all of them agree on it.
+type Meta struct {
+	// Key is the key the object was stored under, which the hashed path
+	// does not reveal.
+	Key string
+	// Version orders writes of the same key; the newest version wins.
+	Version int64
+	// Replica marks the encrypted copies placed by the ring, as opposed to
+	// the plaintext copy kept by the node a file was written on, which is
+	// encrypted at rest by SealedBackend instead.
+	Replica bool
+	// Deleted marks a tombstone: the replica was removed at Version.
+	Deleted bool
+	// Chunked marks the manifest of a file stored as chunks.
+	Chunked bool
+	// Sealed marks a plaintext copy that SealedBackend encrypted at rest.
+	// As stored, Size and Checksum describe the sealed bytes; SealedBackend
+	// reports those of the plaintext instead.
+	Sealed bool
+
+	// Size and Checksum, the hex encoded SHA-256, describe the bytes stored
+	// on disk.
+	Size     int64
+	Checksum string
+	// PlainSize and ContentHash describe the file as it was written, before
+	// encryption. For plaintext objects they equal Size and Checksum.
+	PlainSize   int64
+	ContentHash string
+
+	// WrappedKey is the data key an encrypted replica or a sealed copy is
+	// sealed with, wrapped with the key-encryption key KeyID. Replicas
+	// without a KeyID are sealed with the node's key.
+	KeyID      string
+	WrappedKey []byte
+	// Legacy marks a replica that may have been written before sealing, and
+	// so may be read as AES-CTR; see legacyReplica.
+	Legacy bool
+
+	// Recipients marks a file the client encrypted end to end, and holds its
+	// file key wrapped to everyone it is shared with.
+	Recipients []Recipient
+
+	// Name is the key of the file a replica belongs to, sealed with the
+	// replica's data key, so that the owners can list it; see sealName.
+	Name []byte
+
+	// Plain holds the PlainSize and ContentHash of a sealed copy or a
+	// replica as SealedBackend stores them, sealed with its data key. They
+	// are empty on disk, and restored from Plain on Stat.
+	Plain []byte
+
+	Created  time.Time
+	Modified time.Time
+}
+
+func (s *Store) metaPath(key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return pathKey.FullPath(s.Root) + metaSuffix
+}
+
+func (s *Store) WriteMeta(key string, meta Meta) error {
+	if err := s.indexKey(key); err != nil {
+		return err
+	}
+
+	// A tombstone outlives the object, so its directory may be gone;
+	// writeFileAtomic creates it.
+	return writeMetaFile(s.metaPath(key), meta)
+}
+
+func writeMetaFile(path string, meta Meta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeFileAtomic(path, func(w io.Writer) (int64, error) {
+		n, err := w.Write(b)
+		return int64(n), err
+	})
+	return err
+}
+
+func readMetaFile(path string) (Meta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Meta{}, err
+	}
+
+	var meta Meta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return Meta{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return meta, nil
+}
+
+// Stat returns the metadata of key. Objects written before metadata was
+// introduced get what the file system knows about them.
+func (s *Store) Stat(key string) (Meta, error) {
+	meta, err := readMetaFile(s.metaPath(key))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return meta, err
+	}
+
+	pathKey := s.PathTransformFunc(key)
+	fi, err := os.Stat(pathKey.FullPath(s.Root))
+	if err != nil {
+		return Meta{}, err
+	}
+
+	return Meta{
+		Key:       key,
+		Size:      fi.Size(),
+		PlainSize: fi.Size(),
+		Modified:  fi.ModTime(),
+	}, nil
+}
+
+// WriteWithMeta stores the object read from r together with its metadata
+// and returns the metadata written. See Backend.
+//
+// The object and its metadata take two renames to replace the previous
+// ones. The metadata is written first, next to the temp file of the object,
+// so that a crash in between leaves it behind for CleanTemp to finish the
+// write with.
+func (s *Store) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	if err := s.indexKey(key); err != nil {
+		return Meta{}, err
+	}
+
+	// If meta already holds a checksum the object must match it, otherwise
+	// the previous version is left in place.
+	var (
+		stored  *hashWriter
+		pending string
+	)
+	write := func(w io.Writer) (int64, error) {
+		stored = newHashWriter(w)
+		n, err := io.Copy(stored, r)
+		if err != nil {
+			return n, err
+		}
+		if meta.Checksum != "" && stored.Sum() != meta.Checksum {
+			return n, ErrChecksumMismatch
+		}
+		return n, nil
+	}
+	prepare := func(tmp string) error {
+		// Losing the creation time is better than failing a completed write.
+		prev, _ := readMeta(s, key)
+		meta = completeMeta(key, meta, prev, stored.n, stored.Sum())
+
+		pending = tmp + metaSuffix
+		return writeMetaFile(pending, meta)
+	}
+	_, err := s.writeFunc(key, write, prepare)
+	if err == nil {
+		err = os.Rename(pending, s.metaPath(key))
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(pending))
+	}
+	if err != nil {
+		if pending != "" {
+			// The object may be in place already.
+			reconcileMeta(pending)
+		}
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+// reconcileMeta settles the metadata at pending, which a write left next to
+// the temp file of its object, see WriteWithMeta. If the object made it into
+// place, the metadata follows it; otherwise the write never happened and
+// the metadata is dropped.
+func reconcileMeta(pending string) error {
+	meta, err := readMetaFile(pending)
+	if err != nil {
+		log.Printf("dropping unreadable metadata of an unfinished write: %v\n", err)
+		return os.Remove(pending)
+	}
+
+	name := filepath.Base(pending)
+	object := filepath.Join(filepath.Dir(pending), name[:strings.Index(name, tempMarker)])
+	if sum, err := fileChecksum(object); err != nil || sum != meta.Checksum {
+		return os.Remove(pending)
+	}
+
+	fmt.Printf("Finishing unfinished write [%s]\n", object)
+	if err := os.Rename(pending, object+metaSuffix); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(object))
+}
+
+// fileChecksum returns the hex encoded SHA-256 of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHashWriter(io.Discard)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return h.Sum(), nil
+}
+
+// indexKey adds key to the key index before anything is written for it.
+func (s *Store) indexKey(key string) error {
+	idx, err := keyIndexFor(s.Root)
+	if err != nil {
+		return err
+	}
+	return idx.add(key)
+}
+
+// hashWriter counts and hashes what is written through it.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func newHashWriter(w io.Writer) *hashWriter {
+	return &hashWriter{w: w, h: sha256.New()}
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 of everything written so far.
+func (hw *hashWriter) Sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+// List returns the metadata of the keys in the key index that start with
+// prefix, see Backend. Keys whose object is gone are skipped.
+func (s *Store) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	idx, err := keyIndexFor(s.Root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := func(cursor string, n int) []string {
+		return idx.page(prefix, cursor, n)
+	}
+	metas, next := listSorted(page, cursor, limit, func(key string) (Meta, bool) {
+		meta, err := s.Stat(key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("skipping unreadable metadata:", err)
+		}
+		return meta, err == nil
+	})
+	return metas, next, nil
+}
@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -15,29 +16,26 @@ func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
 	return gob.NewDecoder(r).Decode(rpc)
 }
 
+// DefaultDecoder reads one length-prefixed frame per call (see frame.go).
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
-	peekBuf := make([]byte, 1)
-
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
-	}
-
-	if stream := peekBuf[0] == IncomingStream; stream {
-		rpc.Stream = true
-		return nil
-	}
-
-	buf := make([]byte, 1024)
-
-	n, err := r.Read(buf)
-
+	h, payload, err := ReadFrame(r)
 	if err != nil {
 		return err
 	}
 
-	rpc.Payload = buf[:n]
+	switch h.Type {
+	case IncomingStream:
+		rpc.Stream = true
+		rpc.StreamID = h.StreamID
+		rpc.Flags = h.Flags
+		rpc.Payload = payload
+	case IncomingMessage:
+		rpc.Payload = payload
+	default:
+		return fmt.Errorf("p2p: unknown frame type 0x%x", h.Type)
+	}
 
 	return nil
 }
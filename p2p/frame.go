@@ -0,0 +1,101 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameVersion is the wire format version written in every frame header.
+// Version 2 added the stream ID used for multiplexing, version 3 the
+// announcement of new streams (FlagOpen).
+const FrameVersion = 3
+
+// FrameHeaderSize is the size of the fixed frame header:
+// version (1) | type (1) | flags (2) | stream id (4) | payload length (4).
+const FrameHeaderSize = 12
+
+// MaxFramePayload bounds the payload a single frame can carry so a corrupt
+// or hostile length field cannot make the decoder allocate unbounded memory.
+const MaxFramePayload = 16 << 20
+
+var (
+	ErrFrameVersion  = errors.New("p2p: unsupported frame version")
+	ErrFrameTooLarge = errors.New("p2p: frame payload too large")
+)
+
+type FrameHeader struct {
+	Version  uint8
+	Type     uint8
+	Flags    uint16
+	StreamID uint32
+	Length   uint32
+}
+
+func (h FrameHeader) encode(buf []byte) {
+	buf[0] = h.Version
+	buf[1] = h.Type
+	binary.BigEndian.PutUint16(buf[2:4], h.Flags)
+	binary.BigEndian.PutUint32(buf[4:8], h.StreamID)
+	binary.BigEndian.PutUint32(buf[8:12], h.Length)
+}
+
+func decodeFrameHeader(buf []byte) FrameHeader {
+	return FrameHeader{
+		Version:  buf[0],
+		Type:     buf[1],
+		Flags:    binary.BigEndian.Uint16(buf[2:4]),
+		StreamID: binary.BigEndian.Uint32(buf[4:8]),
+		Length:   binary.BigEndian.Uint32(buf[8:12]),
+	}
+}
+
+// WriteFrame writes a single frame (header followed by payload) to w in one
+// Write call, so frames from concurrent senders are never interleaved as long
+// as the underlying writer is serialised.
+func WriteFrame(w io.Writer, typ uint8, flags uint16, streamID uint32, payload []byte) error {
+	if len(payload) > MaxFramePayload {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	FrameHeader{
+		Version:  FrameVersion,
+		Type:     typ,
+		Flags:    flags,
+		StreamID: streamID,
+		Length:   uint32(len(payload)),
+	}.encode(buf)
+	copy(buf[FrameHeaderSize:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads exactly one frame from r, blocking until the full header
+// and payload have arrived.
+func ReadFrame(r io.Reader) (FrameHeader, []byte, error) {
+	hbuf := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, hbuf); err != nil {
+		return FrameHeader{}, nil, err
+	}
+
+	h := decodeFrameHeader(hbuf)
+	if h.Version != FrameVersion {
+		return h, nil, fmt.Errorf("%w: %d", ErrFrameVersion, h.Version)
+	}
+	if h.Length > MaxFramePayload {
+		return h, nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, h.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, nil, err
+	}
+
+	return h, payload, nil
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("metadata"), 1024)
+
+	buf := new(bytes.Buffer)
+	if err := WriteFrame(buf, IncomingMessage, 0, 0, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(buf, IncomingStream, FlagFIN, 7, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliver one byte per Read to simulate a message split across segments.
+	r := iotest.OneByteReader(buf)
+
+	rpc := RPC{}
+	if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rpc.Payload, payload) {
+		t.Errorf("payload mismatch: got %d bytes want %d", len(rpc.Payload), len(payload))
+	}
+
+	rpc = RPC{}
+	if err := (DefaultDecoder{}).Decode(r, &rpc); err != nil {
+		t.Fatal(err)
+	}
+	if !rpc.Stream || rpc.StreamID != 7 || rpc.Flags != FlagFIN {
+		t.Errorf("unexpected stream frame %+v", rpc)
+	}
+}
+
+func TestFrameRejectsBadHeader(t *testing.T) {
+	hdr := make([]byte, FrameHeaderSize)
+	FrameHeader{Version: FrameVersion + 1, Type: IncomingMessage}.encode(hdr)
+	if _, _, err := ReadFrame(bytes.NewReader(hdr)); err == nil {
+		t.Error("expected version error")
+	}
+
+	FrameHeader{Version: FrameVersion, Type: IncomingMessage, Length: MaxFramePayload + 1}.encode(hdr)
+	if _, _, err := ReadFrame(bytes.NewReader(hdr)); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
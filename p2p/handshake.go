@@ -1,7 +1,138 @@
 package p2p
 
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
 type HandshakeFunc func(Peer) error
 
 func NOPHandshakeFunc(Peer) error {
 	return nil
 }
+
+// HandshakeTimeout bounds how long a TLS handshake may take.
+const HandshakeTimeout = 10 * time.Second
+
+var ErrUntrustedPeer = errors.New("p2p: peer key is not in the trusted node list")
+
+// TrustedNodes is an allowlist of node IDs (hex Ed25519 public keys). A nil
+// or empty list trusts no peer.
+type TrustedNodes map[string]bool
+
+// AnyNode, listed in TrustedNodes, trusts every peer that proves possession
+// of its key.
+const AnyNode = "*"
+
+// LoadTrustedNodes reads one node ID per line; blank lines and lines starting
+// with '#' are ignored.
+func LoadTrustedNodes(path string) (TrustedNodes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	trusted := TrustedNodes{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("p2p: invalid node id %q in %s", line, path)
+		}
+		trusted[strings.ToLower(line)] = true
+	}
+	return trusted, sc.Err()
+}
+
+// TLSHandshakeFunc upgrades the peer connection to mutually authenticated
+// TLS 1.3. Both sides present a self-signed certificate for their Identity;
+// the certificate chain is ignored and the peer is pinned by its public key
+// against trusted instead. On success the peer's ID is its verified node ID.
+func TLSHandshakeFunc(id *Identity, trusted TrustedNodes) HandshakeFunc {
+	return func(p Peer) error {
+		peer, ok := p.(*TCPPeer)
+		if !ok {
+			return fmt.Errorf("p2p: TLS handshake needs a *TCPPeer, got %T", p)
+		}
+
+		var nodeID string
+		verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			var err error
+			nodeID, err = verifyPeerCert(rawCerts, trusted)
+			return err
+		}
+
+		cfg := &tls.Config{
+			Certificates:          []tls.Certificate{id.cert},
+			MinVersion:            tls.VersionTLS13,
+			InsecureSkipVerify:    true, // replaced by verify
+			ClientAuth:            tls.RequireAnyClientCert,
+			VerifyPeerCertificate: verify,
+		}
+
+		var conn *tls.Conn
+		if peer.outbound {
+			conn = tls.Client(peer.Conn, cfg)
+		} else {
+			conn = tls.Server(peer.Conn, cfg)
+		}
+
+		conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		conn.SetDeadline(time.Time{})
+
+		peer.Conn = conn
+		peer.id = nodeID
+		return nil
+	}
+}
+
+func verifyPeerCert(rawCerts [][]byte, trusted TrustedNodes) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("p2p: peer sent no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return "", err
+	}
+
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", errors.New("p2p: peer certificate is not an Ed25519 key")
+	}
+
+	// The certificate must be signed by its own key; TLS itself proves the
+	// peer holds the private half.
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return "", errors.New("p2p: peer certificate expired or not yet valid")
+	}
+
+	nodeID := NodeIDFromKey(pub)
+	if !trusted[nodeID] && !trusted[AnyNode] {
+		return "", fmt.Errorf("%w: %s", ErrUntrustedPeer, nodeID)
+	}
+
+	return nodeID, nil
+}
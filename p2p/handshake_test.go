@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func handshakePair(t *testing.T, trustA, trustB TrustedNodes, idA, idB *Identity) (*TCPPeer, *TCPPeer, error, error) {
+	// A real socket: net.Pipe has no buffering, so a TLS alert written while
+	// the other side is still writing would deadlock.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	a, b := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- TLSHandshakeFunc(idB, trustB)(b)
+	}()
+
+	return a, b, TLSHandshakeFunc(idA, trustA)(a), <-errc
+}
+
+func TestTLSHandshake(t *testing.T) {
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	trusted := TrustedNodes{idA.NodeID(): true, idB.NodeID(): true}
+
+	a, b, errA, errB := handshakePair(t, trusted, trusted, idA, idB)
+	if errA != nil || errB != nil {
+		t.Fatalf("handshake failed: %v / %v", errA, errB)
+	}
+	if a.ID() != idB.NodeID() || b.ID() != idA.NodeID() {
+		t.Errorf("peer IDs not verified: %s / %s", a.ID(), b.ID())
+	}
+
+	if _, ok := a.Conn.(*tls.Conn); !ok {
+		t.Error("expected upgraded connection")
+	}
+}
+
+func TestTLSHandshakeRejectsUntrusted(t *testing.T) {
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	intruder, _ := NewIdentity()
+
+	trusted := TrustedNodes{idA.NodeID(): true, idB.NodeID(): true}
+
+	_, _, _, errB := handshakePair(t, TrustedNodes{AnyNode: true}, trusted, intruder, idB)
+	if !errors.Is(errB, ErrUntrustedPeer) {
+		t.Errorf("expected ErrUntrustedPeer, got %v", errB)
+	}
+
+	// Without an allowlist no peer is trusted.
+	_, _, _, errB = handshakePair(t, TrustedNodes{AnyNode: true}, nil, idA, idB)
+	if !errors.Is(errB, ErrUntrustedPeer) {
+		t.Errorf("empty allowlist: expected ErrUntrustedPeer, got %v", errB)
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+
+	id, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.NodeID() != again.NodeID() {
+		t.Error("identity not persisted")
+	}
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Identity is a node's long-term Ed25519 key pair. The node ID is the hex
+// encoded public key and is what peers pin during the handshake.
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+	cert       tls.Certificate
+}
+
+func NewIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newIdentity(priv)
+}
+
+// LoadOrCreateIdentity reads the PEM encoded private key at path, generating
+// and persisting a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return id, id.save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("p2p: no PEM block in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("p2p: %s is not an Ed25519 key", path)
+	}
+	return newIdentity(priv)
+}
+
+func newIdentity(priv ed25519.PrivateKey) (*Identity, error) {
+	cert, err := selfSignedCert(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PrivateKey: priv, cert: cert}, nil
+}
+
+func (id *Identity) save(path string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(id.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (id *Identity) NodeID() string {
+	return NodeIDFromKey(id.PrivateKey.Public().(ed25519.PublicKey))
+}
+
+func NodeIDFromKey(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// selfSignedCert wraps the identity key in a certificate for TLS. Nothing
+// but the key is ever trusted, so the certificate is regenerated on start.
+func selfSignedCert(priv ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pub := priv.Public().(ed25519.PublicKey)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: NodeIDFromKey(pub)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
@@ -1,14 +1,31 @@
 package p2p
 
-import "net"
-
+// RPC is a single decoded frame from the peer identified by From. Message
+// frames are handed to the consumer of the transport; stream frames (Stream
+// set) are routed to the multiplexed Stream identified by StreamID.
 type RPC struct {
-	From    net.Addr
-	Payload []byte
-	Stream  bool
+	From     string
+	Payload  []byte
+	Stream   bool
+	StreamID uint32
+	Flags    uint16
 }
 
 const (
 	IncomingMessage = 0x1
 	IncomingStream  = 0x2
 )
+
+// Flags carried by IncomingStream frames.
+const (
+	// FlagFIN closes the sender's half of the stream.
+	FlagFIN = 0x1
+	// FlagRST aborts the stream in both directions.
+	FlagRST = 0x2
+	// FlagWindow marks a window update; the payload is a big-endian uint32
+	// increment of the sender's receive window.
+	FlagWindow = 0x4
+	// FlagOpen announces a new stream. It is the first frame of every
+	// stream, and streams are announced in the order of their IDs.
+	FlagOpen = 0x8
+)
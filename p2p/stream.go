@@ -0,0 +1,266 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultStreamWindow is the number of bytes a sender may have in flight on
+// a single stream before the receiver grants more credit.
+const DefaultStreamWindow = 256 * 1024
+
+// maxStreamChunk bounds the payload of one data frame so that frames of
+// different streams interleave on the connection.
+const maxStreamChunk = 32 * 1024
+
+var (
+	ErrStreamReset  = errors.New("p2p: stream reset by peer")
+	ErrStreamClosed = errors.New("p2p: write on closed stream")
+	ErrPeerClosed   = errors.New("p2p: peer connection closed")
+)
+
+// Stream is one logical, flow-controlled byte stream multiplexed over a
+// TCPPeer connection. Both ends must Close (or Reset) a stream once they are
+// done with it so its slot can be released.
+type Stream struct {
+	id   uint32
+	peer *TCPPeer
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// accepted is false for remote-opened streams nobody picked up yet. Those
+	// stay registered after a reset so AcceptStream can still report it,
+	// and count towards MaxPendingStreams until then.
+	accepted bool
+
+	buf        bytes.Buffer
+	recvClosed bool
+	unacked    uint32
+
+	sendWindow uint32
+	sendClosed bool
+
+	// writeDeadline, if set, is when a Write waiting for credit gives up.
+	// deadlineTimer wakes it up then.
+	writeDeadline time.Time
+	deadlineTimer *time.Timer
+
+	err error
+}
+
+func newStream(id uint32, peer *TCPPeer) *Stream {
+	st := &Stream{
+		id:         id,
+		peer:       peer,
+		sendWindow: DefaultStreamWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+
+	for st.buf.Len() == 0 && !st.recvClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.buf.Len() == 0 {
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return 0, st.err
+		}
+		return 0, io.EOF
+	}
+
+	n, _ := st.buf.Read(b)
+
+	// Grant more credit once half of the window has been consumed.
+	st.unacked += uint32(n)
+	var credit uint32
+	if st.unacked >= DefaultStreamWindow/2 && !st.recvClosed {
+		credit, st.unacked = st.unacked, 0
+	}
+	st.mu.Unlock()
+
+	if credit > 0 {
+		inc := make([]byte, 4)
+		binary.BigEndian.PutUint32(inc, credit)
+		st.peer.writeFrame(IncomingStream, FlagWindow, st.id, inc)
+	}
+
+	return n, nil
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.sendClosed && !st.pastWriteDeadline() {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return written, st.err
+		}
+		if st.sendClosed {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			st.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+
+		n := len(b)
+		if n > maxStreamChunk {
+			n = maxStreamChunk
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.peer.writeFrame(IncomingStream, 0, st.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// SetWriteDeadline makes Write fail with os.ErrDeadlineExceeded if the
+// remote end has not granted the credit it waits for by t, for example
+// because the peer stalled. A zero t means Write waits indefinitely.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.writeDeadline = t
+	if st.deadlineTimer != nil {
+		st.deadlineTimer.Stop()
+		st.deadlineTimer = nil
+	}
+	if !t.IsZero() {
+		st.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+// pastWriteDeadline must be called with mu held.
+func (st *Stream) pastWriteDeadline() bool {
+	return !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline)
+}
+
+// Close half-closes the stream: the remote end reads io.EOF once it has
+// drained the data already sent. Reading from the stream is still possible.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.sendClosed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sendClosed = true
+	done := st.recvClosed
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	err := st.peer.writeFrame(IncomingStream, FlagFIN, st.id, nil)
+	if done {
+		st.peer.releaseStream(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions and tells the remote end.
+func (st *Stream) Reset() error {
+	if !st.fail(ErrStreamReset) {
+		return nil
+	}
+	return st.peer.writeFrame(IncomingStream, FlagRST, st.id, nil)
+}
+
+// fail terminates the stream locally with err. It reports whether the stream
+// was still alive.
+func (st *Stream) fail(err error) bool {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return false
+	}
+	st.err = err
+	accepted := st.accepted
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if accepted {
+		st.peer.releaseStream(st.id)
+	}
+	return true
+}
+
+// receive is called from the read loop for every frame addressed to the
+// stream. It never blocks on the application.
+func (st *Stream) receive(rpc RPC) {
+	switch {
+	case rpc.Flags&FlagRST != 0:
+		st.fail(ErrStreamReset)
+		return
+
+	case rpc.Flags&FlagWindow != 0:
+		if len(rpc.Payload) != 4 {
+			return
+		}
+		st.mu.Lock()
+		st.sendWindow += binary.BigEndian.Uint32(rpc.Payload)
+		st.cond.Broadcast()
+		st.mu.Unlock()
+		return
+	}
+
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+
+	if st.buf.Len()+len(rpc.Payload) > DefaultStreamWindow {
+		// The sender ignored flow control.
+		st.mu.Unlock()
+		st.Reset()
+		return
+	}
+
+	st.buf.Write(rpc.Payload)
+
+	done := false
+	if rpc.Flags&FlagFIN != 0 {
+		st.recvClosed = true
+		done = st.sendClosed
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if done {
+		st.peer.releaseStream(st.id)
+	}
+}
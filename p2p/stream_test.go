@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipePeers returns two connected peers with their read loops running.
+func pipePeers(t *testing.T) (*TCPPeer, *TCPPeer) {
+	c1, c2 := net.Pipe()
+	a, b := NewTCPPeer(c1, true), NewTCPPeer(c2, false)
+
+	for _, p := range []*TCPPeer{a, b} {
+		go func(p *TCPPeer) {
+			defer p.closeStreams()
+			for {
+				rpc := RPC{}
+				if err := (DefaultDecoder{}).Decode(p.Conn, &rpc); err != nil {
+					return
+				}
+				if rpc.Stream {
+					p.dispatch(rpc)
+				}
+			}
+		}(p)
+	}
+
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return a, b
+}
+
+func TestStreamsInterleave(t *testing.T) {
+	a, b := pipePeers(t)
+
+	// Larger than the window so flow control has to kick in.
+	payloads := [][]byte{
+		bytes.Repeat([]byte("a"), 3*DefaultStreamWindow+17),
+		bytes.Repeat([]byte("b"), DefaultStreamWindow/3),
+	}
+
+	var wg sync.WaitGroup
+	for _, payload := range payloads {
+		st, err := a.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(2)
+		go func(st *Stream, payload []byte) {
+			defer wg.Done()
+			if _, err := st.Write(payload); err != nil {
+				t.Error(err)
+			}
+			st.Close()
+		}(st, payload)
+
+		go func(id uint32, payload []byte) {
+			defer wg.Done()
+			rst, err := b.AcceptStream(id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rst.Close()
+
+			got, err := io.ReadAll(rst)
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("stream %d: got %d bytes want %d", id, len(got), len(payload))
+			}
+		}(st.ID(), payload)
+	}
+	wg.Wait()
+}
+
+func TestStreamReset(t *testing.T) {
+	a, b := pipePeers(t)
+
+	st, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rst, _ := b.AcceptStream(st.ID())
+
+	st.Reset()
+
+	if _, err := rst.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("expected ErrStreamReset, got %v", err)
+	}
+	if _, err := st.Write([]byte("x")); err != ErrStreamReset {
+		t.Errorf("expected ErrStreamReset, got %v", err)
+	}
+
+	// A reset that overtakes AcceptStream must still be observed.
+	st, _ = a.OpenStream()
+	st.Write([]byte("x"))
+	st.Reset()
+	rst, _ = b.AcceptStream(st.ID())
+	if _, err := io.ReadAll(rst); err != ErrStreamReset {
+		t.Errorf("expected ErrStreamReset, got %v", err)
+	}
+}
+
+func TestStreamWriteDeadline(t *testing.T) {
+	a, _ := pipePeers(t)
+
+	st, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the stream, so no credit beyond the window arrives.
+	st.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := st.Write(make([]byte, 2*DefaultStreamWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("got %v, want os.ErrDeadlineExceeded", err)
+	}
+	if n != DefaultStreamWindow {
+		t.Errorf("wrote %d bytes, want the window of %d", n, DefaultStreamWindow)
+	}
+}
+
+func TestStreamStaleFrames(t *testing.T) {
+	a, b := pipePeers(t)
+
+	st, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rst, err := b.AcceptStream(st.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+	if _, err := io.ReadAll(rst); err != nil {
+		t.Fatal(err)
+	}
+	rst.Close()
+
+	// Frames for the released stream arriving late do not bring it back.
+	a.writeFrame(IncomingStream, 0, st.ID(), []byte("late"))
+	a.writeFrame(IncomingStream, FlagFIN, st.ID(), nil)
+	// Nor does a frame for a stream that was never announced.
+	a.writeFrame(IncomingStream, 0, st.ID()+2, []byte("unannounced"))
+
+	// Frames are dispatched in order, so once the next stream is seen the
+	// stale ones were handled.
+	next, err := a.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Write([]byte("x"))
+	waitStream(t, b, next.ID())
+
+	b.smu.Lock()
+	defer b.smu.Unlock()
+	if len(b.streams) != 1 {
+		t.Errorf("b holds %d streams, want only the last one", len(b.streams))
+	}
+}
+
+func TestStreamPendingLimit(t *testing.T) {
+	a, b := pipePeers(t)
+
+	var streams []*Stream
+	for i := 0; i < MaxPendingStreams+1; i++ {
+		st, err := a.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, st)
+	}
+
+	// The stream over the limit is reset; the others are kept. Nobody
+	// reads it, so only the reset ends a write past the window.
+	last := streams[len(streams)-1]
+	if _, err := last.Write(make([]byte, DefaultStreamWindow+1)); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("write past the pending limit: got %v, want ErrStreamReset", err)
+	}
+	if _, err := b.AcceptStream(last.ID()); !errors.Is(err, ErrStreamReset) {
+		t.Errorf("accept past the pending limit: got %v, want ErrStreamReset", err)
+	}
+	if _, err := b.AcceptStream(streams[0].ID()); err != nil {
+		t.Errorf("accept within the limit: %v", err)
+	}
+}
+
+// waitStream waits until p has registered the remote stream id.
+func waitStream(t *testing.T, p *TCPPeer, id uint32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.smu.Lock()
+		_, ok := p.streams[id]
+		p.smu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream %d never arrived", id)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
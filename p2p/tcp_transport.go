@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 type TCPTransportOpts struct {
@@ -13,6 +14,9 @@ type TCPTransportOpts struct {
 	Decoder       Decoder
 	ShakeHands    HandshakeFunc
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once the read loop of a peer accepted by
+	// OnPeer has exited and its connection is closed.
+	OnPeerDisconnect func(Peer)
 }
 
 type TCPTransport struct {
@@ -27,30 +31,217 @@ type TCPTransport struct {
 type TCPPeer struct {
 	net.Conn
 	outbound bool
-	wg       *sync.WaitGroup
+
+	// id identifies the remote node. It is the remote address unless the
+	// handshake established a verified node ID.
+	id string
+
+	// wmu serialises frame writes so concurrent senders never interleave.
+	wmu sync.Mutex
+
+	// omu orders the announcements of new streams on the connection.
+	omu sync.Mutex
+
+	smu     sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	closed  error
+	// lastRemote is the highest ID of a stream the remote end announced.
+	// Frames for lower IDs not in streams belong to released streams.
+	lastRemote uint32
+	// pending counts the remote streams not accepted yet.
+	pending int
+
+	// done is closed when the connection has been torn down.
+	done chan struct{}
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		peers:            make(map[net.Addr]Peer),
 	}
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+	// The dialing side opens odd stream IDs and the accepting side even ones,
+	// so both ends can open streams without coordination.
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
+
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		id:       conn.RemoteAddr().String(),
+		streams:  make(map[uint32]*Stream),
+		nextID:   nextID,
+		done:     make(chan struct{}),
 	}
 }
 
+func (p *TCPPeer) ID() string {
+	return p.id
+}
+
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// Done is closed once the peer's connection is gone.
+func (p *TCPPeer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Send writes b to the peer as a single message frame.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
+	return p.writeFrame(IncomingMessage, 0, 0, b)
+}
+
+// FrameWriteTimeout bounds how long writing a frame to the connection may
+// take. A peer that does not read for that long is disconnected, so that it
+// cannot block the writers of every other stream.
+const FrameWriteTimeout = 30 * time.Second
+
+func (p *TCPPeer) writeFrame(typ uint8, flags uint16, streamID uint32, payload []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	p.Conn.SetWriteDeadline(time.Now().Add(FrameWriteTimeout))
+	err := WriteFrame(p.Conn, typ, flags, streamID, payload)
+	if err != nil {
+		// A partly written frame leaves the connection unusable.
+		p.Conn.Close()
+	}
 	return err
 }
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+
+// MaxPendingStreams bounds the streams a remote end may open on a connection
+// that were not accepted yet, as each may buffer up to a window. Streams
+// beyond it are reset.
+const MaxPendingStreams = 64
+
+// OpenStream allocates a new stream and announces it to the remote end. Its
+// ID is usually sent to the remote end inside a message so that it can pick
+// the stream up with AcceptStream.
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	p.omu.Lock()
+	defer p.omu.Unlock()
+
+	p.smu.Lock()
+	if p.closed != nil {
+		p.smu.Unlock()
+		return nil, p.closed
+	}
+
+	id := p.nextID
+	p.nextID += 2
+
+	st := newStream(id, p)
+	st.accepted = true
+	p.streams[id] = st
+	p.smu.Unlock()
+
+	if err := p.writeFrame(IncomingStream, FlagOpen, id, nil); err != nil {
+		p.releaseStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream returns the stream the remote end opened with the given ID.
+// Frames that arrived before the call are buffered in the stream. A stream
+// that was announced but is gone, because it was reset when too many were
+// pending or already released, fails with ErrStreamReset.
+func (p *TCPPeer) AcceptStream(id uint32) (*Stream, error) {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+
+	if p.closed != nil {
+		return nil, p.closed
+	}
+
+	st, ok := p.streams[id]
+	switch {
+	case ok && !st.accepted:
+		p.pending--
+	case !ok && (p.isLocalStream(id) || id <= p.lastRemote):
+		return nil, ErrStreamReset
+	case !ok:
+		// Accepted before its announcement arrived.
+		st = newStream(id, p)
+		p.streams[id] = st
+	}
+
+	st.mu.Lock()
+	st.accepted = true
+	failed := st.err != nil
+	st.mu.Unlock()
+
+	if failed {
+		// Reset before it was accepted; hand out the tombstone once.
+		delete(p.streams, id)
+	}
+	return st, nil
+}
+
+func (p *TCPPeer) isLocalStream(id uint32) bool {
+	return (id%2 == 1) == p.outbound
+}
+
+func (p *TCPPeer) releaseStream(id uint32) {
+	p.smu.Lock()
+	defer p.smu.Unlock()
+	delete(p.streams, id)
+}
+
+// dispatch routes a stream frame from the read loop to its stream.
+func (p *TCPPeer) dispatch(rpc RPC) {
+	id := rpc.StreamID
+
+	p.smu.Lock()
+	st, ok := p.streams[id]
+	if !ok {
+		// Frames for streams we opened and already released are stale, as
+		// are frames for remote streams announced before and released,
+		// and window updates. Only an announcement opens a stream.
+		if p.isLocalStream(id) || id <= p.lastRemote || rpc.Flags&FlagOpen == 0 {
+			p.smu.Unlock()
+			return
+		}
+		p.lastRemote = id
+
+		if p.pending >= MaxPendingStreams {
+			p.smu.Unlock()
+			p.writeFrame(IncomingStream, FlagRST, id, nil)
+			return
+		}
+		st = newStream(id, p)
+		p.streams[id] = st
+		p.pending++
+	} else if id > p.lastRemote && !p.isLocalStream(id) {
+		p.lastRemote = id
+	}
+	p.smu.Unlock()
+
+	st.receive(rpc)
+}
+
+// closeStreams fails every open stream once the connection is gone.
+func (p *TCPPeer) closeStreams() {
+	p.smu.Lock()
+	p.closed = ErrPeerClosed
+	streams := make([]*Stream, 0, len(p.streams))
+	for _, st := range p.streams {
+		streams = append(streams, st)
+	}
+	p.smu.Unlock()
+
+	for _, st := range streams {
+		st.fail(ErrPeerClosed)
+	}
 }
 
 func (t *TCPTransport) Consume() <-chan RPC {
@@ -61,22 +252,30 @@ func (t *TCPTransport) Addr() string {
 	return t.TCPTransportOpts.ListenAddress
 }
 func (t *TCPTransport) Close() error {
+	t.mu.RLock()
+	for _, peer := range t.peers {
+		peer.Close()
+	}
+	t.mu.RUnlock()
+
 	return t.listener.Close()
 }
 
-func (t *TCPTransport) Dial(addr string) error {
-
-	if len(addr) == 0 {
-		return nil
+// Dial connects to addr and returns the peer once the handshake succeeded
+// and OnPeer accepted it. Errors from OnPeer are returned unchanged.
+func (t *TCPTransport) Dial(addr string) (Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, HandshakeTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	peer, err := t.setupConn(conn, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	go t.handleConn(conn, true)
-	return nil
+	go t.readLoop(peer)
+	return peer, nil
 }
 
 func (t *TCPTransport) ListenAndAccept() {
@@ -98,47 +297,77 @@ func (t *TCPTransport) ListenAndAccept() {
 func (t *TCPTransport) startAcceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			fmt.Printf("TCP eccept error: %s \n", err)
+			continue
 		}
-		go t.handleConn(conn, false)
+		go t.handleConn(conn)
 	}
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+func (t *TCPTransport) handleConn(conn net.Conn) {
+	peer, err := t.setupConn(conn, false)
+	if err != nil {
+		fmt.Printf("Dropping the peer connection: %v\n", err)
+		return
+	}
 
-	defer func() {
-		fmt.Printf("Dropping the peer connection: %v", err)
-		conn.Close()
-	}()
+	t.readLoop(peer)
+}
+
+// setupConn runs the handshake and hands the peer to OnPeer. The connection
+// is closed if either step fails.
+func (t *TCPTransport) setupConn(conn net.Conn, outbound bool) (*TCPPeer, error) {
 	peer := NewTCPPeer(conn, outbound)
 
 	if err := t.TCPTransportOpts.ShakeHands(peer); err != nil {
 		conn.Close()
-		return
+		return nil, err
 	}
 
-	if err = t.TCPTransportOpts.OnPeer(peer); err != nil {
-		return
+	if err := t.TCPTransportOpts.OnPeer(peer); err != nil {
+		peer.Close()
+		return nil, err
 	}
 
-	//read loop
+	t.mu.Lock()
+	t.peers[conn.RemoteAddr()] = peer
+	t.mu.Unlock()
+
+	return peer, nil
+}
+
+func (t *TCPTransport) readLoop(peer *TCPPeer) {
+	var err error
+
+	defer func() {
+		fmt.Printf("Dropping the peer connection %s: %v\n", peer.ID(), err)
+		peer.Close()
+		peer.closeStreams()
+
+		t.mu.Lock()
+		delete(t.peers, peer.RemoteAddr())
+		t.mu.Unlock()
+
+		if t.TCPTransportOpts.OnPeerDisconnect != nil {
+			t.TCPTransportOpts.OnPeerDisconnect(peer)
+		}
+		close(peer.done)
+	}()
 
 	for {
 		rpc := RPC{}
-		err = t.TCPTransportOpts.Decoder.Decode(conn, &rpc)
+		err = t.TCPTransportOpts.Decoder.Decode(peer.Conn, &rpc)
 		if err != nil {
-			fmt.Println("error after decode : ", err)
 			return
 		}
-		rpc.From = conn.RemoteAddr()
+		rpc.From = peer.ID()
 
 		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, Waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+			peer.dispatch(rpc)
 			continue
 		}
 
@@ -4,8 +4,12 @@ import "net"
 
 type Peer interface {
 	net.Conn
+	ID() string
+	Outbound() bool
+	Done() <-chan struct{}
 	Send([]byte) error
-	CloseStream()
+	OpenStream() (*Stream, error)
+	AcceptStream(uint32) (*Stream, error)
 }
 
 type Transport interface {
@@ -13,5 +17,5 @@ type Transport interface {
 	ListenAndAccept()
 	Consume() <-chan RPC
 	Close() error
-	Dial(string) error
+	Dial(string) (Peer, error)
 }
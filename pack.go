@@ -0,0 +1,1084 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A PackStore appends objects to a few large segment files instead of
+// creating a file and a directory tree per key. Every write appends a record
+// to the active segment:
+//
+//	crc (4) | value crc (4) | kind (1) | seq (8) | key len (4) | meta len (4) | value len (8) | key | meta | value
+//
+// The crc covers the rest of the header, the key and the JSON metadata. Once
+// the active segment reaches MaxSegmentSize it is sealed with a footer that
+// lists its records, so the index of a sealed segment is read without
+// scanning it. On Close the records of the active segment are saved to a hint
+// file; after a crash only the records appended since are scanned.
+//
+// The record with the highest sequence number wins, whatever segment it is
+// in. That lets compaction move live records to new segments and drop the
+// rest. Before it removes the old segments it lists them in the compacted
+// file, so that a crash or a failed removal cannot leave some of them behind:
+// the next start removes them before the index is read.
+
+const (
+	segmentSuffix = ".seg"
+	hintSuffix    = ".hint"
+	// compactedFile lists the segments a compaction replaced.
+	compactedFile = "compacted"
+
+	packHeaderSize = 33
+	// A footer ends with: footer length (8) | footer crc (4) | packMagic (8).
+	packTrailerSize = 20
+	packMagic       = "DFSPACK1"
+)
+
+const (
+	// DefaultMaxSegmentSize is the size at which the active segment is
+	// sealed when PackStoreOpts.MaxSegmentSize is not set.
+	DefaultMaxSegmentSize = 64 << 20
+	// DefaultCompactRatio is the share of dead bytes in the sealed segments
+	// above which they are compacted when PackStoreOpts.CompactRatio is not
+	// set.
+	DefaultCompactRatio = 0.5
+	// DefaultCompactInterval is how often the dead bytes are checked when
+	// PackStoreOpts.CompactInterval is not set.
+	DefaultCompactInterval = 5 * time.Minute
+)
+
+const (
+	// recordPut stores an object and its metadata.
+	recordPut byte = iota + 1
+	// recordMeta stores metadata without an object, such as a tombstone. If
+	// the key holds an object, only its metadata is replaced.
+	recordMeta
+	// recordDelete removes the object and metadata of a key.
+	recordDelete
+)
+
+// packSpoolLimit is how much of an object is buffered in memory before the
+// rest is spooled to a temp file. Objects are only appended once they are
+// complete, so a slow writer does not hold up the others.
+const packSpoolLimit = 1 << 20
+
+var ErrPackStoreClosed = errors.New("pack store is closed")
+
+type PackStoreOpts struct {
+	Root           string
+	MaxSegmentSize int64
+	CompactRatio   float64
+	// CompactInterval is how often compaction runs if enough of the sealed
+	// segments is dead. A negative interval disables it; Compact can still
+	// be called.
+	CompactInterval time.Duration
+}
+
+// packRecord locates a record in its segment. Footers and hint files hold
+// the records of a segment.
+type packRecord struct {
+	Key         string
+	Kind        byte
+	Seq         uint64
+	Offset      int64
+	Length      int64
+	ValueOffset int64
+	ValueLen    int64
+	ValueCRC    uint32
+	Meta        Meta
+}
+
+// packIndexFile is the content of a footer or hint file: the records in the
+// first Size bytes of a segment.
+type packIndexFile struct {
+	Size    int64
+	Records []packRecord
+}
+
+type packSegment struct {
+	id uint32
+	// size counts the bytes of records, dead the ones that were overwritten
+	// or deleted since.
+	size int64
+	dead int64
+
+	// Only the active segment is kept open and remembers its records, for
+	// its footer and hint file.
+	f       *os.File
+	records []packRecord
+}
+
+type packEntry struct {
+	seg uint32
+	packRecord
+	// update is the recordMeta record that replaced the metadata of a put,
+	// which Meta holds.
+	update *packEntry
+}
+
+type PackStore struct {
+	PackStoreOpts
+
+	// writeMu serializes appends; mu protects the index and segments.
+	writeMu   sync.Mutex
+	compactMu sync.Mutex
+	mu        sync.RWMutex
+
+	index map[string]packEntry
+	// sorted holds the keys of index in order from the first List on, kept
+	// so as they change.
+	sorted   sortedKeys
+	segments map[uint32]*packSegment
+	active   *packSegment
+	nextID   uint32
+	seq      uint64
+	closed   bool
+
+	quitCh chan struct{}
+}
+
+// OpenPackStore opens the segments under opts.Root, rebuilding the index
+// from their footers and hint files, and creating the root if needed.
+func OpenPackStore(opts *PackStoreOpts) (*PackStore, error) {
+	if opts.MaxSegmentSize <= 0 {
+		opts.MaxSegmentSize = DefaultMaxSegmentSize
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = DefaultCompactRatio
+	}
+	if opts.CompactInterval == 0 {
+		opts.CompactInterval = DefaultCompactInterval
+	}
+
+	p := &PackStore{
+		PackStoreOpts: *opts,
+		index:         make(map[string]packEntry),
+		segments:      make(map[uint32]*packSegment),
+		quitCh:        make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(p.Root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	if p.CompactInterval > 0 {
+		go p.compactLoop()
+	}
+	return p, nil
+}
+
+func (p *PackStore) segmentPath(id uint32) string {
+	return filepath.Join(p.Root, fmt.Sprintf("%08d%s", id, segmentSuffix))
+}
+
+func (p *PackStore) hintPath(id uint32) string {
+	return filepath.Join(p.Root, fmt.Sprintf("%08d%s", id, hintSuffix))
+}
+
+// load reads the index of every segment and replays the records in sequence
+// order. Of the segments that were never sealed, the newest stays the active
+// one and the others are sealed.
+func (p *PackStore) load() error {
+	obsolete, err := p.removeCompacted()
+	if err != nil {
+		return err
+	}
+	for id := range obsolete {
+		if id >= p.nextID {
+			p.nextID = id + 1
+		}
+	}
+
+	entries, err := os.ReadDir(p.Root)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint32
+	for _, e := range entries {
+		name := e.Name()
+		if strings.Contains(name, tempMarker) {
+			// Unfinished compaction output, hint or spooled object.
+			os.Remove(filepath.Join(p.Root, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 32)
+		if err != nil || obsolete[uint32(id)] {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var (
+		all      []packEntry
+		unsealed []*packSegment
+	)
+	for _, id := range ids {
+		seg, sealed, err := p.loadSegment(id)
+		if err != nil {
+			return err
+		}
+		p.segments[id] = seg
+		for _, rec := range seg.records {
+			all = append(all, packEntry{seg: id, packRecord: rec})
+		}
+		if !sealed {
+			unsealed = append(unsealed, seg)
+		} else {
+			seg.records = nil
+		}
+		if id >= p.nextID {
+			p.nextID = id + 1
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Seq < all[j].Seq })
+	for _, e := range all {
+		p.apply(e.seg, e.packRecord)
+		if e.Seq > p.seq {
+			p.seq = e.Seq
+		}
+	}
+
+	for i, seg := range unsealed {
+		if i == len(unsealed)-1 {
+			p.active = seg
+			break
+		}
+		if err := p.seal(seg); err != nil {
+			return err
+		}
+	}
+	if p.active == nil {
+		return p.newActive()
+	}
+	return nil
+}
+
+// compactedSegments returns the segments listed in the compacted file.
+func (p *PackStore) compactedSegments() (map[uint32]bool, error) {
+	b, err := os.ReadFile(filepath.Join(p.Root, compactedFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, fmt.Errorf("%s: %w", compactedFile, err)
+	}
+	obsolete := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		obsolete[id] = true
+	}
+	return obsolete, nil
+}
+
+// markCompacted lists obsolete in the compacted file, along with the
+// segments it listed already.
+func (p *PackStore) markCompacted(obsolete map[uint32]bool) error {
+	listed, err := p.compactedSegments()
+	if err != nil {
+		return err
+	}
+
+	var ids []uint32
+	for id := range listed {
+		ids = append(ids, id)
+	}
+	for id := range obsolete {
+		if !listed[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(filepath.Join(p.Root, compactedFile), func(w io.Writer) (int64, error) {
+		n, err := w.Write(b)
+		return int64(n), err
+	})
+	return err
+}
+
+// removeCompacted removes the segments listed in the compacted file, and
+// the file once they are gone. It returns the segments it listed, which
+// must not be read even if removing them failed.
+func (p *PackStore) removeCompacted() (map[uint32]bool, error) {
+	obsolete, err := p.compactedSegments()
+	if err != nil || obsolete == nil {
+		return obsolete, err
+	}
+
+	var failed error
+	for id := range obsolete {
+		for _, path := range []string{p.segmentPath(id), p.hintPath(id)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		log.Printf("removing compacted segments: %v\n", failed)
+		return obsolete, nil
+	}
+
+	if err := syncDir(p.Root); err != nil {
+		return obsolete, err
+	}
+	if err := os.Remove(filepath.Join(p.Root, compactedFile)); err != nil {
+		return obsolete, err
+	}
+	return obsolete, syncDir(p.Root)
+}
+
+// loadSegment reads the records of segment id from its footer. A segment
+// without one is opened for appending: its records come from its hint file
+// and a scan of what was written after it, and a torn record at the end is
+// cut off.
+func (p *PackStore) loadSegment(id uint32) (*packSegment, bool, error) {
+	path := p.segmentPath(id)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+
+	if idx, ok := readFooter(f, fi.Size()); ok {
+		f.Close()
+		return &packSegment{id: id, size: idx.Size, records: idx.Records}, true, nil
+	}
+
+	var idx packIndexFile
+	if b, err := os.ReadFile(p.hintPath(id)); err == nil {
+		if err := json.Unmarshal(b, &idx); err != nil || idx.Size > fi.Size() {
+			idx = packIndexFile{}
+		}
+	}
+
+	records, end := scanRecords(f, idx.Size, fi.Size())
+	if end < fi.Size() {
+		log.Printf("truncating torn record at %d in %s\n", end, path)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return nil, false, err
+		}
+	}
+
+	return &packSegment{id: id, size: end, f: f, records: append(idx.Records, records...)}, false, nil
+}
+
+// readFooter returns the index in the footer of a sealed segment of size
+// bytes.
+func readFooter(r io.ReaderAt, size int64) (packIndexFile, bool) {
+	var idx packIndexFile
+
+	if size < packTrailerSize {
+		return idx, false
+	}
+	trailer := make([]byte, packTrailerSize)
+	if _, err := r.ReadAt(trailer, size-packTrailerSize); err != nil {
+		return idx, false
+	}
+	if string(trailer[12:]) != packMagic {
+		return idx, false
+	}
+
+	n := int64(binary.BigEndian.Uint64(trailer[0:8]))
+	if n < 0 || n > size-packTrailerSize {
+		return idx, false
+	}
+	footer := make([]byte, n)
+	if _, err := r.ReadAt(footer, size-packTrailerSize-n); err != nil {
+		return idx, false
+	}
+	if crc32.ChecksumIEEE(footer) != binary.BigEndian.Uint32(trailer[8:12]) {
+		return idx, false
+	}
+	if err := json.Unmarshal(footer, &idx); err != nil || idx.Size != size-packTrailerSize-n {
+		return idx, false
+	}
+	return idx, true
+}
+
+// scanRecords reads the records between off and size and returns them with
+// the offset after the last intact one.
+func scanRecords(r io.ReaderAt, off, size int64) ([]packRecord, int64) {
+	var records []packRecord
+
+	header := make([]byte, packHeaderSize)
+	for off+packHeaderSize <= size {
+		if _, err := r.ReadAt(header, off); err != nil {
+			break
+		}
+
+		keyLen := int64(binary.BigEndian.Uint32(header[17:21]))
+		metaLen := int64(binary.BigEndian.Uint32(header[21:25]))
+		valueLen := int64(binary.BigEndian.Uint64(header[25:33]))
+		if valueLen < 0 || keyLen+metaLen > size-off-packHeaderSize || valueLen > size-off-packHeaderSize-keyLen-metaLen {
+			break
+		}
+
+		head := make([]byte, packHeaderSize+keyLen+metaLen)
+		if _, err := r.ReadAt(head, off); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(head[4:]) != binary.BigEndian.Uint32(head[0:4]) {
+			break
+		}
+
+		rec := packRecord{
+			Key:         string(head[packHeaderSize : packHeaderSize+keyLen]),
+			Kind:        head[8],
+			Seq:         binary.BigEndian.Uint64(head[9:17]),
+			Offset:      off,
+			Length:      int64(len(head)) + valueLen,
+			ValueOffset: off + int64(len(head)),
+			ValueLen:    valueLen,
+			ValueCRC:    binary.BigEndian.Uint32(head[4:8]),
+		}
+		if metaLen > 0 {
+			if err := json.Unmarshal(head[packHeaderSize+keyLen:], &rec.Meta); err != nil {
+				break
+			}
+		}
+
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(h, io.NewSectionReader(r, rec.ValueOffset, valueLen)); err != nil || h.Sum32() != rec.ValueCRC {
+			break
+		}
+
+		records = append(records, rec)
+		off += rec.Length
+	}
+
+	return records, off
+}
+
+// apply puts rec from segment seg into the index and accounts for the bytes
+// it makes dead. The caller must hold mu or be loading.
+func (p *PackStore) apply(seg uint32, rec packRecord) {
+	old, ok := p.index[rec.Key]
+	if ok && old.Kind == recordPut && rec.Kind == recordMeta {
+		if old.update != nil {
+			p.segments[old.update.seg].dead += old.update.Length
+		}
+		old.Meta = rec.Meta
+		old.update = &packEntry{seg: seg, packRecord: rec}
+		p.index[rec.Key] = old
+		return
+	}
+
+	if ok {
+		p.markDead(old)
+	} else if p.sorted != nil {
+		p.sorted.add(rec.Key)
+	}
+
+	if rec.Kind == recordDelete {
+		delete(p.index, rec.Key)
+		if p.sorted != nil {
+			p.sorted.remove(rec.Key)
+		}
+		p.segments[seg].dead += rec.Length
+		return
+	}
+	p.index[rec.Key] = packEntry{seg: seg, packRecord: rec}
+}
+
+// markDead accounts for the records of e, which a newer record replaced.
+func (p *PackStore) markDead(e packEntry) {
+	p.segments[e.seg].dead += e.Length
+	if e.update != nil {
+		p.segments[e.update.seg].dead += e.update.Length
+	}
+}
+
+// newActive starts a new active segment. The caller must hold writeMu or be
+// loading.
+func (p *PackStore) newActive() error {
+	p.mu.Lock()
+	id := p.nextID
+	p.nextID++
+	p.mu.Unlock()
+
+	f, err := os.OpenFile(p.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(p.Root); err != nil {
+		f.Close()
+		return err
+	}
+
+	seg := &packSegment{id: id, f: f}
+
+	p.mu.Lock()
+	p.segments[id] = seg
+	p.active = seg
+	p.mu.Unlock()
+	return nil
+}
+
+// seal writes the footer of seg and closes it. Its hint file is no longer
+// needed.
+func (p *PackStore) seal(seg *packSegment) error {
+	footer, err := encodeFooter(seg.size, seg.records)
+	if err != nil {
+		return err
+	}
+	if _, err := seg.f.WriteAt(footer, seg.size); err != nil {
+		return err
+	}
+	if err := seg.f.Sync(); err != nil {
+		return err
+	}
+	if err := seg.f.Close(); err != nil {
+		return err
+	}
+
+	seg.f, seg.records = nil, nil
+	os.Remove(p.hintPath(seg.id))
+	return nil
+}
+
+func encodeFooter(size int64, records []packRecord) ([]byte, error) {
+	b, err := json.Marshal(packIndexFile{Size: size, Records: records})
+	if err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, packTrailerSize)
+	binary.BigEndian.PutUint64(trailer[0:8], uint64(len(b)))
+	binary.BigEndian.PutUint32(trailer[8:12], crc32.ChecksumIEEE(b))
+	copy(trailer[12:], packMagic)
+
+	return append(b, trailer...), nil
+}
+
+func encodeRecordHead(kind byte, seq uint64, key string, meta []byte, valueLen int64, valueCRC uint32) []byte {
+	head := make([]byte, packHeaderSize+len(key)+len(meta))
+	binary.BigEndian.PutUint32(head[4:8], valueCRC)
+	head[8] = kind
+	binary.BigEndian.PutUint64(head[9:17], seq)
+	binary.BigEndian.PutUint32(head[17:21], uint32(len(key)))
+	binary.BigEndian.PutUint32(head[21:25], uint32(len(meta)))
+	binary.BigEndian.PutUint64(head[25:33], uint64(valueLen))
+	copy(head[packHeaderSize:], key)
+	copy(head[packHeaderSize+len(key):], meta)
+	binary.BigEndian.PutUint32(head[0:4], crc32.ChecksumIEEE(head[4:]))
+	return head
+}
+
+// appendRecord appends a record to the active segment, syncs it and puts it
+// into the index. The caller must hold writeMu.
+func (p *PackStore) appendRecord(kind byte, key string, meta Meta, value io.Reader, valueLen int64, valueCRC uint32) error {
+	if p.closed {
+		return ErrPackStoreClosed
+	}
+	if p.active.size >= p.MaxSegmentSize {
+		if err := p.seal(p.active); err != nil {
+			return err
+		}
+		if err := p.newActive(); err != nil {
+			return err
+		}
+	}
+
+	var metaJSON []byte
+	if kind != recordDelete {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		metaJSON = b
+	}
+
+	seg := p.active
+	p.seq++
+	head := encodeRecordHead(kind, p.seq, key, metaJSON, valueLen, valueCRC)
+	rec := packRecord{
+		Key:         key,
+		Kind:        kind,
+		Seq:         p.seq,
+		Offset:      seg.size,
+		Length:      int64(len(head)) + valueLen,
+		ValueOffset: seg.size + int64(len(head)),
+		ValueLen:    valueLen,
+		ValueCRC:    valueCRC,
+		Meta:        meta,
+	}
+
+	_, err := seg.f.WriteAt(head, rec.Offset)
+	if err == nil && value != nil {
+		var n int64
+		n, err = io.Copy(io.NewOffsetWriter(seg.f, rec.ValueOffset), value)
+		if err == nil && n != valueLen {
+			err = fmt.Errorf("short value for (%s): got %d of %d bytes", key, n, valueLen)
+		}
+	}
+	if err == nil {
+		err = seg.f.Sync()
+	}
+	if err != nil {
+		seg.f.Truncate(rec.Offset)
+		return err
+	}
+
+	seg.records = append(seg.records, rec)
+
+	p.mu.Lock()
+	seg.size += rec.Length
+	p.apply(seg.id, rec)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *PackStore) entry(key string) (packEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e, ok := p.index[key]
+	return e, ok
+}
+
+func (p *PackStore) Has(key string) bool {
+	e, ok := p.entry(key)
+	return ok && e.Kind == recordPut
+}
+
+func (p *PackStore) Read(key string) (int64, io.ReadCloser, error) {
+	// Compaction removes segments while holding mu, so the segment is
+	// opened before it is released.
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e, ok := p.index[key]
+	if !ok || e.Kind != recordPut {
+		return 0, nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+
+	f, err := os.Open(p.segmentPath(e.seg))
+	if err != nil {
+		return 0, nil, err
+	}
+	return e.ValueLen, &sectionFile{SectionReader: io.NewSectionReader(f, e.ValueOffset, e.ValueLen), f: f}, nil
+}
+
+// sectionFile reads a section of a file and closes the file.
+type sectionFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s *sectionFile) Close() error {
+	return s.f.Close()
+}
+
+func (p *PackStore) Write(key string, r io.Reader) (int64, error) {
+	meta, err := p.WriteWithMeta(key, r, Meta{})
+	return meta.Size, err
+}
+
+func (p *PackStore) WriteWithMeta(key string, r io.Reader, meta Meta) (Meta, error) {
+	sp := &spool{dir: p.Root}
+	defer sp.Close()
+
+	stored := newHashWriter(sp)
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(io.MultiWriter(stored, crc), r); err != nil {
+		return Meta{}, err
+	}
+	if meta.Checksum != "" && stored.Sum() != meta.Checksum {
+		return Meta{}, ErrChecksumMismatch
+	}
+
+	value, err := sp.Reader()
+	if err != nil {
+		return Meta{}, err
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	prev, _ := p.entry(key)
+	meta = completeMeta(key, meta, prev.Meta, stored.n, stored.Sum())
+
+	if err := p.appendRecord(recordPut, key, meta, value, stored.n, crc.Sum32()); err != nil {
+		return Meta{}, err
+	}
+	return meta, nil
+}
+
+// WriteMeta replaces the metadata of key. An existing object stays where it
+// is.
+func (p *PackStore) WriteMeta(key string, meta Meta) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	return p.appendRecord(recordMeta, key, meta, nil, 0, 0)
+}
+
+func (p *PackStore) Delete(key string) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if _, ok := p.entry(key); !ok {
+		return nil
+	}
+	return p.appendRecord(recordDelete, key, Meta{}, nil, 0, 0)
+}
+
+func (p *PackStore) Stat(key string) (Meta, error) {
+	e, ok := p.entry(key)
+	if !ok {
+		return Meta{}, &fs.PathError{Op: "stat", Path: key, Err: fs.ErrNotExist}
+	}
+	return e.Meta, nil
+}
+
+func (p *PackStore) List(prefix, cursor string, limit int) ([]Meta, string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sorted == nil {
+		p.sorted = make(sortedKeys, 0, len(p.index))
+		for key := range p.index {
+			p.sorted = append(p.sorted, key)
+		}
+		sort.Strings(p.sorted)
+	}
+
+	metas, next := listPage(keysAfter(p.sorted, prefix, cursor), prefix, limit, func(key string) (Meta, bool) {
+		return p.index[key].Meta, true
+	})
+	return metas, next, nil
+}
+
+// Close stops compaction and saves the records of the active segment to its
+// hint file, so the next start does not have to scan it.
+func (p *PackStore) Close() error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.quitCh)
+
+	seg := p.active
+	b, err := json.Marshal(packIndexFile{Size: seg.size, Records: seg.records})
+	if err == nil {
+		_, err = writeFileAtomic(p.hintPath(seg.id), func(w io.Writer) (int64, error) {
+			n, err := w.Write(b)
+			return int64(n), err
+		})
+	}
+	if cerr := seg.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *PackStore) compactLoop() {
+	for {
+		select {
+		case <-time.After(p.CompactInterval):
+		case <-p.quitCh:
+			return
+		}
+
+		if p.garbage() < p.CompactRatio {
+			continue
+		}
+		if err := p.Compact(); err != nil {
+			log.Printf("compacting %s: %v\n", p.Root, err)
+		}
+	}
+}
+
+// garbage returns the share of dead bytes in the sealed segments.
+func (p *PackStore) garbage() float64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var size, dead int64
+	for id, seg := range p.segments {
+		if id != p.active.id {
+			size += seg.size
+			dead += seg.dead
+		}
+	}
+	if size == 0 {
+		return 0
+	}
+	return float64(dead) / float64(size)
+}
+
+// packMove is a live record copied by compaction.
+type packMove struct {
+	from, to packEntry
+}
+
+// Compact copies the live records of all sealed segments to new segments and
+// removes the old ones. Delete records are dropped: every record they shadow
+// is in a sealed segment as well, so it is dropped too, once the new
+// segments are durable and the old ones are listed in the compacted file. A
+// put whose metadata was replaced is copied with the new metadata.
+func (p *PackStore) Compact() error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+
+	p.writeMu.Lock()
+	closed := p.closed
+	p.writeMu.Unlock()
+	if closed {
+		return ErrPackStoreClosed
+	}
+
+	p.mu.RLock()
+	sealed := make(map[uint32]bool)
+	for id := range p.segments {
+		if id != p.active.id {
+			sealed[id] = true
+		}
+	}
+	var live []packEntry
+	for _, e := range p.index {
+		if sealed[e.seg] {
+			live = append(live, e)
+		}
+	}
+	p.mu.RUnlock()
+
+	if len(sealed) == 0 {
+		return nil
+	}
+
+	// Read the old segments front to back.
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].seg != live[j].seg {
+			return live[i].seg < live[j].seg
+		}
+		return live[i].Offset < live[j].Offset
+	})
+
+	var (
+		moves   []packMove
+		written []*packSegment
+	)
+	for len(live) > 0 {
+		seg, n, err := p.writeCompacted(live, sealed, &moves)
+		if err != nil {
+			p.removeSegments(written)
+			return err
+		}
+		written = append(written, seg)
+		live = live[n:]
+	}
+	if err := p.markCompacted(sealed); err != nil {
+		p.removeSegments(written)
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, seg := range written {
+		p.segments[seg.id] = seg
+	}
+	for _, m := range moves {
+		cur, ok := p.index[m.from.Key]
+		switch {
+		case ok && cur.seg == m.from.seg && cur.Offset == m.from.Offset && cur.update == m.from.update:
+			p.index[m.from.Key] = m.to
+		case ok && cur.seg == m.from.seg && cur.Offset == m.from.Offset:
+			// Its metadata was replaced while it was copied; the newer
+			// record stays where it is.
+			to := m.to
+			to.Meta, to.update = cur.Meta, cur.update
+			p.index[m.from.Key] = to
+		default:
+			// Written again while it was copied; the copy is dead.
+			p.segments[m.to.seg].dead += m.to.Length
+		}
+	}
+	for id := range sealed {
+		delete(p.segments, id)
+	}
+
+	fmt.Printf("Compacted %d segments of %s into %d\n", len(sealed), p.Root, len(written))
+	_, err := p.removeCompacted()
+	return err
+}
+
+// removeSegments removes segments that compaction wrote but did not use.
+func (p *PackStore) removeSegments(segs []*packSegment) {
+	for _, seg := range segs {
+		os.Remove(p.segmentPath(seg.id))
+	}
+}
+
+// writeCompacted copies records from the front of live to a new sealed
+// segment until it reaches MaxSegmentSize. It returns the segment and how
+// many records it took, and adds them to moves. A put whose metadata was
+// replaced in one of the sealed segments is written as a new put, with the
+// sequence number of the replacement.
+func (p *PackStore) writeCompacted(live []packEntry, sealed map[uint32]bool, moves *[]packMove) (*packSegment, int, error) {
+	p.mu.Lock()
+	seg := &packSegment{id: p.nextID}
+	p.nextID++
+	p.mu.Unlock()
+
+	var (
+		records []packRecord
+		taken   int
+	)
+	_, err := writeFileAtomic(p.segmentPath(seg.id), func(w io.Writer) (int64, error) {
+		var (
+			src   *os.File
+			srcID uint32
+		)
+		defer func() {
+			if src != nil {
+				src.Close()
+			}
+		}()
+
+		for _, e := range live {
+			if taken > 0 && seg.size+e.Length > p.MaxSegmentSize {
+				break
+			}
+			if src == nil || srcID != e.seg {
+				if src != nil {
+					src.Close()
+				}
+				f, err := os.Open(p.segmentPath(e.seg))
+				if err != nil {
+					return seg.size, err
+				}
+				src, srcID = f, e.seg
+			}
+
+			rec, update := e.packRecord, e.update
+			if update != nil && sealed[update.seg] {
+				meta, err := json.Marshal(e.Meta)
+				if err != nil {
+					return seg.size, err
+				}
+				head := encodeRecordHead(recordPut, update.Seq, e.Key, meta, e.ValueLen, e.ValueCRC)
+				if _, err := w.Write(head); err != nil {
+					return seg.size, err
+				}
+				if _, err := io.Copy(w, io.NewSectionReader(src, e.ValueOffset, e.ValueLen)); err != nil {
+					return seg.size, err
+				}
+				rec.Seq, rec.Length = update.Seq, int64(len(head))+e.ValueLen
+				rec.ValueOffset = seg.size + int64(len(head))
+				update = nil
+			} else {
+				if _, err := io.Copy(w, io.NewSectionReader(src, e.Offset, e.Length)); err != nil {
+					return seg.size, err
+				}
+				rec.ValueOffset = seg.size + (e.ValueOffset - e.Offset)
+			}
+			rec.Offset = seg.size
+
+			records = append(records, rec)
+			*moves = append(*moves, packMove{from: e, to: packEntry{seg: seg.id, packRecord: rec, update: update}})
+			seg.size += rec.Length
+			taken++
+		}
+
+		footer, err := encodeFooter(seg.size, records)
+		if err != nil {
+			return seg.size, err
+		}
+		n, err := w.Write(footer)
+		return seg.size + int64(n), err
+	})
+	if err != nil {
+		*moves = (*moves)[:len(*moves)-len(records)]
+		return nil, 0, err
+	}
+
+	return seg, taken, nil
+}
+
+// spool holds an object until it is complete, in memory up to
+// packSpoolLimit and in a temp file beyond.
+type spool struct {
+	dir string
+	buf bytes.Buffer
+	f   *os.File
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.f == nil && s.buf.Len()+len(b) > packSpoolLimit {
+		f, err := os.CreateTemp(s.dir, "spool"+tempMarker+"*")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	if s.f != nil {
+		return s.f.Write(b)
+	}
+	return s.buf.Write(b)
+}
+
+// Reader returns what was written to the spool.
+func (s *spool) Reader() (io.Reader, error) {
+	if s.f == nil {
+		return &s.buf, nil
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	return s.f, err
+}
+
+func (s *spool) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	s.f.Close()
+	return os.Remove(s.f.Name())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+// newPackStore opens a PackStore under root that only compacts when asked
+// to and is closed when the test ends.
+func newPackStore(t *testing.T, root string, maxSegmentSize int64) *PackStore {
+	p, err := OpenPackStore(&PackStoreOpts{Root: root, MaxSegmentSize: maxSegmentSize, CompactInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func readString(t *testing.T, b Backend, key string) string {
+	_, r, err := b.Read(key)
+	if err != nil {
+		t.Fatalf("read (%s): %v", key, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read (%s): %v", key, err)
+	}
+	return string(data)
+}
+
+func TestPackStoreReopen(t *testing.T) {
+	root := t.TempDir()
+	p := newPackStore(t, root, 256)
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		if _, err := p.Write(key, bytes.NewReader([]byte("value of "+key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Write("key_0", bytes.NewReader([]byte("overwritten")))
+	p.Delete("key_1")
+	deleteReplica(p, "key_2", 42)
+
+	check := func(p *PackStore) {
+		t.Helper()
+		if got := readString(t, p, "key_0"); got != "overwritten" {
+			t.Errorf("got %q for key_0", got)
+		}
+		if got := readString(t, p, "key_19"); got != "value of key_19" {
+			t.Errorf("got %q for key_19", got)
+		}
+		if p.Has("key_1") {
+			t.Error("deleted key_1 came back")
+		}
+		if meta, err := p.Stat("key_2"); err != nil || !meta.Deleted || meta.Version != 42 {
+			t.Errorf("tombstone of key_2 lost: %+v %v", meta, err)
+		}
+	}
+
+	// From footers and the hint file.
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p = newPackStore(t, root, 256)
+	check(p)
+
+	// From a scan after a crash that tore the last record.
+	p.Write("key_3", bytes.NewReader([]byte("lost in the crash")))
+	f, err := os.OpenFile(p.segmentPath(p.active.id), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Truncate(p.active.size - 1)
+	f.Close()
+
+	p = newPackStore(t, root, 256)
+	check(p)
+	if got := readString(t, p, "key_3"); got != "value of key_3" {
+		t.Errorf("torn record was not dropped, got %q", got)
+	}
+}
+
+func TestPackStoreCompact(t *testing.T) {
+	root := t.TempDir()
+	p := newPackStore(t, root, 512)
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			data := fmt.Sprintf("round %d of %s", round, key)
+			if _, err := p.Write(key, bytes.NewReader([]byte(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	p.Delete("key_9")
+
+	before := len(p.segments)
+	if p.garbage() < 0.5 {
+		t.Fatalf("expected mostly dead segments, got %.2f", p.garbage())
+	}
+	if err := p.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.segments) >= before {
+		t.Errorf("compaction kept %d of %d segments", len(p.segments), before)
+	}
+	if p.garbage() != 0 {
+		t.Errorf("dead bytes left after compaction: %.2f", p.garbage())
+	}
+
+	check := func(p *PackStore) {
+		t.Helper()
+		for i := 0; i < 9; i++ {
+			key := fmt.Sprintf("key_%d", i)
+			if got, want := readString(t, p, key), "round 4 of "+key; got != want {
+				t.Errorf("got %q want %q", got, want)
+			}
+		}
+		if p.Has("key_9") {
+			t.Error("deleted key_9 came back")
+		}
+	}
+	check(p)
+
+	p.Close()
+	check(newPackStore(t, root, 512))
+}
+
+func TestPackStoreCompactCrash(t *testing.T) {
+	root := t.TempDir()
+	// Every record gets a segment of its own.
+	p := newPackStore(t, root, 1)
+
+	p.Write("c", bytes.NewReader([]byte("kept")))
+	p.Write("a", bytes.NewReader([]byte("deleted")))
+	p.Delete("a")
+	p.Write("b", bytes.NewReader([]byte("active")))
+
+	old := make(map[uint32][]byte)
+	for id := range p.segments {
+		if id == p.active.id {
+			continue
+		}
+		b, err := os.ReadFile(p.segmentPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old[id] = b
+	}
+	if err := p.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	restore := func(ids ...uint32) {
+		t.Helper()
+		for _, id := range ids {
+			if err := os.WriteFile(p.segmentPath(id), old[id], 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(p *PackStore) {
+		t.Helper()
+		if p.Has("a") {
+			t.Error("deleted key came back")
+		}
+		if got := readString(t, p, "c"); got != "kept" {
+			t.Errorf("got %q for c", got)
+		}
+		if got := readString(t, p, "b"); got != "active" {
+			t.Errorf("got %q for b", got)
+		}
+	}
+
+	// A crash before the old segments were listed leaves all of them.
+	restore(0, 1, 2)
+	p = newPackStore(t, root, 1)
+	check(p)
+	p.Close()
+
+	// A crash after leaves any of them, the ones holding a deleted put
+	// without the delete included.
+	restore(1)
+	if err := p.markCompacted(map[uint32]bool{0: true, 1: true, 2: true}); err != nil {
+		t.Fatal(err)
+	}
+	p = newPackStore(t, root, 1)
+	check(p)
+	if _, err := os.Stat(p.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("compacted segment survived the restart: %v", err)
+	}
+}
+
+func TestPackStoreWriteMeta(t *testing.T) {
+	root := t.TempDir()
+	p := newPackStore(t, root, 1)
+	data := bytes.Repeat([]byte("x"), 4096)
+
+	if _, err := p.WriteWithMeta("a", bytes.NewReader(data), Meta{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	p.Write("b", bytes.NewReader([]byte("b")))
+
+	if err := p.WriteMeta("a", Meta{Key: "a", Version: 2, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if size := p.segments[p.active.id].size; size >= int64(len(data)) {
+		t.Errorf("appended %d bytes for new metadata", size)
+	}
+
+	check := func(p *PackStore) {
+		t.Helper()
+		if meta, err := p.Stat("a"); err != nil || meta.Version != 2 {
+			t.Errorf("got %+v, %v, want version 2", meta, err)
+		}
+		if got := readString(t, p, "a"); got != string(data) {
+			t.Errorf("read %d bytes", len(got))
+		}
+	}
+	check(p)
+
+	p.Close()
+	p = newPackStore(t, root, 1)
+	check(p)
+
+	// Compaction merges the metadata into a new put.
+	p.Write("c", bytes.NewReader([]byte("c")))
+	if err := p.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if p.garbage() != 0 {
+		t.Errorf("dead bytes left after compaction: %.2f", p.garbage())
+	}
+	check(p)
+	p.Close()
+	check(newPackStore(t, root, 1))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+func TestPeerReconnect(t *testing.T) {
+	var (
+		keys    = newKeyStore(NewEncryptionKey())
+		ids     = make([]*p2p.Identity, 2)
+		addrs   = []string{freeAddr(t), freeAddr(t)}
+		trusted = p2p.TrustedNodes{}
+	)
+	for i := range ids {
+		id, err := p2p.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+		trusted[id.NodeID()] = true
+	}
+
+	// node 1 is started before its bootstrap node is up.
+	s1 := startTestNode(t, ids[1], trusted, addrs[1], addrs[:1], keys, 1, nil)
+	s0 := startTestNode(t, ids[0], trusted, addrs[0], nil, keys, 0, nil)
+	waitConnected(t, []*FileServer{s0, s1}, 1)
+
+	// A peer that goes away is forgotten.
+	stopTestNode(s0)
+	waitConnected(t, []*FileServer{s1}, 0)
+	s1.mu.Lock()
+	_, down := s1.downSince[ids[0].NodeID()]
+	s1.mu.Unlock()
+	if !down {
+		t.Error("lost peer is not marked down")
+	}
+
+	// Once it is back, node 1 dials it again by itself.
+	waitFreeAddr(t, addrs[0])
+	s0 = startTestNode(t, ids[0], trusted, addrs[0], nil, keys, 0, nil)
+	waitConnected(t, []*FileServer{s0, s1}, 1)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A node that accepts connections but never completes a handshake.
+	var dials atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			conn.Close()
+		}
+	}()
+
+	id, err := p2p.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := p2p.TrustedNodes{id.NodeID(): true}
+	startTestNode(t, id, trusted, freeAddr(t), []string{ln.Addr().String()}, newKeyStore(NewEncryptionKey()), 0, nil)
+
+	// With the delay doubling from minReconnectBackoff, there are 3 to 4
+	// dials in the first two seconds.
+	time.Sleep(2 * time.Second)
+	if n := dials.Load(); n < 2 || n > 5 {
+		t.Errorf("dialed %d times in 2s, want 3 to 4", n)
+	}
+}
+
+// waitFreeAddr waits until a stopped node no longer listens on addr.
+func waitFreeAddr(t *testing.T, addr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			ln.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s still in use: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrRequestTimeout = errors.New("request timed out waiting for replies")
+
+// reply is a correlated response delivered to the goroutine that issued the
+// request with the matching Message.ID.
+type reply struct {
+	from string
+	msg  *Message
+}
+
+// pendingRequests is the table of in-flight requests waiting for replies.
+type pendingRequests struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan reply
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		waiting: make(map[uint64]chan reply),
+	}
+}
+
+// register allocates a request ID able to buffer up to n replies.
+func (p *pendingRequests) register(n int) (uint64, chan reply) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	ch := make(chan reply, n)
+	p.waiting[p.next] = ch
+
+	return p.next, ch
+}
+
+// deliver hands a reply to the waiting request. It never blocks: replies for
+// unknown, cancelled or already full requests are dropped.
+func (p *pendingRequests) deliver(id uint64, r reply) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, ok := p.waiting[id]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- r:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *pendingRequests) cancel(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, id)
+}
+
+// collect waits until n replies arrived on ch or the timeout expires. It
+// returns whatever was received, together with ErrRequestTimeout if the
+// deadline was hit first.
+func collect(ch <-chan reply, n int, timeout time.Duration) ([]reply, error) {
+	replies := make([]reply, 0, n)
+	if n == 0 {
+		return replies, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case r := <-ch:
+			replies = append(replies, r)
+			if len(replies) == n {
+				return replies, nil
+			}
+		case <-timer.C:
+			return replies, ErrRequestTimeout
+		}
+	}
+}
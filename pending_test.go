@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingRequests(t *testing.T) {
+	p := newPendingRequests()
+
+	id, ch := p.register(2)
+	if !p.deliver(id, reply{from: "a", msg: &Message{ID: id}}) {
+		t.Fatal("expected reply to be delivered")
+	}
+	if p.deliver(id+1, reply{from: "b"}) {
+		t.Error("reply for unknown request should be dropped")
+	}
+
+	replies, err := collect(ch, 2, 50*time.Millisecond)
+	if err != ErrRequestTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if len(replies) != 1 || replies[0].from != "a" {
+		t.Errorf("unexpected replies %+v", replies)
+	}
+
+	p.cancel(id)
+	if p.deliver(id, reply{from: "a"}) {
+		t.Error("reply after cancel should be dropped")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+var ErrRangeOutOfBounds = errors.New("range starts after the end of the file")
+
+// GetRange reads length bytes of key from offset with the server's
+// ReadConsistency, or the rest of the file if length is negative. It returns
+// the number of bytes the reader yields, which is less than length when the
+// file ends first.
+//
+// Only the chunks the range covers are read. Chunks covered in full are
+// downloaded and checked as by Get; of the first and last chunk only the
+// bytes in range are fetched, which cannot be checked against the hash of
+// the chunk. Files stored before chunking are read in full.
+func (s *FileServer) GetRange(key string, offset, length int64) (int64, io.Reader, error) {
+	if isChunkKey(key) {
+		return 0, nil, fmt.Errorf("get (%s): %w", key, ErrReservedKey)
+	}
+	if offset < 0 {
+		return 0, nil, fmt.Errorf("get (%s): negative offset %d", key, offset)
+	}
+
+	size, r, err := s.getObject(key, s.ReadConsistency)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	meta, err := s.Store.Stat(key)
+	if err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	if !meta.Chunked {
+		r.Close()
+		n, err := clipRange(key, size, offset, length)
+		if err != nil {
+			return 0, nil, err
+		}
+		rc, err := readRange(s.Store, key, offset, n)
+		return n, rc, err
+	}
+
+	m, err := readManifest(key, r)
+	r.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := clipRange(key, m.Size, offset, length)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, s.newChunkReader(key, chunkRange(m, offset, n)), nil
+}
+
+// clipRange returns the length of the range of a size byte file.
+func clipRange(key string, size, offset, length int64) (int64, error) {
+	if offset > size {
+		return 0, fmt.Errorf("get (%s) from %d of %d bytes: %w", key, offset, size, ErrRangeOutOfBounds)
+	}
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+	return length, nil
+}
+
+// chunkPart is the part of a chunk a read covers.
+type chunkPart struct {
+	ref    ChunkRef
+	offset int64
+	length int64
+}
+
+func (p chunkPart) whole() bool {
+	return p.offset == 0 && p.length == p.ref.Size
+}
+
+// wholeChunks returns every chunk of m in full.
+func wholeChunks(m Manifest) []chunkPart {
+	parts := make([]chunkPart, len(m.Chunks))
+	for i, ref := range m.Chunks {
+		parts[i] = chunkPart{ref: ref, length: ref.Size}
+	}
+	return parts
+}
+
+// chunkRange returns the parts of the chunks of m that hold length bytes
+// from offset.
+func chunkRange(m Manifest, offset, length int64) []chunkPart {
+	var (
+		parts []chunkPart
+		start int64
+		end   = offset + length
+	)
+	for _, ref := range m.Chunks {
+		if start >= end {
+			break
+		}
+		if start+ref.Size > offset {
+			from := max(offset-start, 0)
+			to := min(end-start, ref.Size)
+			parts = append(parts, chunkPart{ref: ref, offset: from, length: to - from})
+		}
+		start += ref.Size
+	}
+	return parts
+}
+
+// readChunkPart opens part of a chunk from the local copy, the local replica
+// or the replica of an owner, whichever is found first.
+func (s *FileServer) readChunkPart(key string, part chunkPart) (io.ReadCloser, error) {
+	ckey := chunkKey(part.ref.Hash)
+	if s.Store.Has(ckey) {
+		return readRange(s.Store, ckey, part.offset, part.length)
+	}
+
+	self, peers := s.owners(ckey)
+	if self && s.Store.Has(hashKey(ckey)) {
+		r, err := s.localReplicaPart(hashKey(ckey), part)
+		if err == nil {
+			return r, nil
+		}
+		log.Printf("[%s] part of chunk %s of (%s) from the local replica: %v\n", s.Transport.Addr(), part.ref.Hash, key, err)
+	}
+
+	var errs []error
+	for _, peer := range peers {
+		res, st, err := s.openReplicaRange(peer, hashKey(ckey), part.offset, part.length)
+		if err == nil && (res.Meta.Deleted || res.Meta.ContentHash != part.ref.Hash) {
+			st.Reset()
+			err = fmt.Errorf("replica of chunk %s holds %q", part.ref.Hash, res.Meta.ContentHash)
+		}
+		if err != nil {
+			log.Printf("[%s] part of chunk %s of (%s) from %s: %v\n", s.Transport.Addr(), part.ref.Hash, key, peer.ID(), err)
+			errs = append(errs, err)
+			continue
+		}
+		return s.decryptPart(&streamReader{st: st, r: &io.LimitedReader{R: st, N: res.Size}}, part, res.Meta)
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("chunk %s of (%s): no owner is connected", part.ref.Hash, key)
+	}
+	return nil, fmt.Errorf("chunk %s of (%s) on %d owners: %w", part.ref.Hash, key, len(errs), errors.Join(errs...))
+}
+
+// localReplicaPart opens part of a chunk from its local replica key.
+func (s *FileServer) localReplicaPart(key string, part chunkPart) (io.ReadCloser, error) {
+	meta, err := s.Store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	size, r, err := s.Store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	if r, _, err = replicaRange(r, size, part.offset, part.length); err != nil {
+		return nil, err
+	}
+	return s.decryptPart(r, part, meta)
+}
+
+// decryptPart decrypts part from the range of its replica, described by
+// meta, read from rc.
+func (s *FileServer) decryptPart(rc io.ReadCloser, part chunkPart, meta Meta) (io.ReadCloser, error) {
+	dek, err := s.dataKey(meta)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	r, err := decryptReaderAt(dek, part.offset, legacyReplica(meta), rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: io.LimitReader(r, part.length), Closer: rc}, nil
+}
+
+// streamReader reads the bytes of a reply from its stream, and resets the
+// stream if it is closed before they were all read.
+type streamReader struct {
+	st *p2p.Stream
+	r  *io.LimitedReader
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *streamReader) Close() error {
+	if s.r.N > 0 {
+		return s.st.Reset()
+	}
+	return s.st.Close()
+}
+
+// readRange opens length bytes of key from offset. The bytes before offset
+// are skipped by seeking if the backend allows it.
+func readRange(b Backend, key string, offset, length int64) (io.ReadCloser, error) {
+	_, r, err := b.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := skip(r, offset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return readCloser{Reader: io.LimitReader(r, length), Closer: r}, nil
+}
+
+// replicaRange turns r, a size byte replica, into what decryptReaderAt
+// needs for length bytes of the file from offset, and returns its size: the
+// header of a sealed replica followed by the segments the range is in, or
+// the IV of a CTR replica followed by the ciphertext of the range.
+func replicaRange(r io.ReadCloser, size, offset, length int64) (io.ReadCloser, int64, error) {
+	prefix := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+
+	var (
+		plain = size - aes.BlockSize
+		unit  = int64(1)
+		over  = int64(0)
+	)
+	if bytes.HasPrefix(prefix, []byte(sealMagic)) {
+		header := make([]byte, sealHeaderLen)
+		copy(header, prefix)
+		if _, err := io.ReadFull(r, header[len(prefix):]); err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		segment, _, err := parseSealHeader(header)
+		if err != nil {
+			r.Close()
+			return nil, 0, err
+		}
+		prefix = header
+
+		// A range is sent in whole segments, tags included.
+		unit, over = int64(segment), sealTagSize
+		segments := (size - int64(sealHeaderLen) + unit + over - 1) / (unit + over)
+		plain = size - int64(sealHeaderLen) - segments*over
+	}
+
+	if offset > plain {
+		r.Close()
+		return nil, 0, fmt.Errorf("replica range from %d of %d bytes: %w", offset, plain, ErrRangeOutOfBounds)
+	}
+	length = min(length, plain-offset)
+
+	first, end := offset/unit, (offset+length+unit-1)/unit
+	from := first * (unit + over)
+	n := min(end*(unit+over), size-int64(len(prefix))) - from
+	if length == 0 {
+		n = 0
+	}
+	if err := skip(r, from); err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+
+	rr := io.MultiReader(bytes.NewReader(prefix), io.LimitReader(r, n))
+	return readCloser{Reader: rr, Closer: r}, int64(len(prefix)) + n, nil
+}
+
+// skip advances r by n bytes.
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
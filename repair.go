@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// replicaState is what one owner reported about its replica of a key.
+type replicaState struct {
+	node string
+	has  bool
+	meta Meta
+}
+
+// newestReplica picks the replica or tombstone with the highest version.
+func newestReplica(states []replicaState) (replicaState, bool) {
+	var (
+		newest replicaState
+		found  bool
+	)
+	for _, st := range states {
+		if !st.has && !st.meta.Deleted {
+			continue
+		}
+		if !found || st.meta.Version > newest.meta.Version {
+			newest, found = st, true
+		}
+	}
+	return newest, found
+}
+
+// inSync reports whether st already holds the replica auth describes.
+func inSync(st, auth replicaState) bool {
+	if auth.meta.Deleted {
+		return st.meta.Deleted && st.meta.Version >= auth.meta.Version
+	}
+	return st.has && st.meta.Version == auth.meta.Version && st.meta.Checksum == auth.meta.Checksum
+}
+
+// readRepair brings the replicas a read consulted up to date with auth, the
+// replica the read was served from. Replicas newer than auth are left alone.
+func (s *FileServer) readRepair(auth replicaState, states []replicaState) {
+	for _, st := range states {
+		if st.node == auth.node || inSync(st, auth) || st.meta.Version > auth.meta.Version {
+			continue
+		}
+
+		if err := s.repairReplica(st.node, auth); err != nil {
+			log.Printf("[%s] read repair of (%s) on %s: %v\n", s.Transport.Addr(), auth.meta.Key, st.node, err)
+			continue
+		}
+		fmt.Printf("[%s] Repaired (%s) on %s to version %d\n", s.Transport.Addr(), auth.meta.Key, st.node, auth.meta.Version)
+	}
+}
+
+// repairReplica copies the replica auth describes to node, which may be this
+// node. The data travels the way a store would: with MessageStoreFile to a
+// peer, or with MessageGetFile from the peer that holds it.
+func (s *FileServer) repairReplica(node string, auth replicaState) error {
+	meta := auth.meta
+
+	if node == s.NodeID {
+		if meta.Deleted {
+			return deleteReplica(s.Store, meta.Key, meta.Version)
+		}
+		src, ok := s.peer(auth.node)
+		if !ok {
+			return fmt.Errorf("Peer (%s) is not in map", auth.node)
+		}
+		return s.pullReplica(src, meta)
+	}
+
+	dst, ok := s.peer(node)
+	if !ok {
+		return fmt.Errorf("Peer (%s) is not in map", node)
+	}
+	if meta.Deleted || auth.node == s.NodeID {
+		return s.pushReplica(dst, s.Store, meta)
+	}
+
+	src, ok := s.peer(auth.node)
+	if !ok {
+		return fmt.Errorf("Peer (%s) is not in map", auth.node)
+	}
+	return s.relayReplica(src, dst, meta)
+}
+
+// relayReplica streams the replica meta describes from src to dst without
+// storing it here.
+func (s *FileServer) relayReplica(src, dst p2p.Peer, meta Meta) error {
+	res, st, err := s.openReplica(src, meta.Key)
+	if err != nil {
+		return err
+	}
+	if res.Meta.Version != meta.Version {
+		st.Reset()
+		return fmt.Errorf("replica (%s) changed on %s", meta.Key, src.ID())
+	}
+
+	if err := s.sendReplica(dst, meta, res.Size, io.LimitReader(st, res.Size)); err != nil {
+		st.Reset()
+		return err
+	}
+	return st.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadRepair(t *testing.T) {
+	servers := newTestCluster(t, 3, nil)
+	key := hashKey("a")
+
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("v1")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	old, err := servers[2].Store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, r, err := servers[2].Store.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := io.ReadAll(r)
+	r.Close()
+
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader([]byte("v2")), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	want, err := servers[0].Store.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// servers[1] lost its replica, servers[2] went back to v1.
+	if err := servers[1].Store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[2].Store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeReplica(servers[2].Store, key, bytes.NewReader(stale), old.Size, old); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r2, err := servers[0].GetWithConsistency("a", ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r2); string(b) != "v2" {
+		t.Fatalf("read %q, want v2", b)
+	}
+
+	// The read writes the newest replica back to both in the background.
+	deadline := time.Now().Add(10 * time.Second)
+	for _, s := range servers[1:] {
+		for {
+			meta, err := s.Store.Stat(key)
+			if err == nil && s.Store.Has(key) && meta.Version == want.Version && meta.Checksum == want.Checksum {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s holds %+v, %v; want version %d", s.ListenAddr, meta, err, want.Version)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points each node occupies on the ring.
+// More points spread keys more evenly when the cluster is small.
+const DefaultVirtualNodes = 64
+
+// Ring is a consistent-hashing ring with virtual nodes. Adding or removing
+// a node only moves the keys that hash next to its points.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	hashes []uint64
+	owner  map[uint64]string
+	nodes  map[string]bool
+}
+
+func NewRing(vnodes int, nodes ...string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		vnodes: vnodes,
+		owner:  make(map[uint64]string),
+		nodes:  make(map[string]bool),
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+func ringHash(s string) uint64 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+
+	for i := 0; i < r.vnodes; i++ {
+		h := ringHash(node + "#" + strconv.Itoa(i))
+		if _, taken := r.owner[h]; taken {
+			continue
+		}
+		r.owner[h] = node
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owner[h] == node {
+			delete(r.owner, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+func (r *Ring) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.nodes)
+}
+
+// Owners returns the first n distinct nodes found walking clockwise from the
+// position of key. Fewer are returned if the ring has fewer nodes.
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		node := r.owner[r.hashes[(start+i)%len(r.hashes)]]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		owners = append(owners, node)
+	}
+	return owners
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingOwners(t *testing.T) {
+	r := NewRing(0, "a", "b", "c", "d")
+
+	owners := r.Owners(hashKey("foo"), 3)
+	if len(owners) != 3 {
+		t.Fatalf("want 3 owners, got %v", owners)
+	}
+
+	seen := map[string]bool{}
+	for _, o := range owners {
+		if seen[o] {
+			t.Errorf("duplicate owner %s in %v", o, owners)
+		}
+		seen[o] = true
+	}
+
+	if got := r.Owners(hashKey("foo"), 10); len(got) != 4 {
+		t.Errorf("owners capped at ring size, got %v", got)
+	}
+}
+
+func TestRingStableOnRemove(t *testing.T) {
+	r := NewRing(0, "a", "b", "c", "d", "e")
+
+	before := map[string]string{}
+	for i := 0; i < 1000; i++ {
+		key := hashKey(fmt.Sprintf("key_%d", i))
+		before[key] = r.Owners(key, 1)[0]
+	}
+
+	r.Remove("c")
+
+	moved := 0
+	for key, owner := range before {
+		now := r.Owners(key, 1)[0]
+		if now == "c" {
+			t.Fatalf("removed node still owns %s", key)
+		}
+		if owner != "c" && now != owner {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("%d keys not owned by the removed node moved", moved)
+	}
+}
@@ -2,37 +2,109 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
 )
 
-var (
-	Wg = sync.WaitGroup{}
-)
+// DefaultRequestTimeout is how long a request waits for peer replies when
+// FileServerOpts.RequestTimeout is not set.
+const DefaultRequestTimeout = 5 * time.Second
+
+// DefaultReplicationFactor is the number of nodes a file is placed on when
+// FileServerOpts.ReplicationFactor is not set.
+const DefaultReplicationFactor = 3
 
 type FileServer struct {
 	FileServerOpts
 
-	mu    sync.Mutex
-	peers map[string]p2p.Peer
-	Store
-	QuitCh chan struct{}
+	mu      sync.Mutex
+	peers   map[string]p2p.Peer
+	Store   Backend
+	ring    *Ring
+	pending *pendingRequests
+	QuitCh  chan struct{}
+
+	// members is the ring of every node seen, including the ones that are
+	// down, which are recorded in downSince. Writes for a down owner are
+	// queued in hints.
+	members   *Ring
+	downSince map[string]time.Time
+	hints     *hintQueue
+	transfers *transfers
+
+	syncMu           sync.Mutex
+	syncTrees        map[string]*syncSession
+	chunkRefSessions map[string]*chunkRefSession
+
+	// unreferenced records when the chunks no manifest refers to were first
+	// found, see CollectChunks, and pinned counts the writes whose manifest
+	// will refer to a chunk once it is stored.
+	gcMu         sync.Mutex
+	unreferenced map[string]time.Time
+	pinned       map[string]int
 }
 type FileServerOpts struct {
+	// NodeID is this node's identity as seen by its peers. With the TLS
+	// handshake it is the hex encoded Ed25519 public key.
+	NodeID            string
 	ListenAddr        string
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	TCPTransportOpts  p2p.TCPTransportOpts
 	BootstrapedNodes  []string
-	EncKey            []byte
+	// EncKey sealed the replicas written before data keys. Without Keys
+	// it is also the key data keys are wrapped with.
+	EncKey []byte
+	// Keys holds the key-encryption keys data keys are wrapped with.
+	Keys           *KeyStore
+	RequestTimeout time.Duration
+	// ReplicationFactor is how many nodes on the hash ring, this one
+	// included, hold an encrypted replica of each file.
+	ReplicationFactor int
+	// ReadConsistency and WriteConsistency are used by Get and store.
+	ReadConsistency  Consistency
+	WriteConsistency Consistency
+	// AntiEntropyInterval is the average time between two replica
+	// comparisons with every peer. A negative interval disables them.
+	AntiEntropyInterval time.Duration
+	// MaxHintBytes and MaxHintAge limit the queue of writes kept for owners
+	// that are down.
+	MaxHintBytes int64
+	MaxHintAge   time.Duration
+	// ChunkSize is the size of the chunks files are split into.
+	ChunkSize int64
+	// DownloadWorkers is how many chunks of a file Get fetches at once.
+	DownloadWorkers int
+	// ReadAhead is how many chunks past the one being read Get fetches.
+	ReadAhead int
+	// FillCache makes Get fetch every chunk of a file to the local store as
+	// soon as it is read, not only those within ReadAhead of the reader.
+	FillCache bool
+	// TransferMaxAge is how long an interrupted transfer can be resumed.
+	TransferMaxAge time.Duration
+	// ChunkGracePeriod is how long a chunk no manifest refers to is kept.
+	ChunkGracePeriod time.Duration
+	// GCInterval is the average time between two collections of
+	// unreferenced chunks. A negative interval disables them.
+	GCInterval time.Duration
+	// MessageWorkers is how many requests from peers are handled at once.
+	MessageWorkers int
+	// Backend stores the objects of this node. It defaults to a Store
+	// under StorageRoot. The server's Store wraps it in a SealedBackend, so
+	// everything written to it is encrypted at rest.
+	Backend Backend
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
@@ -43,22 +115,109 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		opts.PathTransformFunc,
 	}
 
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	if opts.NodeID == "" {
+		opts.NodeID = opts.ListenAddr
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	if opts.ReadConsistency == 0 {
+		opts.ReadConsistency = ConsistencyOne
+	}
+	if opts.WriteConsistency == 0 {
+		opts.WriteConsistency = ConsistencyOne
+	}
+	if opts.AntiEntropyInterval == 0 {
+		opts.AntiEntropyInterval = DefaultAntiEntropyInterval
+	}
+	if opts.MaxHintBytes == 0 {
+		opts.MaxHintBytes = DefaultMaxHintBytes
+	}
+	if opts.MaxHintAge == 0 {
+		opts.MaxHintAge = DefaultMaxHintAge
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.DownloadWorkers <= 0 {
+		opts.DownloadWorkers = DefaultDownloadWorkers
+	}
+	if opts.ReadAhead <= 0 {
+		opts.ReadAhead = DefaultReadAhead
+	}
+	if opts.TransferMaxAge == 0 {
+		opts.TransferMaxAge = DefaultTransferMaxAge
+	}
+	if opts.ChunkGracePeriod <= 0 {
+		opts.ChunkGracePeriod = DefaultChunkGracePeriod
+	}
+	if opts.GCInterval == 0 {
+		opts.GCInterval = DefaultGCInterval
+	}
+	if opts.MessageWorkers <= 0 {
+		opts.MessageWorkers = DefaultMessageWorkers
+	}
+	if opts.Keys == nil {
+		opts.Keys = newKeyStore(opts.EncKey)
+	}
+
+	if opts.Backend == nil {
+		store := NewStore(storeOpts)
+		if err := store.CleanTemp(); err != nil {
+			log.Println("cleaning unfinished writes:", err)
+		}
+		opts.Backend = store
+	}
+
 	return &FileServer{
-		FileServerOpts: opts,
-		Store:          *NewStore(storeOpts),
-		QuitCh:         make(chan struct{}),
-		peers:          make(map[string]p2p.Peer),
-		mu:             sync.Mutex{},
+		FileServerOpts:   opts,
+		Store:            NewSealedBackend(opts.Backend, opts.Keys),
+		QuitCh:           make(chan struct{}),
+		peers:            make(map[string]p2p.Peer),
+		ring:             NewRing(DefaultVirtualNodes, opts.NodeID),
+		members:          NewRing(DefaultVirtualNodes, opts.NodeID),
+		downSince:        make(map[string]time.Time),
+		hints:            newHintQueue(root, opts.PathTransformFunc, opts.MaxHintBytes, opts.MaxHintAge),
+		transfers:        newTransfers(root, opts.TransferMaxAge),
+		pending:          newPendingRequests(),
+		syncTrees:        make(map[string]*syncSession),
+		chunkRefSessions: make(map[string]*chunkRefSession),
+		unreferenced:     make(map[string]time.Time),
+		pinned:           make(map[string]int),
+		mu:               sync.Mutex{},
 	}
 }
 
+// Message is the envelope for every control message exchanged between
+// nodes. Replies carry the ID of the request they answer.
 type Message struct {
 	From    string
+	ID      uint64
 	Payload any
 }
 type MessageStoreFile struct {
 	Key  string
 	Size int
+	Meta Meta
+	// Session identifies the bytes sent, if the writer can send them again
+	// from any offset. A transfer of a session that was cut off resumes.
+	Session string
+}
+
+// MessageStoreFileReply tells the writer whether the peer is ready to
+// receive the file. A ready peer opens the stream the writer must send the
+// file on, starting at Offset, the bytes of the session it has already. Have
+// is set instead when the peer already holds an intact copy of the same
+// version and contents, which counts as stored.
+type MessageStoreFileReply struct {
+	Key      string
+	Ready    bool
+	Have     bool
+	StreamID uint32
+	Offset   int64
 }
 
 type DataMessage struct {
@@ -66,200 +225,873 @@ type DataMessage struct {
 	Data []byte
 }
 
-func (s *FileServer) stream(msg *Message) error {
-	peers := []io.Writer{}
-
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+func encodeMessage(msg *Message) ([]byte, error) {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return nil, err
 	}
+	return msgBuf.Bytes(), nil
+}
 
-	mw := io.MultiWriter(peers...)
+func (s *FileServer) broadCast(msg *Message) error {
+	_, err := s.sendTo(s.peerList(), msg)
+	return err
+}
 
-	if err := gob.NewEncoder(mw).Encode(msg); err != nil {
-		return fmt.Errorf("broadcast error: %w", err)
+// sendTo encodes msg once and sends it to every peer in peers. A failing peer
+// does not stop delivery to the others; the peers that were reached are
+// returned together with the joined send errors.
+func (s *FileServer) sendTo(peers []p2p.Peer, msg *Message) ([]p2p.Peer, error) {
+	b, err := encodeMessage(msg)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	var (
+		sent []p2p.Peer
+		errs []error
+	)
+	for _, peer := range peers {
+		if err := peer.Send(b); err != nil {
+			errs = append(errs, fmt.Errorf("send to %s: %w", peer.ID(), err))
+			continue
+		}
+		sent = append(sent, peer)
+	}
+	return sent, errors.Join(errs...)
 }
 
-func (s *FileServer) broadCast(msg *Message) error {
-	msgBuf := new(bytes.Buffer)
+// reply answers the request id received from peer with payload.
+func (s *FileServer) reply(peer p2p.Peer, id uint64, payload any) error {
+	_, err := s.sendTo([]p2p.Peer{peer}, &Message{ID: id, Payload: payload})
+	return err
+}
 
-	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
-		log.Fatal(err)
-		return err
+// request sends payload to peers under a fresh request ID and waits for one
+// reply per reachable peer or until the request timeout expires.
+func (s *FileServer) request(peers []p2p.Peer, payload any) ([]reply, error) {
+	return s.requestN(peers, payload, len(peers))
+}
+
+// requestN is like request but returns as soon as need replies arrived.
+func (s *FileServer) requestN(peers []p2p.Peer, payload any, need int) ([]reply, error) {
+	id, ch := s.pending.register(len(peers))
+	defer s.pending.cancel(id)
+
+	sent, err := s.sendTo(peers, &Message{ID: id, Payload: payload})
+	if err != nil {
+		log.Printf("[%s] %v\n", s.Transport.Addr(), err)
 	}
 
+	if need > len(sent) {
+		need = len(sent)
+	}
+	if need < 0 {
+		need = 0
+	}
+	return collect(ch, need, s.RequestTimeout)
+}
+
+func (s *FileServer) peerList() []p2p.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(msgBuf.Bytes()); err != nil {
-			return err
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *FileServer) peer(id string) (p2p.Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peers[id]
+	return peer, ok
+}
+
+// owners looks up the ReplicationFactor nodes responsible for key on the
+// ring. It reports whether this node is one of them and returns the others.
+func (s *FileServer) owners(key string) (bool, []p2p.Peer) {
+	var (
+		self  bool
+		peers []p2p.Peer
+	)
+	for _, id := range s.ring.Owners(hashKey(key), s.ReplicationFactor) {
+		if id == s.NodeID {
+			self = true
+			continue
+		}
+		if peer, ok := s.peer(id); ok {
+			peers = append(peers, peer)
 		}
 	}
-	return nil
+	return self, peers
 }
 
 type MessageGetFile struct {
 	Key string
+	// MetaOnly asks only for the replica's metadata, without the file.
+	MetaOnly bool
+	// When Length is positive only Length bytes of the file from Offset are
+	// sent, as replicaRange cuts them out of the replica.
+	Offset int64
+	Length int64
+	// When From is positive the replica is sent as stored from byte From on.
+	From int64
 }
 
+// MessageGetFileReply answers MessageGetFile. When Has is set and the request
+// was not MetaOnly, the file is sent on the stream StreamID opened by the
+// replying peer.
+type MessageGetFileReply struct {
+	Key      string
+	Has      bool
+	Size     int64
+	Meta     Meta
+	StreamID uint32
+}
+
+// Get reads key with the server's ReadConsistency.
 func (s *FileServer) Get(key string) (int64, io.Reader, error) {
-	if s.Store.Has(key) {
-		fmt.Printf("[%s] Serving file (%s) from the local disk\n", s.Transport.Addr(), key)
-		return s.Store.Read(key)
-	} else {
-		fmt.Printf("[%s] Doesn't exist file (%s) locally, Fetching from the network...\n", s.Transport.Addr(), key)
+	return s.GetWithConsistency(key, s.ReadConsistency)
+}
+
+// GetWithConsistency consults at least cl.Required replicas of key and
+// returns the newest version found among them. Replicas that turn out to be
+// stale or missing are repaired in the background. The chunks of the file
+// are fetched as the returned reader reaches them.
+func (s *FileServer) GetWithConsistency(key string, cl Consistency) (int64, io.Reader, error) {
+	if isChunkKey(key) {
+		return 0, nil, fmt.Errorf("get (%s): %w", key, ErrReservedKey)
 	}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			Key: hashKey(key),
-		},
+	size, r, err := s.getObject(key, cl)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	if err := s.broadCast(&msg); err != nil {
+	meta, err := s.Store.Stat(key)
+	if err != nil {
+		r.Close()
 		return 0, nil, err
 	}
+	if !meta.Chunked {
+		// Files stored before chunking hold their contents.
+		return size, r, nil
+	}
 
-	time.Sleep(time.Millisecond * 500)
+	m, err := readManifest(key, r)
+	r.Close()
+	if err != nil {
+		return 0, nil, err
+	}
+	return m.Size, s.newChunkReader(key, wholeChunks(m)), nil
+}
 
-	for _, peer := range s.peers {
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+// getObject brings the newest version of the object key to the local store,
+// as GetWithConsistency describes, and opens it. The local copy is only
+// served if none of the replicas consulted is newer, at ONE too.
+func (s *FileServer) getObject(key string, cl Consistency) (int64, io.ReadCloser, error) {
+	var (
+		self, peers = s.owners(key)
+		required    = cl.Required(s.ReplicationFactor)
+		states      []replicaState
+	)
 
-		_, err := s.Store.writeDecrypt(s.EncKey, key, io.LimitReader(peer, fileSize))
+	if self {
+		meta, err := readMeta(s.Store, hashKey(key))
 		if err != nil {
 			return 0, nil, err
 		}
+		states = append(states, replicaState{node: s.NodeID, has: s.Store.Has(hashKey(key)), meta: meta})
+	}
+
+	// Without a local replica keep asking until every owner answered, so a
+	// single miss does not hide a copy held elsewhere.
+	need := required - len(states)
+	if len(states) == 0 || !states[0].has {
+		need = len(peers)
+	}
+
+	if need > 0 {
+		replies, err := s.requestN(peers, MessageGetFile{Key: hashKey(key), MetaOnly: true}, need)
+		if err != nil && err != ErrRequestTimeout {
+			return 0, nil, err
+		}
+		for _, r := range replies {
+			res := r.msg.Payload.(MessageGetFileReply)
+			states = append(states, replicaState{node: r.from, has: res.Has, meta: res.Meta})
+		}
+	}
+
+	if len(states) < required {
+		return 0, nil, fmt.Errorf("get (%s) at %s: %w: %d of %d", key, cl, ErrNotEnoughReplicas, len(states), required)
+	}
 
+	newest, ok := newestReplica(states)
+	if !ok {
+		return 0, nil, fmt.Errorf("[%s] file (%s) not found on any of %d replicas", s.Transport.Addr(), key, len(states))
 	}
-	return s.Store.Read(key)
+
+	local, err := readMeta(s.Store, key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if newest.meta.Deleted {
+		go s.readRepair(newest, states)
+
+		if s.Store.Has(key) && local.Version < newest.meta.Version {
+			if err := s.Store.Delete(key); err != nil {
+				return 0, nil, err
+			}
+		}
+		return 0, nil, fmt.Errorf("[%s] file (%s) was removed", s.Transport.Addr(), key)
+	}
+
+	// The plaintext copy is good as long as no replica has a newer version.
+	if s.Store.Has(key) && local.Version >= newest.meta.Version {
+		go s.readRepair(newest, states)
+
+		fmt.Printf("[%s] Serving file (%s) from the local disk\n", s.Transport.Addr(), key)
+		return s.Store.Read(key)
+	}
+
+	// Any replica of the newest version will do, as long as it is intact.
+	for i, st := range states {
+		if !st.has || st.meta.Version != newest.meta.Version {
+			continue
+		}
+
+		if st.node == s.NodeID {
+			fmt.Printf("[%s] Serving file (%s) from the local replica\n", s.Transport.Addr(), key)
+			err = s.decryptLocalReplica(key, st.meta)
+		} else {
+			fmt.Printf("[%s] Fetching file (%s) version %d from %s\n", s.Transport.Addr(), key, st.meta.Version, st.node)
+			err = s.fetchReplica(key, st.node, st.meta)
+		}
+		if err != nil {
+			log.Printf("[%s] replica (%s) on %s: %v\n", s.Transport.Addr(), key, st.node, err)
+			if errors.Is(err, ErrChecksumMismatch) {
+				// Repair it along with the stale ones.
+				states[i].has = false
+			}
+			continue
+		}
+
+		go s.readRepair(st, states)
+		return s.Store.Read(key)
+	}
+
+	return 0, nil, fmt.Errorf("[%s] no intact replica of file (%s) version %d", s.Transport.Addr(), key, newest.meta.Version)
+}
+
+// fetchReplica downloads the replica of key held by peer id and stores the
+// decrypted file as the local copy. The replica must match meta.
+func (s *FileServer) fetchReplica(key string, id string, meta Meta) error {
+	peer, ok := s.peer(id)
+	if !ok {
+		return fmt.Errorf("Peer (%s) is not in map", id)
+	}
+
+	p, err := s.fetchResumable(peer, hashKey(key), meta)
+	if err != nil {
+		return err
+	}
+	defer p.done()
+
+	return s.writeDecryptVerified(key, p.reader(), p.Size(), meta)
+}
+
+func (s *FileServer) decryptLocalReplica(key string, meta Meta) error {
+	size, r, err := s.Store.Read(hashKey(key))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.writeDecryptVerified(key, r, size, meta)
+}
+
+// writeDecryptVerified decrypts the size byte replica read from r into the
+// local copy of key. The local copy is only replaced if the replica is
+// complete and both it and the decrypted file match the checksums in meta.
+func (s *FileServer) writeDecryptVerified(key string, r io.Reader, size int64, meta Meta) error {
+	plain := Meta{
+		Version:    meta.Version,
+		Chunked:    meta.Chunked,
+		Recipients: meta.Recipients,
+		Checksum:   meta.ContentHash,
+		Created:    meta.Created,
+		Modified:   meta.Modified,
+	}
+
+	dek, err := s.dataKey(meta)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		h := sha256.New()
+		n, err := copyDecrypt(dek, legacyReplica(meta), io.TeeReader(r, h), pw)
+		if err == nil && int64(n) != size {
+			err = fmt.Errorf("short stream for (%s): got %d of %d bytes", key, n, size)
+		}
+		if err == nil && meta.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != meta.Checksum {
+			err = ErrChecksumMismatch
+		}
+		// A failure reaches WriteWithMeta before EOF, so nothing is stored.
+		pw.CloseWithError(err)
+	}()
+
+	_, err = s.Store.WriteWithMeta(key, pr, plain)
+	pr.CloseWithError(err)
+	<-done
+	return err
 }
 
+// storeAckOK is written back on the stream by a peer once the replica and
+// its metadata are on disk, followed by the SHA-256 of the replica.
+const storeAckOK = 0x1
+
 func (s *FileServer) store(key string, r io.Reader) error {
+	return s.StoreWithConsistency(key, r, s.WriteConsistency)
+}
+
+// StoreWithConsistency writes key locally and replicates it to its owners on
+// the ring. It succeeds once cl.Required replicas acknowledged the write.
+//
+// The file is stored as chunks, which are replicated as they are read from r,
+// and a manifest under key that lists them.
+func (s *FileServer) StoreWithConsistency(key string, r io.Reader, cl Consistency) error {
+	return s.storeFile(key, r, cl, nil)
+}
+
+// storeFile stores the chunks of r and their manifest, which carries the
+// recipients of a file encrypted end to end.
+func (s *FileServer) storeFile(key string, r io.Reader, cl Consistency, recipients []Recipient) error {
+	if isChunkKey(key) {
+		return fmt.Errorf("store (%s): %w", key, ErrReservedKey)
+	}
+
+	m, err := s.storeChunks(r, cl)
+	if err != nil {
+		return err
+	}
+	defer s.unpinChunks(m)
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	origin := Meta{Chunked: true, Recipients: recipients, Checksum: hex.EncodeToString(sum[:])}
+	return s.storeObject(key, bytes.NewReader(b), cl, origin, false)
+}
 
+// storeObject writes the object key with the metadata origin locally and
+// replicates it. Replicas are sealed with a new data key, or, if convergent,
+// with one derived from the contents, see newDataKey. Owners that hold the
+// object already, and this node, do not store it again.
+func (s *FileServer) storeObject(key string, r io.Reader, cl Consistency, origin Meta, convergent bool) error {
 	var (
 		fileBuffer = new(bytes.Buffer)
 		tee        = io.TeeReader(r, fileBuffer)
 	)
 
-	size, err := s.Store.Write(key, tee)
+	if holdsCopy(s.Store, key, origin.Version, origin.Checksum) {
+		if _, err := io.Copy(fileBuffer, r); err != nil {
+			return err
+		}
+		local, err := s.Store.Stat(key)
+		if err != nil {
+			return err
+		}
+		origin = local
+	} else {
+		written, err := s.Store.WriteWithMeta(key, tee, origin)
+		if err != nil {
+			return err
+		}
+		origin = written
+	}
+	size := origin.Size
+
+	self, peers := s.owners(key)
+	required := cl.Required(s.ReplicationFactor)
+
+	// Every replica gets the metadata of this write; the size and, unless
+	// set below, the checksum of the ciphertext are filled in where it is
+	// stored.
+	meta := Meta{
+		Key:         hashKey(key),
+		Version:     origin.Version,
+		Replica:     true,
+		Chunked:     origin.Chunked,
+		Recipients:  origin.Recipients,
+		PlainSize:   origin.PlainSize,
+		ContentHash: origin.ContentHash,
+		Created:     origin.Created,
+		Modified:    origin.Modified,
+	}
+
+	kekID, kek := s.Keys.Current()
+	dek, salt := newDataKey(kek, origin.ContentHash, convergent)
+	wrapped, err := wrapKey(kek, dek, meta.Key)
 	if err != nil {
 		return err
 	}
+	meta.KeyID, meta.WrappedKey = kekID, wrapped
+	if meta.Name, err = sealName(dek, key, meta.Key); err != nil {
+		return err
+	}
 
-	msg := &Message{
-		Payload: MessageStoreFile{
-			Key:  hashKey(key),
-			Size: int(size) + 16,
-		},
+	// With a fixed salt the ciphertext is known before it is sent, so the
+	// replicas are checked against it before they are stored, and a transfer
+	// that was cut off can be resumed.
+	var session string
+	if salt != nil {
+		h := newHashWriter(io.Discard)
+		if _, err := copySeal(dek, salt, bytes.NewReader(fileBuffer.Bytes()), h); err != nil {
+			return err
+		}
+		meta.Checksum = h.Sum()
+		session = transferSession(meta.Key, meta.Version, meta.Checksum)
 	}
 
-	if err := s.broadCast(msg); err != nil {
+	replies, err := s.request(peers, MessageStoreFile{
+		Key:     hashKey(key),
+		Size:    int(sealedSize(size)),
+		Meta:    meta,
+		Session: session,
+	})
+	if err != nil && err != ErrRequestTimeout {
 		return err
 	}
 
-	time.Sleep(3 * time.Second)
+	streams := []*p2p.Stream{}
+	offsets := []int64{}
+	present := 0
+	for _, r := range replies {
+		res := r.msg.Payload.(MessageStoreFileReply)
+		if res.Have {
+			present++
+			continue
+		}
+		if !res.Ready {
+			continue
+		}
+
+		peer, ok := s.peer(r.from)
+		if !ok {
+			continue
+		}
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+		st, err := peer.AcceptStream(res.StreamID)
+		if err != nil {
+			continue
+		}
+		streams = append(streams, st)
+		offsets = append(offsets, res.Offset)
+	}
+
+	// An owner's replica is only rewritten if it is not intact.
+	selfHas := self && holdsCopy(s.Store, hashKey(key), meta.Version, meta.ContentHash)
+
+	replicas := len(streams) + present
+	if self {
+		replicas++
+	}
+	if replicas < required {
+		for _, st := range streams {
+			st.Reset()
+		}
+		return fmt.Errorf("store (%s) at %s: %w: %d of %d ready", key, cl, ErrNotEnoughReplicas, replicas, required)
+	}
+
+	// The peers check what they stored against the hash of the ciphertext.
+	// A replica that fails is dropped while the others carry on; waitAcks
+	// decides whether enough of them succeeded.
+	sum := sha256.New()
+	writers := []io.Writer{sum}
+	peerWriters := make([]*bestEffortWriter, len(streams))
+	for i, st := range streams {
+		peerWriters[i] = &bestEffortWriter{w: &skipWriter{w: timedWriter{st: st, timeout: s.RequestTimeout}, skip: offsets[i]}}
+		writers = append(writers, peerWriters[i])
+	}
+
+	// When this node is an owner it keeps an encrypted replica next to its
+	// plaintext copy, written from the same ciphertext the peers receive.
+	var (
+		localW   *io.PipeWriter
+		localErr <-chan error
+	)
+	if self && !selfHas {
+		localW, localErr = replicaWriter(s.Store, hashKey(key), meta)
+		writers = append(writers, &bestEffortWriter{w: localW})
+	}
+
+	// Owners that are down get the same ciphertext once they are back.
+	hints := s.hintWriters(s.hintTargets(key), hashKey(key), sealedSize(size), meta)
+	for _, w := range hints {
+		writers = append(writers, w)
+	}
+
+	mw := io.MultiWriter(writers...)
+	var n int
+	if salt != nil {
+		n, err = copySeal(dek, salt, fileBuffer, mw)
+	} else {
+		n, err = copyEncrypt(dek, fileBuffer, mw)
+	}
+	if localW != nil {
+		localW.CloseWithError(err)
+	}
+	for _, w := range hints {
+		w.CloseWithError(err)
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
 	if err != nil {
+		for _, st := range streams {
+			st.Reset()
+		}
 		return err
 	}
 
-	fmt.Printf("[%s] Received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	fmt.Printf("[%s] Streamed (%d) bytes to %d peers\n", s.Transport.Addr(), n, len(streams))
+
+	acks := make(chan error, replicas)
+	for i := 0; i < present; i++ {
+		acks <- nil
+	}
+	for i, st := range streams {
+		if err := peerWriters[i].err; err != nil {
+			st.Reset()
+			acks <- err
+			continue
+		}
+		st.Close()
+		go func(st *p2p.Stream) {
+			acks <- s.awaitStoreAck(st, hex.EncodeToString(sum.Sum(nil)))
+		}(st)
+	}
+	switch {
+	case selfHas:
+		acks <- nil
+	case self:
+		go func() {
+			acks <- <-localErr
+		}()
+	}
+
+	return waitAcks(acks, replicas, required, key, cl)
+}
+
+// bestEffortWriter keeps a failing writer from failing the io.MultiWriter it
+// is part of. Writes after the first error are discarded, and the error is
+// kept in err.
+type bestEffortWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (b *bestEffortWriter) Write(p []byte) (int, error) {
+	if b.err == nil {
+		_, b.err = b.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// timedWriter fails a write to st that the peer does not take within
+// timeout, see p2p.Stream.SetWriteDeadline.
+type timedWriter struct {
+	st      *p2p.Stream
+	timeout time.Duration
+}
+
+func (w timedWriter) Write(p []byte) (int, error) {
+	w.st.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.st.Write(p)
+}
+
+// replicaWriter returns a pipe whose contents are stored in store as the
+// replica key. The result is sent on the channel once the pipe is closed.
+func replicaWriter(store Backend, key string, meta Meta) (*io.PipeWriter, <-chan error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := writeReplica(store, key, pr, -1, meta)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	return pw, done
+}
+
+// awaitStoreAck waits for the peer on st to confirm the replica is durable,
+// and that it matches the hex encoded SHA-256 sum unless that is empty.
+func (s *FileServer) awaitStoreAck(st *p2p.Stream, sum string) error {
+	timer := time.AfterFunc(s.RequestTimeout, func() { st.Reset() })
+	defer timer.Stop()
+
+	ack := make([]byte, 1+sha256.Size)
+	if _, err := io.ReadFull(st, ack); err != nil {
+		return err
+	}
+	if ack[0] != storeAckOK {
+		return fmt.Errorf("unexpected store ack 0x%x", ack[0])
+	}
+	if sum != "" && hex.EncodeToString(ack[1:]) != sum {
+		return fmt.Errorf("replica stored on the peer: %w", ErrChecksumMismatch)
+	}
+	return nil
+}
 
+// waitAcks returns as soon as required of the total pending acknowledgements
+// succeeded, or with ErrNotEnoughReplicas once that became impossible.
+func waitAcks(acks <-chan error, total, required int, key string, cl Consistency) error {
+	ok, failed := 0, 0
+	for ok < required {
+		if total-failed < required {
+			return fmt.Errorf("store (%s) at %s: %w: %d of %d acknowledged", key, cl, ErrNotEnoughReplicas, ok, required)
+		}
+		if err := <-acks; err != nil {
+			log.Printf("store (%s): replica failed: %v\n", key, err)
+			failed++
+			continue
+		}
+		ok++
+	}
 	return nil
 }
 
+// MessageRemoveFile deletes a replica. The replica is kept if it is newer
+// than Version; otherwise a tombstone with Version replaces it.
 type MessageRemoveFile struct {
+	Key     string
+	Version int64
+}
+
+type MessageRemoveFileReply struct {
 	Key string
 }
 
+// Remove deletes key from the cluster. Only the manifest of a chunked file
+// is removed; its chunks may be shared with other files and stay in place.
 func (s *FileServer) Remove(key string) error {
-	s.Store.Delete(key)
-
-	fmt.Printf("[%v] File (%s) removed from the local disk \n", s.Transport.Addr(), key)
-
-	msg := Message{
-		Payload: MessageRemoveFile{
-			Key: hashKey(key),
-		},
+	if isChunkKey(key) {
+		return fmt.Errorf("remove (%s): %w", key, ErrReservedKey)
 	}
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+
+	version := time.Now().UnixNano()
+	self, peers := s.owners(key)
 
-	Wg.Add(len(s.peers))
-	if err := s.broadCast(&msg); err != nil {
+	if self {
+		if err := deleteReplica(s.Store, hashKey(key), version); err != nil {
+			return err
+		}
+	} else if err := s.Store.Delete(hashKey(key)); err != nil {
 		return err
 	}
 
-	Wg.Wait()
-	return nil
+	s.hintRemove(s.hintTargets(key), hashKey(key), version)
+
+	fmt.Printf("[%v] File (%s) removed from the local disk \n", s.Transport.Addr(), key)
+
+	replies, err := s.request(peers, MessageRemoveFile{Key: hashKey(key), Version: version})
+	if err == ErrRequestTimeout {
+		return fmt.Errorf("remove (%s): %d of %d peers acknowledged", key, len(replies), len(peers))
+	}
+	return err
 }
 
 func (fs *FileServer) Start() error {
 	fs.Transport.ListenAndAccept()
 
 	fs.bootStarpNetwork()
+	go fs.antiEntropyLoop()
+	go fs.gcLoop()
+	go fs.sealPlaintext()
 	fs.Loop()
 
 	return nil
 }
 
-func (f *FileServer) bootStarpNetwork() error {
-	var wg sync.WaitGroup
+const (
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+var errSelfPeer = errors.New("refusing connection to self")
+
+// duplicatePeerError rejects a second connection to a node we are already
+// connected to.
+type duplicatePeerError struct {
+	id string
+}
+
+func (e *duplicatePeerError) Error() string {
+	return fmt.Sprintf("duplicate connection to peer %s", e.id)
+}
+
+// bootStarpNetwork starts a supervisor for every bootstrap node. It returns
+// immediately; nodes that are down are dialed in the background.
+func (f *FileServer) bootStarpNetwork() {
 	for _, addr := range f.BootstrapedNodes {
-		if len(f.BootstrapedNodes) == 0 {
+		if len(addr) == 0 {
 			continue
 		}
+		go f.superviseNode(addr)
+	}
+}
 
-		wg.Add(1)
-		go func(addr string) {
-			for {
-				if err := f.Transport.Dial(addr); err != nil {
-					time.Sleep(time.Second * 5)
-				} else {
-					break
-				}
+// superviseNode keeps a connection to addr alive, redialing with exponential
+// backoff whenever it cannot connect or the connection drops.
+func (f *FileServer) superviseNode(addr string) {
+	backoff := minReconnectBackoff
+
+	for {
+		peer, err := f.Transport.Dial(addr)
+
+		var dup *duplicatePeerError
+		if errors.As(err, &dup) {
+			// The node dialed us first; watch that connection instead.
+			if existing, ok := f.peer(dup.id); ok {
+				peer, err = existing, nil
+			}
+		}
+		if errors.Is(err, errSelfPeer) {
+			return
+		}
+
+		if err != nil {
+			log.Printf("[%s] dial %s failed, retrying in %s: %v\n", f.Transport.Addr(), addr, backoff, err)
+		} else {
+			connectedAt := time.Now()
+			select {
+			case <-peer.Done():
+			case <-f.QuitCh:
+				return
+			}
+			log.Printf("[%s] lost connection to %s, reconnecting\n", f.Transport.Addr(), addr)
+
+			if time.Since(connectedAt) > maxReconnectBackoff {
+				backoff = minReconnectBackoff
 			}
-			wg.Done()
-		}(addr)
+		}
+
+		// Jitter keeps a restarted cluster from redialing in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-f.QuitCh:
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
 	}
-	wg.Wait()
-	return nil
 }
 
 func (f *FileServer) OnPeer(p p2p.Peer) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.peers[p.RemoteAddr().String()] = p
 
-	log.Println("Connected with peer : ", p.RemoteAddr())
+	if p.ID() == f.NodeID {
+		return errSelfPeer
+	}
+
+	// Two nodes that dial each other end up with two connections. Both sides
+	// keep the one dialed by the node with the smaller ID.
+	if old, ok := f.peers[p.ID()]; ok {
+		if !f.preferConn(p) {
+			return &duplicatePeerError{id: p.ID()}
+		}
+		old.Close()
+	}
+
+	f.peers[p.ID()] = p
+	f.ring.Add(p.ID())
+	f.members.Add(p.ID())
+	delete(f.downSince, p.ID())
+
+	go f.replayHints(p)
+
+	log.Printf("Connected with peer %s (%s)\n", p.ID(), p.RemoteAddr())
 	return nil
 }
 
+func (f *FileServer) preferConn(p p2p.Peer) bool {
+	if p.Outbound() {
+		return f.NodeID < p.ID()
+	}
+	return p.ID() < f.NodeID
+}
+
+// OnPeerDisconnect forgets a peer whose connection has gone away. A newer
+// connection to the same node that replaced it is left alone.
+func (f *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cur, ok := f.peers[p.ID()]; ok && cur == p {
+		delete(f.peers, p.ID())
+		f.ring.Remove(p.ID())
+		f.downSince[p.ID()] = time.Now()
+		log.Printf("Disconnected from peer %s (%s)\n", p.ID(), p.RemoteAddr())
+	}
+}
+
 // Loop is the main loop of the server which listens for incoming messages and handles them
 func (f *FileServer) Loop() {
 
 	defer func() {
 		fmt.Println("File server stopped")
 		f.Transport.Close()
+		if c, ok := f.Store.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Println("closing storage:", err)
+			}
+		}
 	}()
 
+	workers := newMessageWorkers(f.MessageWorkers, func(from string, msg *Message) {
+		if err := f.handleMessage(from, msg); err != nil {
+			log.Println("handle message error  : ", err)
+		}
+	}, f.QuitCh)
+
 	for {
 		select {
 		case rpc := <-f.Transport.Consume():
-			var message Message
-			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&message); err != nil {
-				log.Fatal(err)
+			message := new(Message)
+			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(message); err != nil {
+				log.Println("decode message error : ", err)
+				continue
 			}
 
-			if err := f.handleMessage(rpc.From.String(), &message); err != nil {
-				log.Println("handle message error  : ", err)
+			// Replies only wake up the request waiting for them, so they
+			// are delivered right away. Handlers may block on streams, so
+			// requests go to the workers.
+			if isReply(message) {
+				if err := f.handleMessage(rpc.From, message); err != nil {
+					log.Println("handle message error  : ", err)
+				}
+				continue
 			}
+			workers.dispatch(rpc.From, message)
 
 		case <-f.QuitCh:
 			return
@@ -270,45 +1102,120 @@ func (f *FileServer) Loop() {
 func (f *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return f.handleMessageStoreFile(from, v)
+		return f.handleMessageStoreFile(from, msg.ID, v)
 
 	case MessageGetFile:
-		return f.handleMessageGetFile(from, v)
+		return f.handleMessageGetFile(from, msg.ID, v)
 
 	case MessageRemoveFile:
-		return f.handleMessageRemoveFile(from, v)
+		return f.handleMessageRemoveFile(from, msg.ID, v)
+
+	case MessageSyncTree:
+		return f.handleMessageSyncTree(from, msg.ID, v)
+
+	case MessageSyncBucket:
+		return f.handleMessageSyncBucket(from, msg.ID, v)
+
+	case MessageListKeys:
+		return f.handleMessageListKeys(from, msg.ID, v)
+
+	case MessageChunkRefs:
+		return f.handleMessageChunkRefs(from, msg.ID, v)
+
+	default:
+		if !isReply(msg) {
+			return fmt.Errorf("[%s] unknown message %T from %s", f.Transport.Addr(), msg.Payload, from)
+		}
+		if !f.pending.deliver(msg.ID, reply{from: from, msg: msg}) {
+			f.discardReply(from, msg)
+			return fmt.Errorf("[%s] dropping late or unknown reply %d from %s", f.Transport.Addr(), msg.ID, from)
+		}
 	}
 	return nil
 }
 
-func (f *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !f.Store.Has(msg.Key) {
-		return fmt.Errorf("[%s] file serving request of (%s) but does'nt exist on disk \n", f.Transport.Addr(), msg.Key)
+// discardReply resets the stream a reply offered, so the peer that opened it
+// does not wait for a transfer nobody is going to do.
+func (f *FileServer) discardReply(from string, msg *Message) {
+	var id uint32
+	switch v := msg.Payload.(type) {
+	case MessageStoreFileReply:
+		id = v.StreamID
+	case MessageGetFileReply:
+		id = v.StreamID
+	}
+	if id == 0 {
+		return
 	}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", f.Transport.Addr(), msg.Key)
+	peer, ok := f.peer(from)
+	if !ok {
+		return
+	}
+	if st, err := peer.AcceptStream(id); err == nil {
+		st.Reset()
+	}
+}
+
+func (f *FileServer) handleMessageGetFile(from string, id uint64, msg MessageGetFile) error {
+	peer, ok := f.peer(from)
+	if !ok {
+		return fmt.Errorf("Peer (%s) is not in map", from)
+	}
+
+	meta, err := readMeta(f.Store, msg.Key)
+	if err != nil {
+		return err
+	}
+
+	// Without the file the metadata may still hold a tombstone.
+	if !f.Store.Has(msg.Key) {
+		fmt.Printf("[%s] file serving request of (%s) but doesn't exist on disk\n", f.Transport.Addr(), msg.Key)
+		return f.reply(peer, id, MessageGetFileReply{Key: msg.Key, Meta: meta})
+	}
 
 	fileSize, r, err := f.Store.Read(msg.Key)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
+	if msg.MetaOnly {
+		return f.reply(peer, id, MessageGetFileReply{Key: msg.Key, Has: true, Size: fileSize, Meta: meta})
 	}
 
-	peer, ok := f.peers[from]
-	if !ok {
-		return fmt.Errorf("Peer (%s) is not in map", from)
+	switch {
+	case msg.Length > 0:
+		if r, fileSize, err = replicaRange(r, fileSize, msg.Offset, msg.Length); err != nil {
+			return err
+		}
+		defer r.Close()
+	case msg.From > 0:
+		if msg.From > fileSize {
+			return fmt.Errorf("replica (%s) from %d of %d bytes: %w", msg.Key, msg.From, fileSize, ErrRangeOutOfBounds)
+		}
+		if err := skip(r, msg.From); err != nil {
+			return err
+		}
+		fileSize -= msg.From
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	err = binary.Write(peer, binary.LittleEndian, fileSize)
+	fmt.Printf("[%s] serving file (%s) over the network\n", f.Transport.Addr(), msg.Key)
+
+	st, err := peer.OpenStream()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer st.Close()
+
+	if err := f.reply(peer, id, MessageGetFileReply{Key: msg.Key, Has: true, Size: fileSize, Meta: meta, StreamID: st.ID()}); err != nil {
+		st.Reset()
+		return err
 	}
-	n, err := io.Copy(peer, r)
+
+	n, err := io.Copy(timedWriter{st: st, timeout: f.RequestTimeout}, r)
 	if err != nil {
+		st.Reset()
 		return err
 	}
 
@@ -316,41 +1223,108 @@ func (f *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 	return nil
 }
 
-func (f *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := f.peers[from]
+func (f *FileServer) handleMessageStoreFile(from string, id uint64, msg MessageStoreFile) error {
+	peer, ok := f.peer(from)
 	if !ok {
-		log.Fatal(fmt.Errorf("Peer (%s) could not be found in the peer map", from))
 		return fmt.Errorf("Peer (%s) could not be found in the peer map", from)
 	}
 
+	// A chunk written again is about to be referred to, whether or not
+	// this owner still holds it.
+	if msg.Key == hashKey(chunkKey(msg.Meta.ContentHash)) {
+		f.touchChunk(msg.Meta.ContentHash)
+	}
+	if holdsCopy(f.Store, msg.Key, msg.Meta.Version, msg.Meta.ContentHash) {
+		return f.reply(peer, id, MessageStoreFileReply{Key: msg.Key, Have: true})
+	}
+
+	// A session is received into a partial first, which is kept if the
+	// transfer is cut off, and then stored.
+	var p *partial
+	if msg.Session != "" {
+		var err error
+		if p, err = f.transfers.open(msg.Session); err != nil {
+			return err
+		}
+		if p.Size() > int64(msg.Size) {
+			p.reset()
+		}
+	}
+	var offset int64
+	if p != nil {
+		offset = p.Size()
+	}
+
+	st, err := peer.OpenStream()
+	if err != nil {
+		if p != nil {
+			p.keep()
+		}
+		return err
+	}
+	defer st.Close()
+
+	if err := f.reply(peer, id, MessageStoreFileReply{Key: msg.Key, Ready: true, StreamID: st.ID(), Offset: offset}); err != nil {
+		st.Reset()
+		if p != nil {
+			p.keep()
+		}
+		return err
+	}
+
 	fmt.Println("writing file to peer ===> ", f.Transport.Addr())
-	n, err := f.Store.Write(msg.Key, io.LimitReader(peer, int64(msg.Size)))
+	r := io.LimitReader(st, int64(msg.Size))
+	if p != nil {
+		if offset > 0 {
+			fmt.Printf("[%s] Resuming (%s) at %d of %d bytes\n", f.Transport.Addr(), msg.Key, offset, msg.Size)
+		}
+		if _, err := io.Copy(p, io.LimitReader(st, int64(msg.Size)-offset)); err != nil || p.Size() != int64(msg.Size) {
+			p.keep()
+			st.Reset()
+			if err == nil {
+				err = fmt.Errorf("short stream for (%s): got %d of %d bytes", msg.Key, p.Size(), msg.Size)
+			}
+			return err
+		}
+		defer p.done()
+		r = p.reader()
+	}
+
+	sum := sha256.New()
+	n, err := writeReplica(f.Store, msg.Key, io.TeeReader(r, sum), int64(msg.Size), msg.Meta)
 	if err != nil {
-		log.Fatal(err)
+		st.Reset()
 		return err
 	}
 
 	fmt.Printf("[%s] Written %v bytes to disk\n", f.Transport.Addr(), n)
 
-	peer.CloseStream()
-	return nil
+	_, err = st.Write(append([]byte{storeAckOK}, sum.Sum(nil)...))
+	return err
 }
 
-func (f *FileServer) handleMessageRemoveFile(from string, msg MessageRemoveFile) error {
-	peer, ok := f.peers[from]
+func (f *FileServer) handleMessageRemoveFile(from string, id uint64, msg MessageRemoveFile) error {
+	peer, ok := f.peer(from)
 	if !ok {
 		return fmt.Errorf("Peer (%s) could not be found in the peer map\n", from)
 	}
 
-	err := f.Store.Delete(msg.Key)
+	local, err := readMeta(f.Store, msg.Key)
 	if err != nil {
-		log.Println(err)
 		return err
 	}
-	Wg.Done()
-	fmt.Printf("[%v] Removed (%v) file from the network storage\n", peer.LocalAddr(), msg.Key)
 
-	return nil
+	if local.Version > msg.Version {
+		fmt.Printf("[%v] Keeping (%v), it is newer than the remove\n", peer.LocalAddr(), msg.Key)
+	} else {
+		if err := deleteReplica(f.Store, msg.Key, msg.Version); err != nil {
+			log.Println(err)
+			return err
+		}
+		fmt.Printf("[%v] Removed (%v) file from the network storage\n", peer.LocalAddr(), msg.Key)
+	}
+
+	return f.reply(peer, id, MessageRemoveFileReply{Key: msg.Key})
 }
 
 func (f *FileServer) Stop() {
@@ -362,6 +1336,17 @@ func init() {
 	gob.Register(Message{})
 	gob.Register(DataMessage{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileReply{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileReply{})
 	gob.Register(MessageRemoveFile{})
+	gob.Register(MessageRemoveFileReply{})
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSyncTreeReply{})
+	gob.Register(MessageSyncBucket{})
+	gob.Register(MessageSyncBucketReply{})
+	gob.Register(MessageListKeys{})
+	gob.Register(MessageListKeysReply{})
+	gob.Register(MessageChunkRefs{})
+	gob.Register(MessageChunkRefsReply{})
 }
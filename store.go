@@ -8,6 +8,8 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 )
 
@@ -88,23 +90,52 @@ func (s *Store) Has(key string) bool {
 }
 
 func (s *Store) Clear() error {
+	forgetKeyIndex(s.Root)
 	return os.RemoveAll(s.Root)
 }
 
+// Delete removes the object key and its metadata, then prunes the
+// directories of its path that are left empty. Other objects sharing a
+// path prefix are not touched.
 func (s *Store) Delete(key string) error {
 	pathkey := s.PathTransformFunc(key)
-
-	if ok := s.Has(key); !ok {
-		return nil
+	fullPath := pathkey.FullPath(s.Root)
+
+	removed := false
+	for _, path := range []string{fullPath, s.metaPath(key)} {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		s.pruneDirs(filepath.Dir(fullPath))
+		fmt.Printf("Deleted [%s] from disk \n", fullPath)
 	}
 
-	defer func() {
-		fmt.Printf("Deleted [%s] from disk \n", pathkey.FullPath(s.Root))
-	}()
-
-	path := s.Root + "/" + strings.Split(pathkey.PathName, "/")[0]
+	idx, err := keyIndexFor(s.Root)
+	if err != nil {
+		return err
+	}
+	return idx.remove(key)
+}
 
-	return os.RemoveAll(path)
+// pruneDirs removes dir and its parents up to, but not including, the root
+// as long as they are empty. Removing a directory fails once anything is
+// created in it, so a concurrent write is never lost; see writeFileAtomic
+// for the other half.
+func (s *Store) pruneDirs(dir string) {
+	root := filepath.Clean(s.Root)
+
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
 }
 
 func (s *Store) Read(key string) (int64, io.ReadCloser, error) {
@@ -127,37 +158,121 @@ func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
 	return stat.Size(), f, nil
 }
 
+// Write stores the object read from r as a new version of key, together
+// with its metadata.
 func (s *Store) Write(key string, r io.Reader) (int64, error) {
 	return s.writeStream(key, r)
 }
 
-func (s *Store) openFileForWriting(key string) (*os.File, error) {
+// tempMarker is part of the name of every file that is still being written.
+// Files are renamed into place only once they are complete and synced, so a
+// crash leaves at most a temp file behind, which CleanTemp removes.
+const tempMarker = ".tmp-"
+
+// writeFunc writes the object key with write. The object only replaces the
+// previous one if write succeeds, and then prepare, which is called with the
+// name of the complete temp file right before it is renamed into place.
+func (s *Store) writeFunc(key string, write func(io.Writer) (int64, error), prepare func(tmp string) error) (int64, error) {
 	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s", s.Root, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
-	}
+	return writeFilePrepared(pathKey.FullPath(s.Root), write, prepare)
+}
+
+// createDirRetries bounds how often creating a temp file is retried when a
+// concurrent Delete pruned its directory in between.
+const createDirRetries = 5
 
-	return os.Create(pathKey.FullPath(s.Root))
+// writeFileAtomic writes path through a temp file in the same directory,
+// syncs it, renames it over path and syncs the directory. Missing
+// directories are created.
+func writeFileAtomic(path string, write func(io.Writer) (int64, error)) (int64, error) {
+	return writeFilePrepared(path, write, nil)
 }
 
-func (s *Store) writeDecrypt(encKey []byte, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
+// writeFilePrepared is writeFileAtomic, except that prepare, if not nil, is
+// called with the name of the synced temp file before it is renamed over
+// path. If prepare fails, path is left alone.
+func writeFilePrepared(path string, write func(io.Writer) (int64, error), prepare func(tmp string) error) (int64, error) {
+	dir, name := filepath.Split(path)
+
+	var (
+		f   *os.File
+		err error
+	)
+	for i := 0; i < createDirRetries; i++ {
+		// Once the temp file exists the directory is no longer empty and
+		// cannot be pruned until the file is renamed into place.
+		if err = os.MkdirAll(dir, os.ModePerm); err == nil {
+			f, err = os.CreateTemp(dir, name+tempMarker+"*")
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	n, err := copyDecrypt(encKey, r, f)
-	defer f.Close()
-	return int64(n), err
+	n, err := write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && prepare != nil {
+		err = prepare(f.Name())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+
+	return n, syncDir(dir)
 }
 
-func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer d.Close()
 
-	defer f.Close()
-	return io.Copy(f, r)
+	// Directories cannot be synced on Windows, renames are durable there.
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
+
+// CleanTemp removes the temp files of writes that never completed, and
+// settles the metadata of writes cut short between placing an object and
+// its metadata, see reconcileMeta. It must only run while nothing is
+// writing to the store, i.e. on startup.
+func (s *Store) CleanTemp() error {
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.Contains(d.Name(), tempMarker) {
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), metaSuffix) {
+			return reconcileMeta(path)
+		}
+
+		fmt.Printf("Removing unfinished write [%s]\n", path)
+		return os.Remove(path)
+	})
+	return err
+}
+
+func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
+	meta, err := s.WriteWithMeta(key, r, Meta{})
+	return meta.Size, err
 }
@@ -2,8 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"sync"
 	"testing"
 )
 
@@ -23,10 +29,32 @@ func TestPathTransformFunc(t *testing.T) {
 	}
 }
 
+// forEachBackend runs test against a fresh instance of every Backend.
+func forEachBackend(t *testing.T, test func(t *testing.T, b Backend)) {
+	backends := map[string]func(t *testing.T) Backend{
+		"store": func(t *testing.T) Backend {
+			return NewStore(&StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransform})
+		},
+		"memory": func(t *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+		"pack": func(t *testing.T) Backend {
+			return newPackStore(t, t.TempDir(), 0)
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			test(t, newBackend(t))
+		})
+	}
+}
+
 func TestStore(t *testing.T) {
-	s := newStore()
-	defer teardown(t, s)
+	forEachBackend(t, testStore)
+}
 
+func testStore(t *testing.T, s Backend) {
 	for i := 0; i < 50; i++ {
 		key := fmt.Sprintf("foo_%d", i)
 		data := []byte("some jpg bytes")
@@ -49,7 +77,7 @@ func TestStore(t *testing.T) {
 			t.Errorf("want %s have %s", data, b)
 		}
 
-		r.(io.ReadCloser).Close()
+		r.Close()
 
 		if err := s.Delete(key); err != nil {
 			t.Error(err)
@@ -61,6 +89,314 @@ func TestStore(t *testing.T) {
 	}
 }
 
+// sharedPrefixTransform puts every key under the same two directories.
+func sharedPrefixTransform(key string) PathKey {
+	return PathKey{
+		PathName: "shared/" + key[:1],
+		FileName: key,
+	}
+}
+
+func TestStoreDeleteKeepsSiblings(t *testing.T) {
+	s := NewStore(&StoreOpts{Root: t.TempDir(), PathTransformFunc: sharedPrefixTransform})
+
+	for _, key := range []string{"a1", "a2", "b1"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete("a1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has("a1") {
+		t.Error("a1 still exists")
+	}
+	if _, err := s.Stat("a1"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("metadata of a1 survived: %v", err)
+	}
+	if !s.Has("a2") || !s.Has("b1") {
+		t.Fatal("deleting a1 removed other keys")
+	}
+
+	s.Delete("a2")
+	if _, err := os.Stat(s.Root + "/shared/a"); !os.IsNotExist(err) {
+		t.Errorf("empty directory was not pruned: %v", err)
+	}
+
+	s.Delete("b1")
+	if _, err := os.Stat(s.Root + "/shared"); !os.IsNotExist(err) {
+		t.Errorf("empty directory was not pruned: %v", err)
+	}
+	if _, err := os.Stat(s.Root); err != nil {
+		t.Errorf("root must be kept: %v", err)
+	}
+}
+
+func TestStoreDeleteRacesWrite(t *testing.T) {
+	s := NewStore(&StoreOpts{Root: t.TempDir(), PathTransformFunc: sharedPrefixTransform})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", w)
+			for i := 0; i < 200; i++ {
+				if _, err := s.Write(key, bytes.NewReader([]byte("data"))); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.Delete(key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestStoreStat(t *testing.T) {
+	forEachBackend(t, testStoreStat)
+}
+
+func testStoreStat(t *testing.T, s Backend) {
+	if _, err := s.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+
+	data := []byte("some jpg bytes")
+	if _, err := s.Write("picture", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Stat("picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	if first.Key != "picture" || first.Size != int64(len(data)) || first.Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected metadata %+v", first)
+	}
+	if first.ContentHash != first.Checksum || first.PlainSize != first.Size {
+		t.Errorf("plaintext object must describe its content: %+v", first)
+	}
+
+	if _, err := s.Write("picture", bytes.NewReader([]byte("other bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Stat("picture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Version <= first.Version {
+		t.Errorf("version did not increase: %d then %d", first.Version, second.Version)
+	}
+	if !second.Created.Equal(first.Created) {
+		t.Errorf("creation time changed on overwrite: %v then %v", first.Created, second.Created)
+	}
+}
+
+// failingReader returns its data and then fails, like a dropped connection.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestStoreWriteIsAtomic(t *testing.T) {
+	forEachBackend(t, testStoreWriteIsAtomic)
+}
+
+func testStoreWriteIsAtomic(t *testing.T, s Backend) {
+	key := "atomic"
+	if _, err := s.Write(key, bytes.NewReader([]byte("old content"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Write(key, &failingReader{data: []byte("new")}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	_, r, err := s.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	r.Close()
+	if string(b) != "old content" {
+		t.Errorf("failed write replaced the object: %q", b)
+	}
+
+	if _, err := s.WriteWithMeta(key, bytes.NewReader([]byte("new")), Meta{Checksum: "bogus"}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if meta, _ := s.Stat(key); meta.Size != int64(len("old content")) {
+		t.Errorf("mismatching write replaced the metadata: %+v", meta)
+	}
+}
+
+func TestStoreList(t *testing.T) {
+	forEachBackend(t, testStoreList)
+}
+
+func testStoreList(t *testing.T, s Backend) {
+	for _, key := range []string{"photos/b", "docs/a", "photos/a", "photos/d"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := deleteReplica(s, "photos/c", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		keys   []string
+		pages  int
+		cursor string
+	)
+	for {
+		metas, next, err := s.List("photos/", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, meta := range metas {
+			keys = append(keys, meta.Key)
+			if meta.Deleted != (meta.Key == "photos/c") {
+				t.Errorf("wrong tombstone flag for %s", meta.Key)
+			}
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if fmt.Sprint(keys) != "[photos/a photos/b photos/c photos/d]" {
+		t.Errorf("got keys %v", keys)
+	}
+	if pages != 2 {
+		t.Errorf("got %d pages, want 2", pages)
+	}
+}
+
+func TestStoreKeyIndex(t *testing.T) {
+	root := t.TempDir()
+	s := NewStore(&StoreOpts{Root: root, PathTransformFunc: CASPathTransform})
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := s.Write(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func() string {
+		t.Helper()
+		forgetKeyIndex(root)
+		metas, _, err := NewStore(&StoreOpts{Root: root, PathTransformFunc: CASPathTransform}).List("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for _, meta := range metas {
+			keys = append(keys, meta.Key)
+		}
+		return fmt.Sprint(keys)
+	}
+
+	if got := list(); got != "[a c]" {
+		t.Errorf("got %s from the key index", got)
+	}
+
+	// Stores that predate the index get one built from their metadata.
+	if err := os.Remove(root + "/" + keyIndexFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := list(); got != "[a c]" {
+		t.Errorf("got %s from the rebuilt key index", got)
+	}
+}
+
+func TestStoreCleanTemp(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	key := "atomic"
+	if _, err := s.Write(key, bytes.NewReader([]byte("content"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leftovers of a crash are removed on startup.
+	pathKey := s.PathTransformFunc(key)
+	orphan := pathKey.FullPath(s.Root) + tempMarker + "123"
+	if err := os.WriteFile(orphan, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CleanTemp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("temp file survived CleanTemp: %v", err)
+	}
+	if !s.Has(key) {
+		t.Error("CleanTemp removed a complete object")
+	}
+}
+
+func TestStoreReconcileMeta(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	key := "atomic"
+	if _, err := s.WriteWithMeta(key, bytes.NewReader([]byte("v1")), Meta{Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	pathKey := s.PathTransformFunc(key)
+	path := pathKey.FullPath(s.Root)
+	sum := func(data string) string {
+		h := newHashWriter(io.Discard)
+		h.Write([]byte(data))
+		return h.Sum()
+	}
+
+	// A crash after the object of v2 was renamed into place, but not its
+	// metadata: the write is finished on startup.
+	if err := os.WriteFile(path, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetaFile(path+tempMarker+"1"+metaSuffix, Meta{Key: key, Version: 2, Size: 2, Checksum: sum("v2")}); err != nil {
+		t.Fatal(err)
+	}
+	// A crash before the object of v3 was: the write never happened.
+	if err := writeMetaFile(path+tempMarker+"2"+metaSuffix, Meta{Key: key, Version: 3, Size: 2, Checksum: sum("v3")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.CleanTemp(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Stat(key); err != nil || meta.Version != 2 || meta.Checksum != sum("v2") {
+		t.Errorf("got %+v, %v after CleanTemp, want version 2", meta, err)
+	}
+	for _, pending := range []string{"1", "2"} {
+		if _, err := os.Stat(path + tempMarker + pending + metaSuffix); !os.IsNotExist(err) {
+			t.Errorf("pending metadata %s survived CleanTemp: %v", pending, err)
+		}
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransform,
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// DefaultDownloadWorkers is the number of chunks of a file fetched at once
+// when FileServerOpts.DownloadWorkers is not set.
+const DefaultDownloadWorkers = 4
+
+// DefaultReadAhead is the number of chunks of a file fetched ahead of the
+// one being read when FileServerOpts.ReadAhead is not set.
+const DefaultReadAhead = 8
+
+// swarm downloads the chunks of a file to the local store, several at a
+// time and from every owner that holds them, in the order they are read.
+// Only the chunks within the read-ahead window of the reader are fetched,
+// unless the server fills its cache with whole files.
+type swarm struct {
+	s   *FileServer
+	key string
+
+	pieces map[string]*piece
+	order  []*piece
+	work   chan *piece
+	quit   chan struct{}
+	stop   sync.Once
+
+	mu       sync.Mutex
+	queued   int
+	closed   bool
+	peers    map[string]*peerStats
+	reported bool
+}
+
+// piece is a chunk to download. done is closed once it is stored locally or
+// err is set.
+type piece struct {
+	ref   ChunkRef
+	index int
+	done  chan struct{}
+	err   error
+}
+
+// peerStats records the chunks fetched from a peer.
+type peerStats struct {
+	inflight int
+	pieces   int
+	bytes    int64
+	elapsed  time.Duration
+}
+
+// throughput is in bytes per second; 0 before the first piece.
+func (p *peerStats) throughput() float64 {
+	if p.elapsed <= 0 {
+		return 0
+	}
+	return float64(p.bytes) / p.elapsed.Seconds()
+}
+
+// newSwarm starts downloading the chunks of the file key.
+func (s *FileServer) newSwarm(key string, chunks []ChunkRef) *swarm {
+	w := &swarm{
+		s:      s,
+		key:    key,
+		pieces: make(map[string]*piece),
+		quit:   make(chan struct{}),
+		peers:  make(map[string]*peerStats),
+	}
+
+	// A chunk that occurs more than once is fetched once.
+	for _, ref := range chunks {
+		if _, ok := w.pieces[ref.Hash]; ok {
+			continue
+		}
+		p := &piece{ref: ref, index: len(w.order), done: make(chan struct{})}
+		w.pieces[ref.Hash] = p
+		w.order = append(w.order, p)
+	}
+	w.work = make(chan *piece, len(w.order))
+
+	for i := 0; i < s.DownloadWorkers; i++ {
+		go func() {
+			for p := range w.work {
+				select {
+				case <-w.quit:
+					p.err = errors.New("download stopped")
+				default:
+					p.err = w.fetch(p.ref)
+				}
+				close(p.done)
+			}
+		}()
+	}
+
+	if s.FillCache {
+		w.queue(len(w.order))
+	} else {
+		w.queue(s.ReadAhead)
+	}
+	return w
+}
+
+// queue hands the pieces before index n in read order to the workers, if
+// they are not queued yet.
+func (w *swarm) queue(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ; w.queued < n && w.queued < len(w.order) && !w.closed; w.queued++ {
+		w.work <- w.order[w.queued]
+	}
+	if w.queued == len(w.order) && !w.closed {
+		w.closed = true
+		close(w.work)
+	}
+}
+
+// wait blocks until the chunk ref is stored locally, and moves the
+// read-ahead window to the chunks that follow it.
+func (w *swarm) wait(ref ChunkRef) error {
+	p := w.pieces[ref.Hash]
+	w.queue(p.index + 1 + w.s.ReadAhead)
+
+	w.mu.Lock()
+	stopped := p.index >= w.queued
+	w.mu.Unlock()
+	if stopped {
+		return errors.New("download stopped")
+	}
+
+	<-p.done
+	return p.err
+}
+
+// close stops the download; chunks being fetched are finished and the ones
+// not fetched yet are dropped.
+func (w *swarm) close() {
+	w.stop.Do(func() { close(w.quit) })
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.work)
+	}
+}
+
+// fetch stores the chunk ref locally, trying every owner in turn until one
+// sends it intact. The chunk is checked against its hash as it is written.
+func (w *swarm) fetch(ref ChunkRef) error {
+	key := chunkKey(ref.Hash)
+	if w.s.Store.Has(key) {
+		return nil
+	}
+
+	self, peers := w.s.owners(key)
+	if self {
+		if meta, err := w.s.Store.Stat(hashKey(key)); err == nil && !meta.Deleted && meta.ContentHash == ref.Hash {
+			err := w.s.decryptLocalReplica(key, meta)
+			if err == nil {
+				return nil
+			}
+			log.Printf("[%s] chunk %s of (%s) from the local replica: %v\n", w.s.Transport.Addr(), ref.Hash, w.key, err)
+		}
+	}
+
+	var (
+		tried = make(map[string]bool)
+		errs  []error
+	)
+	for {
+		peer, ok := w.pick(peers, tried)
+		if !ok {
+			break
+		}
+		tried[peer.ID()] = true
+
+		start := time.Now()
+		err := w.s.fetchChunk(peer, key, ref)
+		w.record(peer.ID(), ref.Size, time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+		log.Printf("[%s] chunk %s of (%s) from %s: %v\n", w.s.Transport.Addr(), ref.Hash, w.key, peer.ID(), err)
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return fmt.Errorf("chunk %s of (%s): no owner is connected", ref.Hash, w.key)
+	}
+	return fmt.Errorf("chunk %s of (%s) on %d owners: %w", ref.Hash, w.key, len(errs), errors.Join(errs...))
+}
+
+// pick returns the owner not tried yet with the fewest chunks in flight,
+// preferring the faster one, and counts the chunk against it.
+func (w *swarm) pick(peers []p2p.Peer, tried map[string]bool) (p2p.Peer, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var (
+		best      p2p.Peer
+		bestStats *peerStats
+	)
+	for _, peer := range peers {
+		if tried[peer.ID()] {
+			continue
+		}
+		st, ok := w.peers[peer.ID()]
+		if !ok {
+			st = &peerStats{}
+			w.peers[peer.ID()] = st
+		}
+		if best == nil || st.inflight < bestStats.inflight ||
+			st.inflight == bestStats.inflight && st.throughput() > bestStats.throughput() {
+			best, bestStats = peer, st
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	bestStats.inflight++
+	return best, true
+}
+
+func (w *swarm) record(id string, size int64, elapsed time.Duration, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	st := w.peers[id]
+	st.inflight--
+	if err == nil {
+		st.pieces++
+		st.bytes += size
+		st.elapsed += elapsed
+	}
+}
+
+// report logs how much of the file every peer sent and how fast, once.
+func (w *swarm) report() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.reported {
+		return
+	}
+	w.reported = true
+
+	ids := make([]string, 0, len(w.peers))
+	for id, st := range w.peers {
+		if st.pieces > 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		st := w.peers[id]
+		fmt.Printf("[%s] Fetched %d chunks (%d bytes) of (%s) from %s at %.1f KiB/s\n",
+			w.s.Transport.Addr(), st.pieces, st.bytes, w.key, id, st.throughput()/1024)
+	}
+}
+
+// fetchChunk downloads the replica of the chunk key from peer and stores the
+// decrypted chunk locally, provided it matches ref.
+func (s *FileServer) fetchChunk(peer p2p.Peer, key string, ref ChunkRef) error {
+	res, err := s.requestOne(peer, MessageGetFile{Key: hashKey(key), MetaOnly: true})
+	if err != nil {
+		return err
+	}
+	meta := res.(MessageGetFileReply).Meta
+	if !res.(MessageGetFileReply).Has || meta.Deleted || meta.ContentHash != ref.Hash {
+		return fmt.Errorf("replica of chunk %s holds %q", ref.Hash, meta.ContentHash)
+	}
+
+	p, err := s.fetchResumable(peer, hashKey(key), meta)
+	if err != nil {
+		return err
+	}
+	defer p.done()
+
+	return s.writeDecryptVerified(key, p.reader(), p.Size(), meta)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+)
+
+// corruptBackend flips a byte of every replica read from it.
+type corruptBackend struct {
+	Backend
+}
+
+func (b corruptBackend) Read(key string) (int64, io.ReadCloser, error) {
+	size, r, err := b.Backend.Read(key)
+	if err != nil {
+		return size, r, err
+	}
+	if meta, err := b.Backend.Stat(key); err != nil || !meta.Replica {
+		return size, r, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	data[len(data)/2] ^= 1
+	return size, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestSwarmRetriesPiece(t *testing.T) {
+	servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+		opts.ChunkSize = 4
+		if i == 1 {
+			opts.Backend = corruptBackend{NewMemoryBackend()}
+		}
+	})
+	data := []byte("aaaabbbbccccddddeeeeffffgggghhhh")
+
+	if err := servers[0].StoreWithConsistency("a", bytes.NewReader(data), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop every chunk servers[0] holds, so that all of them are fetched.
+	metas, _, err := servers[0].Store.List("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, meta := range metas {
+		if meta.Key == "a" || meta.Key == hashKey("a") {
+			continue
+		}
+		if err := servers[0].Store.Delete(meta.Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, r, err := servers[0].GetWithConsistency("a", ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("read %q, %v", b, err)
+	}
+
+	// servers[1] sent nothing intact; servers[2] sent every chunk, the
+	// ones that failed on servers[1] included.
+	w := r.(*chunkReader).swarm
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if st := w.peers[servers[1].NodeID]; st == nil || st.pieces != 0 {
+		t.Errorf("got %+v from the corrupt peer", st)
+	}
+	if st := w.peers[servers[2].NodeID]; st == nil || st.pieces != len(data)/4 {
+		t.Errorf("got %+v from the intact peer, want %d pieces", st, len(data)/4)
+	}
+}
+
+func TestSwarmReadAhead(t *testing.T) {
+	for _, fill := range []bool{false, true} {
+		servers := newTestCluster(t, 3, func(i int, opts *FileServerOpts) {
+			opts.ChunkSize = 4
+			opts.ReadAhead = 2
+			opts.FillCache = fill
+		})
+		data := []byte("aaaabbbbccccddddeeeeffffgggghhhh")
+
+		if err := servers[0].StoreWithConsistency("a", bytes.NewReader(data), ConsistencyAll); err != nil {
+			t.Fatal(err)
+		}
+		var chunks []string
+		for i := 0; i < len(data); i += 4 {
+			sum := sha256.Sum256(data[i : i+4])
+			key := chunkKey(hex.EncodeToString(sum[:]))
+			chunks = append(chunks, key)
+			if err := servers[0].Store.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		local := func() int {
+			n := 0
+			for _, key := range chunks {
+				if servers[0].Store.Has(key) {
+					n++
+				}
+			}
+			return n
+		}
+
+		_, r, err := servers[0].GetWithConsistency("a", ConsistencyAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil || string(b) != "aaaa" {
+			t.Fatalf("read %q, %v", b, err)
+		}
+
+		if fill {
+			// Every chunk is fetched although only the first one was read.
+			deadline := time.Now().Add(5 * time.Second)
+			for local() < len(chunks) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := local(); n != len(chunks) {
+				t.Errorf("filling the cache fetched %d of %d chunks", n, len(chunks))
+			}
+			r.(io.Closer).Close()
+			continue
+		}
+
+		// The chunk read and the two after it are fetched, and no more
+		// once the reader is closed.
+		r.(io.Closer).Close()
+		w := r.(*chunkReader).swarm
+		for _, p := range w.order[:3] {
+			<-p.done
+		}
+		w.mu.Lock()
+		queued := w.queued
+		w.mu.Unlock()
+		if queued != 3 {
+			t.Errorf("queued %d chunks, want 3", queued)
+		}
+		if n := local(); n > 3 {
+			t.Errorf("fetched %d of %d chunks after reading one", n, len(chunks))
+		}
+	}
+}
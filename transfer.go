@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ManManavadaria/Go_Distributed_Storage/p2p"
+)
+
+// DefaultTransferMaxAge is how long the bytes of an interrupted transfer are
+// kept for it to resume when FileServerOpts.TransferMaxAge is not set.
+const DefaultTransferMaxAge = 24 * time.Hour
+
+const transfersDir = ".transfers"
+
+const partialSuffix = ".part"
+
+// partialSyncBytes is how much of a transfer is written between two syncs.
+// The synced size of a partial is the offset its transfer resumes from.
+const partialSyncBytes = 4 << 20
+
+// transferSession returns the ID of a transfer of version of the object key,
+// whose bytes are identified by sum. Every attempt to transfer the same bytes
+// gets the same ID, whichever node they come from.
+func transferSession(key string, version int64, sum string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", key, version, sum)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// transfers keeps the bytes received by replica transfers, so that a
+// transfer cut off resumes where it stopped instead of starting over.
+type transfers struct {
+	dir    string
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	active  map[string]bool
+	cleaned time.Time
+}
+
+func newTransfers(root string, maxAge time.Duration) *transfers {
+	return &transfers{
+		dir:    filepath.Join(root, transfersDir),
+		maxAge: maxAge,
+		active: make(map[string]bool),
+	}
+}
+
+// open returns the bytes received so far in session, none for a new one.
+// A session is only resumed by one transfer at a time; a concurrent one
+// gets a partial of its own that is not kept.
+func (t *transfers) open(session string) (*partial, error) {
+	t.mu.Lock()
+	busy := t.active[session]
+	if !busy {
+		t.active[session] = true
+	}
+	clean := time.Since(t.cleaned) > time.Hour
+	if clean {
+		t.cleaned = time.Now()
+	}
+	t.mu.Unlock()
+
+	if clean {
+		t.clean()
+	}
+
+	p := &partial{t: t, session: session}
+	if err := os.MkdirAll(t.dir, os.ModePerm); err != nil {
+		p.release()
+		return nil, err
+	}
+
+	var err error
+	if busy {
+		p.session = ""
+		p.f, err = os.CreateTemp(t.dir, session+tempMarker)
+	} else {
+		p.f, err = os.OpenFile(filepath.Join(t.dir, session+partialSuffix), os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	if p.n, err = p.f.Seek(0, io.SeekEnd); err != nil {
+		p.f.Close()
+		p.release()
+		return nil, err
+	}
+	return p, nil
+}
+
+// clean removes the partials of transfers that did not resume in time.
+func (t *transfers) clean() {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < t.maxAge {
+			continue
+		}
+
+		t.mu.Lock()
+		active := t.active[strings.TrimSuffix(e.Name(), partialSuffix)]
+		t.mu.Unlock()
+		if active {
+			continue
+		}
+
+		log.Printf("dropping the transfer %s, last resumed at %s\n", e.Name(), info.ModTime().Format(time.RFC3339))
+		os.Remove(filepath.Join(t.dir, e.Name()))
+	}
+}
+
+// partial holds the bytes a transfer received so far. It appends what is
+// written to it.
+type partial struct {
+	t *transfers
+	// session is empty for a partial that is not kept.
+	session  string
+	f        *os.File
+	n        int64
+	unsynced int64
+}
+
+func (p *partial) Size() int64 {
+	return p.n
+}
+
+func (p *partial) Write(b []byte) (int, error) {
+	n, err := p.f.Write(b)
+	p.n += int64(n)
+	p.unsynced += int64(n)
+	if err == nil && p.unsynced >= partialSyncBytes {
+		err = p.f.Sync()
+		p.unsynced = 0
+	}
+	return n, err
+}
+
+// reset drops the bytes received so far.
+func (p *partial) reset() error {
+	if err := p.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := p.f.Seek(0, io.SeekStart)
+	p.n, p.unsynced = 0, 0
+	return err
+}
+
+// sum returns the hex encoded SHA-256 of the bytes received.
+func (p *partial) sum() (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, p.reader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reader returns the bytes received.
+func (p *partial) reader() io.Reader {
+	return io.NewSectionReader(p.f, 0, p.n)
+}
+
+// keep ends the transfer for now, to be resumed later.
+func (p *partial) keep() {
+	if p.session == "" {
+		p.done()
+		return
+	}
+	p.f.Sync()
+	p.f.Close()
+	p.release()
+}
+
+// done ends the transfer for good and removes what it received.
+func (p *partial) done() {
+	p.f.Close()
+	os.Remove(p.f.Name())
+	p.release()
+}
+
+func (p *partial) release() {
+	if p.session == "" {
+		return
+	}
+	p.t.mu.Lock()
+	delete(p.t.active, p.session)
+	p.t.mu.Unlock()
+}
+
+// fetchResumable downloads the replica key described by meta from peer. An
+// earlier download of the same replica, from any peer, is resumed where it
+// stopped, and kept if this one is cut off as well. The complete replica is
+// checked against meta.Checksum; the caller must call done on it.
+func (s *FileServer) fetchResumable(peer p2p.Peer, key string, meta Meta) (*partial, error) {
+	p, err := s.transfers.open(transferSession(key, meta.Version, meta.Checksum))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.resumeFetch(peer, key, meta, p); err != nil {
+		p.keep()
+		return nil, err
+	}
+
+	sum, err := p.sum()
+	if err == nil && sum != meta.Checksum {
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		p.done()
+		return nil, err
+	}
+	return p, nil
+}
+
+// resumeFetch appends the bytes of the replica p lacks, as sent by peer.
+func (s *FileServer) resumeFetch(peer p2p.Peer, key string, meta Meta, p *partial) error {
+	if p.Size() > meta.Size {
+		if err := p.reset(); err != nil {
+			return err
+		}
+	}
+	if p.Size() == meta.Size {
+		return nil
+	}
+
+	var (
+		res MessageGetFileReply
+		st  *p2p.Stream
+		err error
+	)
+	if p.Size() == 0 {
+		res, st, err = s.openReplica(peer, key)
+	} else {
+		fmt.Printf("[%s] Resuming (%s) from %s at %d of %d bytes\n", s.Transport.Addr(), key, peer.ID(), p.Size(), meta.Size)
+		res, st, err = s.openReplicaFrom(peer, key, p.Size())
+	}
+	if err != nil {
+		return err
+	}
+	// The checksum covers the whole replica, so a peer with the same one
+	// continues the very bytes received so far.
+	if res.Meta.Version != meta.Version || res.Meta.Checksum != meta.Checksum {
+		st.Reset()
+		return fmt.Errorf("[%s] replica (%s) changed on %s", s.Transport.Addr(), key, peer.ID())
+	}
+	if res.Size != meta.Size-p.Size() {
+		st.Reset()
+		return fmt.Errorf("[%s] replica (%s) on %s sent %d bytes from %d, want %d", s.Transport.Addr(), key, peer.ID(), res.Size, p.Size(), meta.Size-p.Size())
+	}
+
+	if _, err := io.Copy(p, io.LimitReader(st, res.Size)); err != nil {
+		st.Reset()
+		return err
+	}
+	if p.Size() != meta.Size {
+		st.Reset()
+		return fmt.Errorf("short stream for (%s): got %d of %d bytes", key, p.Size(), meta.Size)
+	}
+	return st.Close()
+}
+
+// skipWriter drops the first skip bytes written to it, which the peer it
+// writes to holds already.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip > 0 {
+		k := min(int64(len(p)), s.skip)
+		s.skip -= k
+		p = p[k:]
+	}
+	if len(p) > 0 {
+		if _, err := s.w.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTransfersResume(t *testing.T) {
+	tr := newTransfers(t.TempDir(), time.Hour)
+
+	p, err := tr.open("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Write([]byte("hello "))
+	p.keep()
+
+	// The session resumes with the bytes received before.
+	p, err = tr.open("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Size() != 6 {
+		t.Fatalf("resumed at %d, want 6", p.Size())
+	}
+
+	// A concurrent transfer of the session starts over and is not kept.
+	other, err := tr.open("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Size() != 0 {
+		t.Errorf("concurrent transfer starts at %d, want 0", other.Size())
+	}
+	other.Write([]byte("other"))
+	other.keep()
+	if _, err := os.Stat(other.f.Name()); !os.IsNotExist(err) {
+		t.Errorf("concurrent transfer was kept: %v", err)
+	}
+
+	p.Write([]byte("world"))
+	b, _ := io.ReadAll(p.reader())
+	if string(b) != "hello world" {
+		t.Errorf("got %q, want %q", b, "hello world")
+	}
+	p.done()
+
+	p, err = tr.open("session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.done()
+	if p.Size() != 0 {
+		t.Errorf("done transfer resumed at %d", p.Size())
+	}
+}
+
+func TestSkipWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &skipWriter{w: &buf, skip: 5}
+
+	for _, s := range []string{"abc", "defg", "hij"} {
+		if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if buf.String() != "fghij" {
+		t.Errorf("got %q, want %q", buf.String(), "fghij")
+	}
+}
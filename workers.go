@@ -0,0 +1,96 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+)
+
+// DefaultMessageWorkers is how many requests from peers a node handles at
+// once when FileServerOpts.MessageWorkers is not set.
+const DefaultMessageWorkers = 32
+
+// messageQueueLen bounds the requests waiting for each worker. A request
+// that finds its worker's queue full is dropped, and times out at the peer
+// that sent it.
+const messageQueueLen = 64
+
+type queuedMessage struct {
+	from string
+	msg  *Message
+}
+
+// messageWorkers handles the requests of peers on a fixed number of
+// goroutines, as handlers may block on streams for as long as a transfer
+// takes. The requests of one peer about one key always go to the same
+// worker, so they are handled in the order they arrived: a store followed
+// by a remove from the same coordinator is never reversed.
+type messageWorkers struct {
+	queues []chan queuedMessage
+	handle func(from string, msg *Message)
+}
+
+// newMessageWorkers starts n workers that hand the requests dispatched to
+// them to handle, until quit is closed.
+func newMessageWorkers(n int, handle func(from string, msg *Message), quit <-chan struct{}) *messageWorkers {
+	w := &messageWorkers{
+		queues: make([]chan queuedMessage, n),
+		handle: handle,
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan queuedMessage, messageQueueLen)
+		go w.run(w.queues[i], quit)
+	}
+	return w
+}
+
+func (w *messageWorkers) run(queue <-chan queuedMessage, quit <-chan struct{}) {
+	for {
+		select {
+		case m := <-queue:
+			w.handle(m.from, m.msg)
+		case <-quit:
+			return
+		}
+	}
+}
+
+// dispatch queues msg from the peer from with its worker. It never blocks,
+// so that the loop delivering replies is never held up by a busy worker.
+func (w *messageWorkers) dispatch(from string, msg *Message) {
+	h := fnv.New32a()
+	h.Write([]byte(from))
+	h.Write([]byte{0})
+	h.Write([]byte(messageKey(msg)))
+
+	select {
+	case w.queues[h.Sum32()%uint32(len(w.queues))] <- queuedMessage{from: from, msg: msg}:
+	default:
+		log.Printf("dropping message %d from %s: too many requests queued\n", msg.ID, from)
+	}
+}
+
+// messageKey returns the key a request is about, or "" for requests about
+// no single key.
+func messageKey(msg *Message) string {
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		return v.Key
+	case MessageGetFile:
+		return v.Key
+	case MessageRemoveFile:
+		return v.Key
+	}
+	return ""
+}
+
+// isReply tells replies, which are delivered to the request waiting for them
+// right away, from requests.
+func isReply(msg *Message) bool {
+	switch msg.Payload.(type) {
+	case MessageStoreFileReply, MessageGetFileReply, MessageRemoveFileReply,
+		MessageSyncTreeReply, MessageSyncBucketReply, MessageListKeysReply,
+		MessageChunkRefsReply:
+		return true
+	}
+	return false
+}
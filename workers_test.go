@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessageWorkers(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	var (
+		mu      sync.Mutex
+		order   = make(map[string][]uint64)
+		running atomic.Int32
+		most    atomic.Int32
+		wg      sync.WaitGroup
+	)
+	w := newMessageWorkers(4, func(from string, msg *Message) {
+		defer wg.Done()
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		order[from+"/"+messageKey(msg)] = append(order[from+"/"+messageKey(msg)], msg.ID)
+		mu.Unlock()
+	}, quit)
+
+	// A store and a remove of each key from each peer, interleaved.
+	var id uint64
+	for i := 0; i < 10; i++ {
+		for _, from := range []string{"a", "b", "c"} {
+			for _, key := range []string{"x", "y"} {
+				id++
+				wg.Add(1)
+				if i%2 == 0 {
+					w.dispatch(from, &Message{ID: id, Payload: MessageStoreFile{Key: key}})
+				} else {
+					w.dispatch(from, &Message{ID: id, Payload: MessageRemoveFile{Key: key}})
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	for key, ids := range order {
+		for i := 1; i < len(ids); i++ {
+			if ids[i] < ids[i-1] {
+				t.Errorf("%s: handled %v, not in the order sent", key, ids)
+				break
+			}
+		}
+	}
+	if n := most.Load(); n > 4 {
+		t.Errorf("%d messages handled at once, want at most 4", n)
+	}
+}